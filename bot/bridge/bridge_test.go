@@ -0,0 +1,376 @@
+package bridge_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/xor-shift/Shiba/bot/bridge"
+	"github.com/xor-shift/Shiba/bot/mbus"
+	"github.com/xor-shift/Shiba/bot/message"
+)
+
+//echoRequest is answered by the remote module with its text
+type echoRequest struct {
+	Text string
+}
+
+func (req echoRequest) GetType() int { return mbus.MTypGeneric }
+
+func init() {
+	mbus.RegisterMessageType("test.echo", echoRequest{})
+}
+
+//platformModule stands in for a platform, it gets the messages targeted at it
+type platformModule struct {
+	messages chan mbus.Message
+}
+
+func (mod *platformModule) GetIdentifier() mbus.ModuleIdentifier {
+	return mbus.ModuleIdentifier{MainIdent: "Test", SubIdent: "platform"}
+}
+
+func (mod *platformModule) Subscriptions() []mbus.Subscription { return nil }
+func (mod *platformModule) OnRegister(bus *mbus.Bus)           {}
+func (mod *platformModule) OnUnregister()                      {}
+func (mod *platformModule) OnMessage(msg mbus.Message)         { mod.messages <- msg }
+
+func next(t *testing.T, messages chan mbus.Message) mbus.Message {
+	select {
+	case msg := <-messages:
+		return msg
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for a message")
+		return nil
+	}
+}
+
+//setup runs a bus with a platform and a bridge server listening on a unix socket, the bus is shut down at the end
+func setup(t *testing.T) (*mbus.Bus, *platformModule, string) {
+	bus := mbus.New()
+	platform := &platformModule{messages: make(chan mbus.Message, 16)}
+	bus.RegisterModule(platform)
+	bus.RunAsync()
+
+	address := "unix:" + filepath.Join(t.TempDir(), "bus.sock")
+	listener, err := bridge.Listen(address)
+	if err != nil {
+		t.Fatalf("failed to listen: %s", err)
+	}
+
+	server := bridge.NewServer(bus)
+	served := make(chan error, 1)
+	go func() { served <- server.Serve(listener) }()
+
+	t.Cleanup(func() {
+		bus.Shutdown(context.Background())
+		server.Close()
+		if err := <-served; !errors.Is(err, bridge.ErrServerClosed) {
+			t.Errorf("Serve returned %v, expected %v", err, bridge.ErrServerClosed)
+		}
+	})
+
+	return bus, platform, address
+}
+
+func waitForState(t *testing.T, bus *mbus.Bus, identifier mbus.ModuleIdentifier, registered bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if state, ok := bus.ModuleState(identifier); ok == registered && (!ok || state == mbus.StateRunning) {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("%s didn't get registered=%v", identifier.String(), registered)
+}
+
+func TestClient(t *testing.T) {
+	ctx := context.Background()
+	bus, platform, address := setup(t)
+	remote := mbus.ModuleIdentifier{MainIdent: "Plugin", SubIdent: "echo"}
+
+	client, err := bridge.Dial(address)
+	if err != nil {
+		t.Fatalf("failed to dial: %s", err)
+	}
+
+	//the remote module echoes chat messages to their senders and answers echo requests, handled gets how that went
+	handled := make(chan error, 1)
+	err = client.Register(ctx, remote, []bridge.Subscription{{Types: []int{mbus.MTypIncomingChat}}}, func(msg mbus.Message) {
+		switch msg := msg.(type) {
+		case mbus.IncomingChatMessage:
+			handled <- client.Publish(ctx, msg.MakeReply(msg.Message))
+		case mbus.RequestMessage:
+			req := msg.Payload.(echoRequest)
+			var replyErr error
+			if req.Text == "" {
+				replyErr = errors.New("nothing to echo")
+			}
+			handled <- client.Reply(ctx, msg, req, replyErr)
+		default:
+			t.Errorf("the remote module got a %T", msg)
+		}
+	})
+	if err != nil {
+		t.Fatalf("failed to register: %s", err)
+	}
+	waitForState(t, bus, remote, true)
+
+	Handled := func(what string) {
+		select {
+		case err := <-handled:
+			if err != nil {
+				t.Errorf("the remote module failed to handle %s: %s", what, err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for the remote module to handle %s", what)
+		}
+	}
+
+	if err := client.Register(ctx, platform.GetIdentifier(), nil, func(mbus.Message) {}); !errors.Is(err, bridge.ErrRejected) {
+		t.Errorf("got error %v for a taken identifier, expected %v", err, bridge.ErrRejected)
+	}
+
+	bus.NewMessage(mbus.IncomingChatMessage{
+		SourceModule: platform.GetIdentifier(),
+		ReplyTo:      "#chan",
+		Message:      message.PlaintextToMessage("hello"),
+	})
+	Handled("a chat message")
+	if reply, ok := next(t, platform.messages).(mbus.OutgoingChatMessage); !ok || reply.To != "#chan" || message.MessageToPlaintext(reply.Message) != "hello" {
+		t.Errorf("got %#v, expected the message to be echoed", reply)
+	}
+
+	if reply, err := bus.Request(ctx, remote, echoRequest{Text: "echo"}); err != nil || reply != (echoRequest{Text: "echo"}) {
+		t.Errorf("got %#v and error %v for a request, expected it to be echoed", reply, err)
+	}
+	Handled("a request")
+	if _, err := bus.Request(ctx, remote, echoRequest{}); err == nil || err.Error() != "nothing to echo" {
+		t.Errorf("got error %v for a request, expected the error of the remote module", err)
+	}
+	Handled("a failing request")
+
+	if err := client.Publish(ctx, struct{ mbus.Message }{}); !errors.Is(err, mbus.ErrUnknownMessageType) {
+		t.Errorf("got error %v for publishing an unregistered type, expected %v", err, mbus.ErrUnknownMessageType)
+	}
+
+	//modules are unregistered along with the connection
+	client.Close()
+	waitForState(t, bus, remote, false)
+}
+
+func TestListen(t *testing.T) {
+	dir := t.TempDir()
+	socket := filepath.Join(dir, "bus.sock")
+
+	tests := []struct {
+		address string
+		err     error
+	}{
+		{"tcp:127.0.0.1:0", nil},
+		{"tcp:[::1]:0", nil},
+		{"tcp:localhost:0", nil},
+		{"tcp::9000", bridge.ErrNotLoopback},
+		{"tcp:0.0.0.0:9000", bridge.ErrNotLoopback},
+		{"tcp:[::]:9000", bridge.ErrNotLoopback},
+		{"tcp:example.com:9000", bridge.ErrNotLoopback},
+		{"udp:127.0.0.1:9000", bridge.ErrBadAddress},
+		{"unix:" + socket, nil},
+	}
+
+	for k, v := range tests {
+		listener, err := bridge.Listen(v.address)
+		if (err == nil) != (v.err == nil) || !errors.Is(err, v.err) {
+			t.Errorf("(test %d) got error %v for %q, expected %v", k, err, v.address, v.err)
+		}
+		if err == nil {
+			listener.Close()
+		}
+	}
+
+	//a socket left behind by a previous run is replaced and only the owner can access the new one
+	stale, err := net.ListenUnix("unix", &net.UnixAddr{Name: socket, Net: "unix"})
+	if err != nil {
+		t.Fatalf("failed to create a socket: %s", err)
+	}
+	stale.SetUnlinkOnClose(false)
+	stale.Close()
+
+	listener, err := bridge.Listen("unix:" + socket)
+	if err != nil {
+		t.Fatalf("failed to listen over a stale socket: %s", err)
+	}
+	if info, err := os.Stat(socket); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("got %v and error %v for the socket, expected mode 0600", info, err)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("got %d entries next to the socket, expected the private directory to be removed", len(entries))
+	}
+	listener.Close()
+	if _, err := os.Lstat(socket); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("got error %v for the socket of a closed listener, expected it to be removed", err)
+	}
+
+	//anything else at the path is left alone
+	if err := os.WriteFile(socket, nil, 0600); err != nil {
+		t.Fatalf("failed to create a file: %s", err)
+	}
+	if listener, err := bridge.Listen("unix:" + socket); err == nil {
+		listener.Close()
+		t.Errorf("listened on a path that isn't a socket")
+	}
+}
+
+func TestServer_Unregister(t *testing.T) {
+	ctx := context.Background()
+	bus, _, _ := setup(t)
+	server := bridge.NewServer(bus)
+	remote := mbus.ModuleIdentifier{MainIdent: "Plugin", SubIdent: "raw"}
+
+	//frames are written by hand to check what the bot sends
+	serverConn, clientConn := net.Pipe()
+	go server.ServeConn(serverConn)
+	defer server.Close()
+
+	Send := func(frame bridge.Frame) {
+		if err := bridge.WriteFrame(clientConn, frame); err != nil {
+			t.Fatalf("failed to write a frame: %s", err)
+		}
+	}
+	Expect := func(expected bridge.Frame) {
+		frame, err := bridge.ReadFrame(clientConn)
+		if err != nil {
+			t.Fatalf("failed to read a frame: %s", err)
+		}
+		if frame.Op != expected.Op || frame.ID != expected.ID || (frame.Error == "") != (expected.Error == "") ||
+			(expected.Module != nil && (frame.Module == nil || *frame.Module != *expected.Module)) {
+			t.Fatalf("got frame %#v, expected %#v", frame, expected)
+		}
+	}
+
+	Send(bridge.Frame{Op: "bogus", ID: 1})
+	Expect(bridge.Frame{Op: bridge.OpAck, ID: 1, Error: "unknown op"})
+
+	Send(bridge.Frame{Op: bridge.OpUnregister, ID: 2, Module: &remote})
+	Expect(bridge.Frame{Op: bridge.OpAck, ID: 2, Error: "not the owner"})
+
+	//an empty list of subscriptions only gets targeted messages
+	Send(bridge.Frame{Op: bridge.OpRegister, ID: 3, Module: &remote, Subscriptions: &[]bridge.Subscription{}})
+	Expect(bridge.Frame{Op: bridge.OpAck, ID: 3})
+	waitForState(t, bus, remote, true)
+
+	bus.NewMessage(mbus.PlatformConnectedMessage{SourceModule: remote})
+	bus.NewMessage(mbus.ModuleControlMessage{TargetModule: remote, StrArgv: []string{"hi"}})
+	Expect(bridge.Frame{Op: bridge.OpMessage, Module: &remote})
+
+	Send(bridge.Frame{Op: bridge.OpUnregister, ID: 4, Module: &remote})
+	Expect(bridge.Frame{Op: bridge.OpUnregistered, Module: &remote})
+	Expect(bridge.Frame{Op: bridge.OpAck, ID: 4})
+	waitForState(t, bus, remote, false)
+
+	//the bot lets clients know when it unregisters their modules
+	Send(bridge.Frame{Op: bridge.OpRegister, ID: 5, Module: &remote})
+	Expect(bridge.Frame{Op: bridge.OpAck, ID: 5})
+	waitForState(t, bus, remote, true)
+
+	go bus.Shutdown(ctx)
+	for {
+		frame, err := bridge.ReadFrame(clientConn)
+		if err != nil {
+			t.Fatalf("failed to read a frame: %s", err)
+		}
+		if frame.Op == bridge.OpUnregistered && *frame.Module == remote {
+			break
+		}
+	}
+}
+
+func TestServer_StalledClient(t *testing.T) {
+	bus, _, _ := setup(t)
+	server := bridge.NewServer(bus)
+	remote := mbus.ModuleIdentifier{MainIdent: "Plugin", SubIdent: "stalled"}
+
+	serverConn, clientConn := net.Pipe()
+	go server.ServeConn(serverConn)
+	defer server.Close()
+
+	if err := bridge.WriteFrame(clientConn, bridge.Frame{Op: bridge.OpRegister, ID: 1, Module: &remote}); err != nil {
+		t.Fatalf("failed to write a frame: %s", err)
+	}
+	if _, err := bridge.ReadFrame(clientConn); err != nil {
+		t.Fatalf("failed to read a frame: %s", err)
+	}
+	waitForState(t, bus, remote, true)
+
+	//the client stops reading while the bot fills up its outbox
+	for i := 0; i < 2*bridge.OutboxSize; i++ {
+		bus.NewMessage(mbus.ModuleControlMessage{TargetModule: remote})
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	start := time.Now()
+	bus.UnregisterModule(remote)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("unregistering the module of a stalled client took %s", elapsed)
+	}
+}
+
+func TestServer_Publish(t *testing.T) {
+	ctx := context.Background()
+	bus, platform, address := setup(t)
+	remote := mbus.ModuleIdentifier{MainIdent: "Plugin", SubIdent: "weather"}
+
+	client, err := bridge.Dial(address)
+	if err != nil {
+		t.Fatalf("failed to dial: %s", err)
+	}
+	defer client.Close()
+
+	if err := client.Register(ctx, remote, []bridge.Subscription{}, func(mbus.Message) {}); err != nil {
+		t.Fatalf("failed to register: %s", err)
+	}
+	waitForState(t, bus, remote, true)
+
+	tests := []struct {
+		msg     mbus.Message
+		allowed bool
+	}{
+		{mbus.OutgoingChatMessage{TargetModule: platform.GetIdentifier(), To: "#chan", Message: message.PlaintextToMessage("first")}, true},
+		{mbus.IncomingChatMessage{SourceModule: remote, SenderIdent: "Plugin:weather:someone", ReplyTo: "#chan"}, true},
+		{mbus.PlatformConnectedMessage{SourceModule: remote}, true},
+		{mbus.PlatformDisconnectedMessage{SourceModule: remote, Reason: "bye"}, true},
+
+		//others can't be impersonated
+		{mbus.IncomingChatMessage{SourceModule: remote, SenderIdent: "Test:platform:admin!a@host", ReplyTo: "#chan"}, false},
+		{mbus.IncomingChatMessage{SourceModule: platform.GetIdentifier(), SenderIdent: "Test:platform:admin!a@host", ReplyTo: "#chan"}, false},
+		{mbus.PlatformDisconnectedMessage{SourceModule: platform.GetIdentifier()}, false},
+
+		//and modules can't be controlled
+		{mbus.ModuleControlMessage{TargetModule: platform.GetIdentifier(), StrArgv: []string{}}, false},
+		{mbus.ModuleStateMessage{Module: platform.GetIdentifier(), Previous: mbus.StateRunning, State: mbus.StateFailed}, false},
+		{mbus.ModuleHealthMessage{}, false},
+		{mbus.RequestMessage{ID: 1, TargetModule: platform.GetIdentifier(), Payload: echoRequest{}}, false},
+
+		{mbus.OutgoingChatMessage{TargetModule: platform.GetIdentifier(), To: "#chan", Message: message.PlaintextToMessage("last")}, true},
+	}
+
+	for nTest, test := range tests {
+		err := client.Publish(ctx, test.msg)
+		if test.allowed && err != nil {
+			t.Errorf("(test %d) got error %v for publishing a %T, expected it to be published", nTest, err, test.msg)
+		} else if !test.allowed && !errors.Is(err, bridge.ErrRejected) {
+			t.Errorf("(test %d) got error %v for publishing a %T, expected %v", nTest, err, test.msg, bridge.ErrRejected)
+		}
+	}
+
+	//the platform only gets the chat messages, the control message never reached it
+	for _, expected := range []string{"first", "last"} {
+		if msg, ok := next(t, platform.messages).(mbus.OutgoingChatMessage); !ok || message.MessageToPlaintext(msg.Message) != expected {
+			t.Errorf("got %#v, expected the message %q", msg, expected)
+		}
+	}
+}
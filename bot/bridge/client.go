@@ -0,0 +1,286 @@
+package bridge
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+
+	"github.com/xor-shift/Shiba/bot/mbus"
+)
+
+var (
+	//ErrRejected wraps the errors the server answers frames with
+	ErrRejected = errors.New("rejected by the bridge")
+	ErrClosed   = errors.New("bridge connection closed")
+)
+
+//Handler is called with the messages routed to a remote module
+type Handler func(msg mbus.Message)
+
+//Client connects a process to the bus of a bot, modules registered through it get their messages from the bot
+//Handlers are called one at a time from a goroutine of the client, they may publish and reply but shouldn't block for long
+type Client struct {
+	conn       net.Conn
+	writeMutex *sync.Mutex
+
+	mutex    *sync.Mutex
+	lastID   uint64
+	acks     map[uint64]chan error
+	handlers map[mbus.ModuleIdentifier]Handler
+	err      error
+
+	//deliveries queues the message frames for deliveryWorker so that reading acks never waits for a handler
+	deliveries []Frame
+	delivery   *sync.Cond
+
+	done chan struct{}
+}
+
+//Dial connects to a unix:/path or tcp:host:port address
+func Dial(address string) (*Client, error) {
+	network, addr, err := splitAddress(address)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := net.Dial(network, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewClient(conn), nil
+}
+
+//NewClient speaks the protocol over an established connection
+func NewClient(conn net.Conn) *Client {
+	mutex := &sync.Mutex{}
+	client := &Client{
+		conn:       conn,
+		writeMutex: &sync.Mutex{},
+
+		mutex:    mutex,
+		acks:     make(map[uint64]chan error),
+		handlers: make(map[mbus.ModuleIdentifier]Handler),
+
+		deliveries: make([]Frame, 0),
+		delivery:   sync.NewCond(mutex),
+
+		done: make(chan struct{}),
+	}
+
+	go client.readWorker()
+	go client.deliveryWorker()
+
+	return client
+}
+
+func (client *Client) readWorker() {
+	reader := bufio.NewReader(client.conn)
+
+	for {
+		frame, err := ReadFrame(reader)
+		if err != nil {
+			if err == io.EOF {
+				err = ErrClosed
+			}
+			client.fail(err)
+			return
+		}
+
+		client.mutex.Lock()
+		switch frame.Op {
+		case OpAck:
+			if ack, ok := client.acks[frame.ID]; ok {
+				delete(client.acks, frame.ID)
+				if frame.Error != "" {
+					ack <- fmt.Errorf("%w: %s", ErrRejected, frame.Error)
+				} else {
+					ack <- nil
+				}
+			}
+		case OpMessage, OpUnregistered:
+			client.deliveries = append(client.deliveries, frame)
+			client.delivery.Signal()
+		default:
+			log.Printf("Ignoring a bridge frame with the unknown op %q", frame.Op)
+		}
+		client.mutex.Unlock()
+	}
+}
+
+//deliveryWorker passes the queued messages to the handlers until the client is closed
+func (client *Client) deliveryWorker() {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+
+	for {
+		for len(client.deliveries) == 0 && client.err == nil {
+			client.delivery.Wait()
+		}
+		if len(client.deliveries) == 0 {
+			return
+		}
+
+		frame := client.deliveries[0]
+		client.deliveries[0] = Frame{}
+		client.deliveries = client.deliveries[1:]
+
+		if frame.Module == nil {
+			continue
+		}
+
+		handler, ok := client.handlers[*frame.Module]
+		if frame.Op == OpUnregistered {
+			delete(client.handlers, *frame.Module)
+			continue
+		} else if !ok {
+			continue
+		}
+
+		msg, err := mbus.UnmarshalMessage(frame.Message)
+		if err != nil {
+			log.Printf("Dropping a message for %s: %s", frame.Module.String(), err)
+			continue
+		}
+
+		client.mutex.Unlock()
+		handler(msg)
+		client.mutex.Lock()
+	}
+}
+
+//fail closes the connection and fails everything waiting for an ack, the first error is kept
+func (client *Client) fail(err error) {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+
+	if client.err != nil {
+		return
+	}
+
+	client.err = err
+	client.conn.Close()
+	for id, ack := range client.acks {
+		delete(client.acks, id)
+		ack <- err
+	}
+	client.delivery.Broadcast()
+	close(client.done)
+}
+
+//call sends a frame and waits for the server to acknowledge it
+func (client *Client) call(ctx context.Context, frame Frame) error {
+	ack := make(chan error, 1)
+
+	client.mutex.Lock()
+	if client.err != nil {
+		client.mutex.Unlock()
+		return client.err
+	}
+	client.lastID++
+	frame.ID = client.lastID
+	client.acks[frame.ID] = ack
+	client.mutex.Unlock()
+
+	client.writeMutex.Lock()
+	err := WriteFrame(client.conn, frame)
+	client.writeMutex.Unlock()
+
+	if err != nil {
+		client.fail(err)
+		return err
+	}
+
+	select {
+	case err := <-ack:
+		return err
+	case <-ctx.Done():
+		client.mutex.Lock()
+		delete(client.acks, frame.ID)
+		client.mutex.Unlock()
+		return ctx.Err()
+	}
+}
+
+//Register registers a module on the bus, subscriptions work like mbus.Subscriber.Subscriptions with nil meaning every
+//message
+//The handler is dropped when the module is unregistered, either by the client or by the bot
+func (client *Client) Register(ctx context.Context, module mbus.ModuleIdentifier, subscriptions []Subscription, handler Handler) error {
+	frame := Frame{Op: OpRegister, Module: &module}
+	if subscriptions != nil {
+		frame.Subscriptions = &subscriptions
+	}
+
+	//messages might arrive before the ack
+	client.mutex.Lock()
+	if _, exists := client.handlers[module]; exists {
+		client.mutex.Unlock()
+		return fmt.Errorf("%w: %s", ErrModuleExists, module.String())
+	}
+	client.handlers[module] = handler
+	client.mutex.Unlock()
+
+	if err := client.call(ctx, frame); err != nil {
+		client.mutex.Lock()
+		delete(client.handlers, module)
+		client.mutex.Unlock()
+		return err
+	}
+
+	return nil
+}
+
+func (client *Client) Unregister(ctx context.Context, module mbus.ModuleIdentifier) error {
+	return client.call(ctx, Frame{Op: OpUnregister, Module: &module})
+}
+
+//Publish publishes a message of a type registered with mbus.RegisterMessageType on the bus
+func (client *Client) Publish(ctx context.Context, msg mbus.Message) error {
+	data, err := mbus.MarshalMessage(msg)
+	if err != nil {
+		return err
+	}
+
+	return client.call(ctx, Frame{Op: OpPublish, Message: data})
+}
+
+//Reply answers a request sent to one of the modules of the client, reply may be nil
+func (client *Client) Reply(ctx context.Context, request mbus.RequestMessage, reply mbus.Message, replyErr error) error {
+	frame := Frame{Op: OpReply, Module: &request.TargetModule, Request: request.ID}
+
+	if reply != nil {
+		data, err := mbus.MarshalMessage(reply)
+		if err != nil {
+			return err
+		}
+		frame.Message = data
+	}
+	if replyErr != nil {
+		frame.Error = replyErr.Error()
+	}
+
+	return client.call(ctx, frame)
+}
+
+//Close disconnects from the bot, the modules of the client are unregistered
+func (client *Client) Close() error {
+	client.fail(ErrClosed)
+	return nil
+}
+
+//Done is closed once the connection is lost or closed, Err tells why
+func (client *Client) Done() <-chan struct{} {
+	return client.done
+}
+
+func (client *Client) Err() error {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+
+	return client.err
+}
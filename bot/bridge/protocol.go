@@ -0,0 +1,199 @@
+package bridge
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/xor-shift/Shiba/bot/mbus"
+)
+
+//The protocol is described in protocol.md, frames are JSON objects preceded by their length
+
+const (
+	//MaxFrameLength is the longest frame either side accepts, in bytes and without the length prefix
+	MaxFrameLength = 1 << 20
+
+	//OpRegister registers a module for the connection, see Frame.Module and Frame.Subscriptions
+	OpRegister = "register"
+	//OpUnregister unregisters a module of the connection
+	OpUnregister = "unregister"
+	//OpPublish publishes Frame.Message on the bus
+	OpPublish = "publish"
+	//OpReply answers the request Frame.Request sent to Frame.Module with Frame.Message or Frame.Error
+	OpReply = "reply"
+
+	//OpAck answers every frame sent by a client, Frame.Error is set if it failed
+	OpAck = "ack"
+	//OpMessage carries Frame.Message, which was routed to Frame.Module
+	OpMessage = "message"
+	//OpUnregistered tells the client that Frame.Module was removed from the bus
+	OpUnregistered = "unregistered"
+)
+
+var (
+	ErrFrameTooLong = errors.New("frame too long")
+	ErrBadAddress   = errors.New("addresses look like unix:/path/to/socket or tcp:host:port")
+	ErrNotLoopback  = errors.New("the bridge only listens on loopback addresses")
+)
+
+//Frame is the unit of the protocol, only the fields relevant to Op are set
+type Frame struct {
+	Op string `json:"op"`
+	//ID is chosen by the client and echoed in the ack of the frame
+	ID     uint64                 `json:"id,omitempty"`
+	Module *mbus.ModuleIdentifier `json:"module,omitempty"`
+	//Subscriptions of a registered module, nil means every message and an empty list only the targeted ones
+	Subscriptions *[]Subscription `json:"subscriptions,omitempty"`
+	//Message is in the form written by mbus.MarshalMessage
+	Message json.RawMessage `json:"message,omitempty"`
+	Request uint64          `json:"request,omitempty"`
+	Error   string          `json:"error,omitempty"`
+}
+
+//Subscription is the serialisable part of mbus.Subscription
+type Subscription struct {
+	Types   []int                   `json:"types,omitempty"`
+	Sources []mbus.ModuleIdentifier `json:"sources,omitempty"`
+}
+
+func (sub Subscription) toBus() mbus.Subscription {
+	return mbus.Subscription{
+		Types:   sub.Types,
+		Sources: sub.Sources,
+	}
+}
+
+//ReadFrame reads a length prefixed frame
+func ReadFrame(reader io.Reader) (Frame, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return Frame{}, err
+	}
+
+	length := binary.BigEndian.Uint32(header)
+	if length > MaxFrameLength {
+		return Frame{}, fmt.Errorf("%w: %d bytes", ErrFrameTooLong, length)
+	}
+
+	body := make([]byte, length)
+	if _, err := io.ReadFull(reader, body); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return Frame{}, err
+	}
+
+	frame := Frame{}
+	if err := json.Unmarshal(body, &frame); err != nil {
+		return Frame{}, err
+	}
+
+	return frame, nil
+}
+
+//WriteFrame writes a frame with its length prefix in a single write
+func WriteFrame(writer io.Writer, frame Frame) error {
+	body, err := json.Marshal(frame)
+	if err != nil {
+		return err
+	}
+
+	if len(body) > MaxFrameLength {
+		return fmt.Errorf("%w: %d bytes", ErrFrameTooLong, len(body))
+	}
+
+	data := make([]byte, 4, 4+len(body))
+	binary.BigEndian.PutUint32(data, uint32(len(body)))
+	data = append(data, body...)
+
+	_, err = writer.Write(data)
+	return err
+}
+
+//splitAddress splits unix:/path and tcp:host:port addresses into a network and an address for the net package
+func splitAddress(address string) (string, string, error) {
+	network, addr, ok := strings.Cut(address, ":")
+	if !ok || addr == "" || (network != "unix" && network != "tcp") {
+		return "", "", fmt.Errorf("%w, got %q", ErrBadAddress, address)
+	}
+
+	return network, addr, nil
+}
+
+//Listen listens on a unix:/path or tcp:host:port address, clients aren't authenticated so TCP addresses have to be
+//loopback ones
+//Unix sockets are only accessible by the user running the bot and a socket left behind by a previous run is replaced
+func Listen(address string) (net.Listener, error) {
+	network, addr, err := splitAddress(address)
+	if err != nil {
+		return nil, err
+	}
+
+	if network == "unix" {
+		return listenUnix(addr)
+	}
+
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return nil, fmt.Errorf("%w, got %q", ErrNotLoopback, address)
+	}
+
+	return net.Listen(network, addr)
+}
+
+//unixListener removes its socket when closed, the socket was moved into place so the listener can't do it itself
+type unixListener struct {
+	*net.UnixListener
+	path string
+}
+
+func (listener *unixListener) Close() error {
+	err := listener.UnixListener.Close()
+	if removeErr := os.Remove(listener.path); removeErr != nil && err == nil && !errors.Is(removeErr, os.ErrNotExist) {
+		err = removeErr
+	}
+	return err
+}
+
+//listenUnix creates the socket in a private directory and moves it into place once only the owner can access it
+func listenUnix(path string) (net.Listener, error) {
+	if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSocket == 0 {
+		return nil, fmt.Errorf("%s exists and isn't a socket", path)
+	}
+
+	dir, err := os.MkdirTemp(filepath.Dir(path), ".bridge-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	tmpPath := filepath.Join(dir, "socket")
+	listener, err := net.ListenUnix("unix", &net.UnixAddr{Name: tmpPath, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	listener.SetUnlinkOnClose(false)
+
+	if err := os.Chmod(tmpPath, 0600); err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	//a socket left behind is replaced
+	if err := os.Rename(tmpPath, path); err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	return &unixListener{UnixListener: listener, path: path}, nil
+}
@@ -0,0 +1,430 @@
+package bridge
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/xor-shift/Shiba/bot/mbus"
+)
+
+const (
+	//WriteTimeout is how long a client gets to read a frame before it is disconnected
+	WriteTimeout = 10 * time.Second
+	//OutboxSize is the number of frames waiting to be written to a client, messages for a client that is that far behind
+	//are dropped
+	OutboxSize = 256
+)
+
+var (
+	ErrServerClosed = errors.New("bridge server closed")
+	ErrModuleExists = errors.New("a module with the identifier is already registered")
+	ErrNotOwner     = errors.New("the module isn't registered by this connection")
+	ErrBadFrame     = errors.New("bad frame")
+	ErrSlowClient   = errors.New("the client isn't reading its frames")
+	ErrForbidden    = errors.New("clients can't publish this message")
+
+	//InboxOptions are used for remote modules, a slow client loses its oldest messages instead of holding up the bus
+	InboxOptions = mbus.InboxOptions{
+		Size:     256,
+		Overflow: mbus.OverflowDropOldest,
+	}
+)
+
+//Server exposes a bus to other processes, which register remote modules and publish messages through it
+//Clients aren't authenticated, Listen only creates private unix sockets and loopback TCP listeners and clients can only
+//publish chat messages and the messages of platforms they registered
+type Server struct {
+	bus *mbus.Bus
+
+	mutex       *sync.Mutex
+	closed      bool
+	listeners   map[net.Listener]struct{}
+	connections map[*connection]struct{}
+	wg          *sync.WaitGroup
+
+	//registerMutex makes checking for existing modules and registering a remote one atomic across connections
+	registerMutex *sync.Mutex
+}
+
+func NewServer(bus *mbus.Bus) *Server {
+	return &Server{
+		bus: bus,
+
+		mutex:       &sync.Mutex{},
+		listeners:   make(map[net.Listener]struct{}),
+		connections: make(map[*connection]struct{}),
+		wg:          &sync.WaitGroup{},
+
+		registerMutex: &sync.Mutex{},
+	}
+}
+
+//Serve accepts connections until the listener fails or the server is closed, in which case ErrServerClosed is returned
+func (server *Server) Serve(listener net.Listener) error {
+	server.mutex.Lock()
+	if server.closed {
+		server.mutex.Unlock()
+		listener.Close()
+		return ErrServerClosed
+	}
+	server.listeners[listener] = struct{}{}
+	server.mutex.Unlock()
+
+	defer func() {
+		server.mutex.Lock()
+		delete(server.listeners, listener)
+		server.mutex.Unlock()
+	}()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			server.mutex.Lock()
+			closed := server.closed
+			server.mutex.Unlock()
+
+			if closed {
+				return ErrServerClosed
+			}
+			return err
+		}
+
+		go server.ServeConn(conn)
+	}
+}
+
+//ServeConn serves a single client and closes the connection when done, its modules are unregistered once it's closed
+func (server *Server) ServeConn(netConn net.Conn) {
+	conn := &connection{
+		server:  server,
+		conn:    netConn,
+		outbox:  make(chan Frame, OutboxSize),
+		closing: make(chan struct{}),
+		mutex:   &sync.Mutex{},
+		modules: make(map[mbus.ModuleIdentifier]*remoteModule),
+	}
+
+	server.mutex.Lock()
+	if server.closed {
+		server.mutex.Unlock()
+		netConn.Close()
+		return
+	}
+	server.connections[conn] = struct{}{}
+	server.wg.Add(1)
+	server.mutex.Unlock()
+
+	defer func() {
+		server.mutex.Lock()
+		delete(server.connections, conn)
+		server.mutex.Unlock()
+		server.wg.Done()
+	}()
+
+	go conn.writeWorker()
+	conn.serve()
+}
+
+//Close stops the listeners, disconnects every client and waits for their modules to be unregistered
+func (server *Server) Close() error {
+	server.mutex.Lock()
+	server.closed = true
+
+	var firstErr error
+	for listener := range server.listeners {
+		if err := listener.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	for conn := range server.connections {
+		conn.close()
+	}
+	server.mutex.Unlock()
+
+	server.wg.Wait()
+	return firstErr
+}
+
+//connection is a client of the server along with the modules it registered
+type connection struct {
+	server *Server
+	conn   net.Conn
+
+	//outbox holds the frames for writeWorker so that they are written in order, closing is closed along with the connection
+	outbox  chan Frame
+	closing chan struct{}
+
+	mutex   *sync.Mutex
+	closed  bool
+	modules map[mbus.ModuleIdentifier]*remoteModule
+}
+
+func (conn *connection) serve() {
+	reader := bufio.NewReader(conn.conn)
+
+	for {
+		frame, err := ReadFrame(reader)
+		if err != nil {
+			conn.mutex.Lock()
+			closed := conn.closed
+			conn.mutex.Unlock()
+
+			if err != io.EOF && !closed {
+				log.Printf("Bridge client %s disconnected: %s", conn.conn.RemoteAddr(), err)
+			}
+			break
+		}
+
+		ack := Frame{Op: OpAck, ID: frame.ID}
+		if err := conn.handle(frame); err != nil {
+			ack.Error = err.Error()
+		}
+
+		if err := conn.sendWait(ack); err != nil {
+			break
+		}
+	}
+
+	conn.close()
+
+	conn.mutex.Lock()
+	modules := make([]mbus.ModuleIdentifier, 0, len(conn.modules))
+	for identifier := range conn.modules {
+		modules = append(modules, identifier)
+	}
+	conn.mutex.Unlock()
+
+	for _, identifier := range modules {
+		conn.server.bus.UnregisterModule(identifier)
+	}
+}
+
+func (conn *connection) close() {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+
+	if !conn.closed {
+		conn.closed = true
+		close(conn.closing)
+		conn.conn.Close()
+	}
+}
+
+//send queues a frame without waiting, it fails if the connection is closed or the outbox is full
+func (conn *connection) send(frame Frame) error {
+	select {
+	case <-conn.closing:
+		return net.ErrClosed
+	default:
+	}
+
+	select {
+	case conn.outbox <- frame:
+		return nil
+	default:
+		return ErrSlowClient
+	}
+}
+
+//sendWait queues a frame, waiting while the outbox is full
+func (conn *connection) sendWait(frame Frame) error {
+	select {
+	case conn.outbox <- frame:
+		return nil
+	case <-conn.closing:
+		return net.ErrClosed
+	}
+}
+
+//writeWorker writes the queued frames until the connection is closed or a write fails
+func (conn *connection) writeWorker() {
+	for {
+		select {
+		case frame := <-conn.outbox:
+			conn.conn.SetWriteDeadline(time.Now().Add(WriteTimeout))
+			if err := WriteFrame(conn.conn, frame); err != nil {
+				conn.close()
+				return
+			}
+		case <-conn.closing:
+			return
+		}
+	}
+}
+
+func (conn *connection) handle(frame Frame) error {
+	switch frame.Op {
+	case OpRegister:
+		return conn.register(frame)
+	case OpUnregister:
+		if err := conn.own(frame.Module); err != nil {
+			return err
+		}
+		conn.server.bus.UnregisterModule(*frame.Module)
+		return nil
+	case OpPublish:
+		msg, err := mbus.UnmarshalMessage(frame.Message)
+		if err != nil {
+			return err
+		}
+		if err := conn.mayPublish(msg); err != nil {
+			return err
+		}
+		return conn.server.bus.NewMessage(msg)
+	case OpReply:
+		return conn.reply(frame)
+	}
+
+	return fmt.Errorf("%w: unknown op %q", ErrBadFrame, frame.Op)
+}
+
+//own checks that the module was registered by the connection
+func (conn *connection) own(identifier *mbus.ModuleIdentifier) error {
+	if identifier == nil {
+		return fmt.Errorf("%w: no module", ErrBadFrame)
+	}
+
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+
+	if _, ok := conn.modules[*identifier]; !ok {
+		return fmt.Errorf("%w: %s", ErrNotOwner, identifier.String())
+	}
+	return nil
+}
+
+//mayPublish lets clients send chat messages and publish the messages of platforms for their own modules only, the other
+//types would let them control the modules of the bot
+//Incoming chat messages need a SenderIdent under their source, permissions are looked up by it
+func (conn *connection) mayPublish(msg mbus.Message) error {
+	switch msg := msg.(type) {
+	case mbus.OutgoingChatMessage:
+		return nil
+	case mbus.IncomingChatMessage:
+		if !strings.HasPrefix(msg.SenderIdent, msg.SourceModule.String()+":") {
+			return fmt.Errorf("%w: the sender %q isn't under the source %s", ErrForbidden, msg.SenderIdent, msg.SourceModule.String())
+		}
+		return conn.own(&msg.SourceModule)
+	case mbus.PlatformConnectedMessage:
+		return conn.own(&msg.SourceModule)
+	case mbus.PlatformDisconnectedMessage:
+		return conn.own(&msg.SourceModule)
+	}
+
+	return fmt.Errorf("%w: %T", ErrForbidden, msg)
+}
+
+func (conn *connection) register(frame Frame) error {
+	if frame.Module == nil || frame.Module.MainIdent == "" || frame.Module.SubIdent == "" {
+		return fmt.Errorf("%w: no module", ErrBadFrame)
+	} else if frame.Module.SubIdent == "*" {
+		return fmt.Errorf("%w: modules can't have wildcard identifiers", ErrBadFrame)
+	}
+
+	module := &remoteModule{
+		identifier: *frame.Module,
+		conn:       conn,
+		//a subscription without criteria matches every message
+		subscriptions: []mbus.Subscription{{}},
+	}
+
+	if frame.Subscriptions != nil {
+		module.subscriptions = make([]mbus.Subscription, 0, len(*frame.Subscriptions))
+		for _, sub := range *frame.Subscriptions {
+			module.subscriptions = append(module.subscriptions, sub.toBus())
+		}
+	}
+
+	conn.server.registerMutex.Lock()
+	defer conn.server.registerMutex.Unlock()
+
+	if _, exists := conn.server.bus.ModuleState(module.identifier); exists {
+		return fmt.Errorf("%w: %s", ErrModuleExists, module.identifier.String())
+	}
+
+	conn.mutex.Lock()
+	if conn.closed {
+		conn.mutex.Unlock()
+		return net.ErrClosed
+	}
+	conn.modules[module.identifier] = module
+	conn.mutex.Unlock()
+
+	conn.server.bus.RegisterModuleWithInbox(module, InboxOptions)
+	return nil
+}
+
+func (conn *connection) reply(frame Frame) error {
+	if err := conn.own(frame.Module); err != nil {
+		return err
+	}
+
+	var reply mbus.Message
+	if len(frame.Message) != 0 {
+		var err error
+		if reply, err = mbus.UnmarshalMessage(frame.Message); err != nil {
+			return err
+		}
+	}
+
+	var replyErr error
+	if frame.Error != "" {
+		replyErr = errors.New(frame.Error)
+	}
+
+	conn.server.bus.Reply(mbus.RequestMessage{ID: frame.Request, TargetModule: *frame.Module}, reply, replyErr)
+	return nil
+}
+
+//remoteModule stands in for a module of a client, it forwards the messages routed to it
+type remoteModule struct {
+	identifier    mbus.ModuleIdentifier
+	conn          *connection
+	subscriptions []mbus.Subscription
+	//dropped counts the messages that didn't fit into the outbox, only the worker of the module touches it
+	dropped uint64
+}
+
+func (mod *remoteModule) GetIdentifier() mbus.ModuleIdentifier { return mod.identifier }
+func (mod *remoteModule) Subscriptions() []mbus.Subscription   { return mod.subscriptions }
+func (mod *remoteModule) OnRegister(bus *mbus.Bus)             {}
+
+//OnUnregister lets the client know, the module might have been unregistered by the bot rather than the client
+//It is called with the lifecycle of the bus locked, so it doesn't wait for the client, a client too far behind to be told
+//is disconnected
+func (mod *remoteModule) OnUnregister() {
+	mod.conn.mutex.Lock()
+	if mod.conn.modules[mod.identifier] == mod {
+		delete(mod.conn.modules, mod.identifier)
+	}
+	mod.conn.mutex.Unlock()
+
+	if err := mod.conn.send(Frame{Op: OpUnregistered, Module: &mod.identifier}); err == ErrSlowClient {
+		log.Printf("Disconnecting bridge client %s: %s", mod.conn.conn.RemoteAddr(), err)
+		mod.conn.close()
+	}
+}
+
+//OnMessage forwards a message to the client, messages are dropped while the client is too far behind so that the module
+//can always be stopped right away
+func (mod *remoteModule) OnMessage(msg mbus.Message) {
+	data, err := mbus.MarshalMessage(msg)
+	if err != nil {
+		log.Printf("Not forwarding a message to the remote module %s: %s", mod.identifier.String(), err)
+		return
+	}
+
+	if err := mod.conn.send(Frame{Op: OpMessage, Module: &mod.identifier, Message: data}); err == ErrSlowClient {
+		mod.dropped++
+		if mod.dropped%100 == 1 {
+			log.Printf("Bridge client %s is falling behind, %d message(s) for %s dropped so far", mod.conn.conn.RemoteAddr(), mod.dropped, mod.identifier.String())
+		}
+	}
+}
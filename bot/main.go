@@ -1,12 +1,18 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"os"
+	"os/signal"
 	"strconv"
 	"strings"
+	"syscall"
+	"time"
+	"unicode/utf8"
 
+	"github.com/xor-shift/Shiba/bot/bridge"
 	"github.com/xor-shift/Shiba/bot/mbus"
 	"github.com/xor-shift/Shiba/bot/message"
 	"github.com/xor-shift/Shiba/bot/modules/commandMod"
@@ -14,6 +20,7 @@ import (
 	ircPlat "github.com/xor-shift/Shiba/bot/platforms/ircp"
 	tPlat "github.com/xor-shift/Shiba/bot/platforms/terminal"
 	"github.com/xor-shift/Shiba/common/irc"
+	"github.com/xor-shift/Shiba/common/ratelimit"
 
 	// _ "github.com/go-sql-driver/mysql"
 	"github.com/jmoiron/sqlx"
@@ -25,6 +32,15 @@ import (
 var (
 	db  *sqlx.DB
 	bus = mbus.New()
+
+	ignoreList = mbus.NewIgnoreList()
+
+	//recordFile receives every bus message if SHIBA_RECORD is set, replayPath is the recording to replay from SHIBA_REPLAY
+	recordFile *os.File
+	replayPath = os.Getenv("SHIBA_REPLAY")
+
+	//bridgeServer lets other processes register modules if SHIBA_BRIDGE is set to a unix:/path or tcp:host:port address
+	bridgeServer *bridge.Server
 )
 
 type YmlConfig struct {
@@ -43,10 +59,26 @@ type YmlNetwork struct {
 	User     string `yaml:"username"`
 	RealName string `yaml:"realname"`
 
+	AltNicks           []string `yaml:"alt_nicks"`
+	NickRegainInterval int      `yaml:"nick_regain_interval"`
+
 	Pass string `yaml:"password"`
 
+	SASLMechanism string `yaml:"sasl_mechanism"`
+	SASLAccount   string `yaml:"sasl_account"`
+	SASLPassword  string `yaml:"sasl_password"`
+	TLSCertFile   string `yaml:"tls_cert"`
+	TLSKeyFile    string `yaml:"tls_key"`
+
+	Capabilities []string `yaml:"capabilities"`
+
 	PingFrequency int `yaml:"ping_freq"`
 	PingTimeout   int `yaml:"ping_timeout"`
+
+	ReconnectMinDelay int `yaml:"reconnect_min_delay"`
+	ReconnectMaxDelay int `yaml:"reconnect_max_delay"`
+
+	QuitMessage string `yaml:"quit_message"`
 }
 
 func readConf(filename string) (*YmlConfig, error) {
@@ -76,20 +108,34 @@ func prepIRC() {
 	log.Println("Initialising networks...")
 
 	for _, conf := range networkConf.Networks {
+		conf := conf
+
 		platform, err := ircPlat.New(conf.SubIdent, irc.ClientConfig{
 			Address:       conf.Address + ":" + conf.Port,
 			TLS:           conf.TLS,
 			Nick:          conf.Nick,
 			User:          conf.User,
 			RealName:      conf.RealName,
+			AltNicks:      conf.AltNicks,
 			Pass:          conf.Pass,
+			SASLMechanism: conf.SASLMechanism,
+			SASLAccount:   conf.SASLAccount,
+			SASLPassword:  conf.SASLPassword,
+			TLSCertFile:   conf.TLSCertFile,
+			TLSKeyFile:    conf.TLSKeyFile,
+			Capabilities:  conf.Capabilities,
 			PingFrequency: conf.PingFrequency,
 			PingTimeout:   conf.PingTimeout,
+
+			NickRegainInterval: conf.NickRegainInterval,
+			ReconnectMinDelay:  conf.ReconnectMinDelay,
+			ReconnectMaxDelay:  conf.ReconnectMaxDelay,
 		})
 
 		if err != nil {
 			panic(err)
 		}
+		platform.QuitMessage = conf.QuitMessage
 
 		platform.Client.SetPostInitCallback(func() {
 			for _, ch := range conf.Channels {
@@ -100,14 +146,34 @@ func prepIRC() {
 			}
 		})
 
-		if err := platform.Client.Init(); err != nil {
-			panic(err)
-		}
-
+		//the platform connects once it is registered, networks that can't be reached yet are retried in the background
 		bus.RegisterModule(platform)
 	}
 }
 
+var (
+	commandModIdent  = mbus.ModuleIdentifier{MainIdent: "Module", SubIdent: "Command"}
+	reactionModIdent = mbus.ModuleIdentifier{MainIdent: "Module", SubIdent: "Reaction"}
+
+	//platformIdents are started before and stopped after the modules that reply through them
+	platformIdents = []mbus.ModuleIdentifier{
+		{MainIdent: "IRC", SubIdent: "*"},
+		{MainIdent: "Terminal", SubIdent: "*"},
+	}
+)
+
+//requestAndReport sends a request in the background and replies to the original message with the outcome,
+//command callbacks run inside the OnMessage of the command module so they can't wait for replies themselves
+func requestAndReport(bus *mbus.Bus, origMessage mbus.IncomingChatMessage, target mbus.ModuleIdentifier, payload mbus.Message, success string) {
+	go func() {
+		text := success
+		if _, err := bus.Request(context.Background(), target, payload); err != nil {
+			text = "Failed: " + err.Error()
+		}
+		bus.NewMessage(origMessage.MakeReply(message.PlaintextToMessage(text)))
+	}()
+}
+
 func registerCommands(module *commandMod.CommandModule) {
 	module.RegisterCommand(commandMod.Command{
 		Ident:   "permTest",
@@ -122,15 +188,17 @@ func registerCommands(module *commandMod.CommandModule) {
 
 	module.RegisterCommand(commandMod.Command{
 		Ident:   "echo",
-		Desc:    "(((echo))), strips formatting before echoing, maybe",
+		Desc:    "(((echo))), formatting included",
 		MinPerm: 0,
 		MinArgs: 1,
 		MaxArgs: -1,
 		Callback: func(argv []string, origMessage mbus.IncomingChatMessage, bus *mbus.Bus) {
-			text := origMessage.Message.String()
-			idx := strings.Index(text, argv[0])
-			text = text[idx+len(argv[0])+1:]
-			bus.NewMessage(origMessage.MakeReply(message.PlaintextToMessage(text)))
+			parts := origMessage.Message.SplitN(" ", 2)
+			if len(parts) < 2 {
+				return
+			}
+			text := parts[1].String()
+			bus.NewMessage(origMessage.MakeReply(parts[1].TrimLeft(len(text) - len(strings.TrimLeft(text, " \t")))))
 		},
 	})
 
@@ -174,14 +242,7 @@ func registerCommands(module *commandMod.CommandModule) {
 				bus.NewMessage(origMessage.MakeReply(message.PlaintextToMessage("Bad permission integer")))
 				return
 			}
-			bus.NewMessage(mbus.ModuleControlMessage{
-				TargetModule: mbus.ModuleIdentifier{
-					MainIdent: "Module",
-					SubIdent:  "Command",
-				},
-				StrArgv:   []string{"setperm", argv[1]},
-				OtherData: map[string]interface{}{"level": i},
-			})
+			requestAndReport(bus, origMessage, commandModIdent, commandMod.SetPermRequest{UserIdent: argv[1], Level: i}, "Permission set")
 		},
 	})
 
@@ -194,25 +255,48 @@ func registerCommands(module *commandMod.CommandModule) {
 		Callback: func(argv []string, origMessage mbus.IncomingChatMessage, bus *mbus.Bus) {
 			if len(argv) > 1 {
 				// Attempt to auth with secret
-				bus.NewMessage(mbus.ModuleControlMessage{
-					TargetModule: mbus.ModuleIdentifier{
-						MainIdent: "Module",
-						SubIdent:  "Command",
-					},
-					StrArgv:   []string{"auth_token", argv[1]},
-					OtherData: map[string]interface{}{"sender_identity": origMessage.SenderIdent},
-				})
+				requestAndReport(bus, origMessage, commandModIdent, commandMod.AuthTokenRequest{UserIdent: origMessage.SenderIdent, Token: argv[1]}, "Authenticated")
 				return
 			}
 			// Generate a secret token to be used to grant admin for calling user ident
-			bus.NewMessage(mbus.ModuleControlMessage{
-				TargetModule: mbus.ModuleIdentifier{
-					MainIdent: "Module",
-					SubIdent:  "Command",
-				},
-				StrArgv:   []string{"gen_token"},
-				OtherData: map[string]interface{}{"sender_identity": origMessage.SenderIdent},
-			})
+			requestAndReport(bus, origMessage, commandModIdent, commandMod.GenTokenRequest{UserIdent: origMessage.SenderIdent}, "Token generated, check the bot's log")
+		},
+	})
+
+	module.RegisterCommand(commandMod.Command{
+		Ident:   "health",
+		Desc:    "lists the modules on the bus with their state, panics and restarts",
+		MinPerm: 10,
+		MinArgs: 1,
+		MaxArgs: 1,
+		Callback: func(argv []string, origMessage mbus.IncomingChatMessage, bus *mbus.Bus) {
+			for _, health := range bus.Health() {
+				bus.NewMessage(origMessage.MakeReply(message.PlaintextToMessage(health.String())))
+			}
+		},
+	})
+
+	module.RegisterCommand(commandMod.Command{
+		Ident:   "ignore",
+		Desc:    "drops every message from the given user ident before any module sees it",
+		MinPerm: 100,
+		MinArgs: 2,
+		MaxArgs: 2,
+		Callback: func(argv []string, origMessage mbus.IncomingChatMessage, bus *mbus.Bus) {
+			ignoreList.Add(argv[1])
+			bus.NewMessage(origMessage.MakeReply(message.PlaintextToMessage("Ignoring " + argv[1])))
+		},
+	})
+
+	module.RegisterCommand(commandMod.Command{
+		Ident:   "unignore",
+		Desc:    "",
+		MinPerm: 100,
+		MinArgs: 2,
+		MaxArgs: 2,
+		Callback: func(argv []string, origMessage mbus.IncomingChatMessage, bus *mbus.Bus) {
+			ignoreList.Remove(argv[1])
+			bus.NewMessage(origMessage.MakeReply(message.PlaintextToMessage("No longer ignoring " + argv[1])))
 		},
 	})
 
@@ -223,13 +307,19 @@ func registerCommands(module *commandMod.CommandModule) {
 		MinArgs: 3,
 		MaxArgs: 3,
 		Callback: func(argv []string, origMessage mbus.IncomingChatMessage, bus *mbus.Bus) {
+			//keep the formatting of the reply if it can be found verbatim, it can't be if it was quoted with escapes
+			reply := message.PlaintextToMessage(argv[2])
+			if idx := origMessage.Message.RuneLastIndex(argv[2]); idx != -1 {
+				reply = origMessage.Message.Slice(idx, idx+utf8.RuneCountInString(argv[2]))
+			}
+
 			bus.NewMessage(mbus.ModuleControlMessage{
-				TargetModule: mbus.ModuleIdentifier{"Module", "Reaction"},
+				TargetModule: reactionModIdent,
 				StrArgv: []string{
 					"add",
 					origMessage.SourceModule.String() + ":" + origMessage.ReplyTo,
-					argv[1], // regexStr
-					origMessage.Message.TrimLeft(origMessage.Message.Index(argv[1]) + len(argv[1]) + 1).ToIntermediate(), // replyStr
+					argv[1],                 // regexStr
+					reply.Encode(),          // replyStr
 					origMessage.SenderIdent, // addedBy
 				},
 				OtherData: nil,
@@ -250,7 +340,7 @@ func registerCommands(module *commandMod.CommandModule) {
 			}
 
 			bus.NewMessage(mbus.ModuleControlMessage{
-				TargetModule: mbus.ModuleIdentifier{"Module", "Reaction"},
+				TargetModule: reactionModIdent,
 				StrArgv:      args,
 				OtherData:    nil,
 			})
@@ -269,7 +359,7 @@ func registerCommands(module *commandMod.CommandModule) {
 				args = append(args, argv[1:]...)
 			}
 			bus.NewMessage(mbus.ModuleControlMessage{
-				TargetModule: mbus.ModuleIdentifier{"Module", "Reaction"},
+				TargetModule: reactionModIdent,
 				StrArgv:      args,
 				OtherData:    nil,
 			})
@@ -288,7 +378,7 @@ func registerCommands(module *commandMod.CommandModule) {
 				args = append(args, argv[1:]...)
 			}
 			bus.NewMessage(mbus.ModuleControlMessage{
-				TargetModule: mbus.ModuleIdentifier{"Module", "Reaction"},
+				TargetModule: reactionModIdent,
 				StrArgv:      args,
 				OtherData:    nil,
 			})
@@ -321,17 +411,131 @@ func init() {
 		"update reactions set reply_str='0:0:-1:' || reply_str;",
 	}
 
-	prepIRC()
+	if path := os.Getenv("SHIBA_RECORD"); path != "" {
+		if recordFile, err = os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600); err != nil {
+			log.Fatalln(err)
+		}
+		bus.Use(mbus.Record(bus, mbus.NewJSONRecorder(recordFile)))
+	}
+
+	//ignored users are dropped before they can use up the rate limits
+	bus.Use(ignoreList.Middleware())
+
+	//replays run faster than the recorded sessions and the rate limiter goes by the wall clock, there are no platforms
+	//to replay into either
+	if replayPath == "" {
+		bus.Use(mbus.RateLimit(ratelimit.NewRateLimiter(256, 40, 250, 8, 1500)))
+		prepIRC()
+		bus.RegisterModule(tPlat.New("std"))
+	}
 
 	cmdMod := commandMod.New(db, ";")
 	registerCommands(cmdMod)
 
-	bus.RegisterModule(tPlat.New("std"))
+	//commands add, delete and list reactions
+	bus.AddDependencies(reactionModIdent, platformIdents...)
+	bus.AddDependencies(commandModIdent, append(platformIdents, reactionModIdent)...)
+
 	bus.RegisterModule(reactionMod.New(db))
 	bus.RegisterModule(cmdMod)
 }
 
+const (
+	//shutdownTimeout bounds the delivery of the messages that are left on the bus after a signal
+	shutdownTimeout = 10 * time.Second
+)
+
 func main() {
 	bus.RunAsync()
-	bus.Wait()
+
+	if address := os.Getenv("SHIBA_BRIDGE"); address != "" {
+		listener, err := bridge.Listen(address)
+		if err != nil {
+			log.Fatalln(err)
+		}
+
+		bridgeServer = bridge.NewServer(bus)
+		go func() {
+			if err := bridgeServer.Serve(listener); err != bridge.ErrServerClosed {
+				log.Printf("The bridge stopped accepting connections: %s", err)
+			}
+		}()
+		log.Printf("Bridge listening on %s", address)
+	}
+
+	if replayPath != "" {
+		os.Exit(replay())
+	}
+
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	log.Printf("Received %s, shutting down", <-signals)
+
+	go func() {
+		log.Printf("Received %s while shutting down, exiting immediately", <-signals)
+		os.Exit(2)
+	}()
+
+	os.Exit(shutdown())
+}
+
+//replay publishes the messages recorded in replayPath to the modules and shuts down, it returns the exit status
+func replay() int {
+	f, err := os.Open(replayPath)
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+	defer f.Close()
+
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+
+	replayer := mbus.NewReplayer(bus)
+	published, err := replayer.Replay(ctx, mbus.NewRecordReader(f))
+	log.Printf("Replayed %d message(s) from %s", published, replayPath)
+
+	status := shutdown()
+	if err != nil {
+		log.Printf("Replay failed: %s", err)
+		status = 1
+	}
+	return status
+}
+
+//shutdown stops the bus and closes the database, it returns the exit status
+func shutdown() int {
+	status := 0
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	if err := bus.Shutdown(ctx); err != nil {
+		log.Printf("The bus didn't shut down cleanly: %s", err)
+		status = 1
+	}
+
+	//remote modules take part in draining the bus, their clients are disconnected once it has stopped
+	if bridgeServer != nil {
+		if err := bridgeServer.Close(); err != nil {
+			log.Printf("Failed to close the bridge: %s", err)
+		}
+	}
+
+	if err := db.Close(); err != nil {
+		log.Printf("Failed to close the database: %s", err)
+		status = 1
+	}
+
+	if recordFile != nil {
+		if err := recordFile.Close(); err != nil {
+			log.Printf("Failed to close the recording: %s", err)
+			status = 1
+		}
+	}
+
+	if status == 0 {
+		log.Println("Shut down cleanly")
+	}
+	return status
 }
@@ -0,0 +1,69 @@
+package mbus
+
+import (
+	"sync"
+	"time"
+)
+
+//Clock is the time source of the bus, replays use a VirtualClock so that modules see the recorded times
+type Clock interface {
+	Now() time.Time
+}
+
+type realClock struct{}
+
+func (clock realClock) Now() time.Time { return time.Now() }
+
+//VirtualClock only moves when it's told to
+type VirtualClock struct {
+	mutex *sync.RWMutex
+	now   time.Time
+}
+
+func NewVirtualClock(now time.Time) *VirtualClock {
+	return &VirtualClock{
+		mutex: &sync.RWMutex{},
+		now:   now,
+	}
+}
+
+func (clock *VirtualClock) Now() time.Time {
+	clock.mutex.RLock()
+	defer clock.mutex.RUnlock()
+
+	return clock.now
+}
+
+//Set moves the clock to the given time, the clock never goes backwards
+func (clock *VirtualClock) Set(now time.Time) {
+	clock.mutex.Lock()
+	defer clock.mutex.Unlock()
+
+	if now.After(clock.now) {
+		clock.now = now
+	}
+}
+
+func (clock *VirtualClock) Advance(d time.Duration) {
+	clock.mutex.Lock()
+	defer clock.mutex.Unlock()
+
+	clock.now = clock.now.Add(d)
+}
+
+//SetClock replaces the time source of the bus, which is the system clock by default
+func (bus *Bus) SetClock(clock Clock) {
+	bus.busMutex.Lock()
+	defer bus.busMutex.Unlock()
+
+	bus.clock = clock
+}
+
+//Now returns the time according to the clock of the bus, modules should prefer it over time.Now to behave the same in replays
+func (bus *Bus) Now() time.Time {
+	bus.busMutex.RLock()
+	clock := bus.clock
+	bus.busMutex.RUnlock()
+
+	return clock.Now()
+}
@@ -0,0 +1,139 @@
+package mbus
+
+import (
+	"log"
+	"sync"
+)
+
+//OverflowPolicy decides what happens when a message is published to a full inbox
+type OverflowPolicy int
+
+const (
+	//OverflowBlock makes the message worker wait until the module catches up, publishers never wait since the bus queues
+	//their messages
+	OverflowBlock OverflowPolicy = iota
+	//OverflowDropOldest discards the oldest undelivered message to make room
+	OverflowDropOldest
+	//OverflowDropNewest discards the message being published
+	OverflowDropNewest
+)
+
+type InboxOptions struct {
+	//Size is the number of undelivered messages the inbox holds, values below 1 are treated as 1
+	Size     int
+	Overflow OverflowPolicy
+}
+
+var (
+	DefaultInboxOptions = InboxOptions{
+		Size:     64,
+		Overflow: OverflowBlock,
+	}
+)
+
+//inbox is the bounded, ordered queue of messages waiting to be delivered to a module
+type inbox struct {
+	owner   ModuleIdentifier
+	options InboxOptions
+
+	mutex    *sync.Mutex
+	notEmpty *sync.Cond
+	notFull  *sync.Cond
+	queue    []delivery
+	closed   bool
+	dropped  uint64
+	//discarded is called with the number of queued messages that were dropped or discarded
+	discarded func(count int)
+}
+
+func newInbox(owner ModuleIdentifier, options InboxOptions, discarded func(count int)) *inbox {
+	if options.Size < 1 {
+		options.Size = 1
+	}
+
+	mutex := &sync.Mutex{}
+	return &inbox{
+		owner:    owner,
+		options:  options,
+		mutex:    mutex,
+		notEmpty: sync.NewCond(mutex),
+		notFull:  sync.NewCond(mutex),
+		queue:    make([]delivery, 0, options.Size),
+
+		discarded: discarded,
+	}
+}
+
+//drop counts a dropped message, logging the first one and every hundredth after that
+func (in *inbox) drop() {
+	in.dropped++
+	if in.dropped%100 == 1 {
+		log.Printf("Inbox of module %s is full, %d message(s) dropped so far", in.owner.String(), in.dropped)
+	}
+}
+
+//push queues a message according to the overflow policy, it returns false if the message was not queued
+//OverflowBlock is treated as OverflowDropNewest unless wait is set
+func (in *inbox) push(d delivery, wait bool) bool {
+	in.mutex.Lock()
+	defer in.mutex.Unlock()
+
+	overflow := in.options.Overflow
+	if overflow == OverflowBlock && !wait {
+		overflow = OverflowDropNewest
+	}
+
+	for !in.closed && len(in.queue) >= in.options.Size {
+		switch overflow {
+		case OverflowDropOldest:
+			in.queue = in.queue[1:]
+			in.drop()
+			in.discarded(1)
+		case OverflowDropNewest:
+			in.drop()
+			return false
+		default:
+			in.notFull.Wait()
+		}
+	}
+
+	if in.closed {
+		return false
+	}
+
+	in.queue = append(in.queue, d)
+	in.notEmpty.Signal()
+	return true
+}
+
+//pop waits for a message, it returns false once the inbox is closed
+func (in *inbox) pop() (delivery, bool) {
+	in.mutex.Lock()
+	defer in.mutex.Unlock()
+
+	for !in.closed && len(in.queue) == 0 {
+		in.notEmpty.Wait()
+	}
+
+	if in.closed {
+		return delivery{}, false
+	}
+
+	d := in.queue[0]
+	in.queue[0] = delivery{}
+	in.queue = in.queue[1:]
+	in.notFull.Signal()
+	return d, true
+}
+
+//close discards undelivered messages and wakes up everyone waiting on the inbox
+func (in *inbox) close() {
+	in.mutex.Lock()
+	defer in.mutex.Unlock()
+
+	in.closed = true
+	in.discarded(len(in.queue))
+	in.queue = nil
+	in.notEmpty.Broadcast()
+	in.notFull.Broadcast()
+}
@@ -0,0 +1,283 @@
+package mbus
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+)
+
+//ModuleState is the lifecycle state of a module on the bus
+type ModuleState int
+
+const (
+	//StateRegistered modules wait for the bus to start and for their dependencies to run, their messages wait in their inboxes
+	StateRegistered ModuleState = iota
+	//StateStarting modules are in OnRegister
+	StateStarting
+	//StateRunning modules get their messages delivered
+	StateRunning
+	//StateStopping modules finish the message they are handling and get OnUnregister called
+	StateStopping
+	//StateStopped modules are no longer on the bus
+	StateStopped
+	//StateFailed modules panicked in OnRegister, they don't get any messages until they are registered again
+	StateFailed
+)
+
+var (
+	ErrModuleFailed = errors.New("module failed to start")
+
+	moduleStateNames = []string{"registered", "starting", "running", "stopping", "stopped", "failed"}
+)
+
+func (state ModuleState) String() string {
+	if state < 0 || int(state) >= len(moduleStateNames) {
+		return fmt.Sprintf("ModuleState(%d)", int(state))
+	}
+	return moduleStateNames[state]
+}
+
+//DependentModule is implemented by modules that have to start after and stop before other modules
+//Dependencies with a wildcard sub-identifier refer to every module with the main identifier, there may be none of them
+type DependentModule interface {
+	Module
+	Dependencies() []ModuleIdentifier
+}
+
+//ModuleStateMessage is published on every lifecycle transition of a module
+type ModuleStateMessage struct {
+	Module   ModuleIdentifier
+	Previous ModuleState
+	State    ModuleState
+}
+
+func (msg ModuleStateMessage) GetType() int                          { return MTypModuleState }
+func (msg ModuleStateMessage) GetSourceIdentifier() ModuleIdentifier { return msg.Module }
+
+//setState changes the state of the entry, busMutex must be write locked and the returned message published after unlocking
+func (entry *moduleEntry) setState(state ModuleState) ModuleStateMessage {
+	msg := ModuleStateMessage{
+		Module:   entry.module.GetIdentifier(),
+		Previous: entry.state,
+		State:    state,
+	}
+
+	entry.state = state
+	return msg
+}
+
+//AddDependencies declares that a module starts after and stops before the dependencies, on top of what the module
+//itself declares as a DependentModule
+//The module doesn't need to be registered yet, dependencies added to a module that is already starting have no effect on
+//its startup
+func (bus *Bus) AddDependencies(identifier ModuleIdentifier, dependencies ...ModuleIdentifier) {
+	bus.busMutex.Lock()
+	defer bus.busMutex.Unlock()
+
+	bus.dependencies[identifier] = append(bus.dependencies[identifier], dependencies...)
+}
+
+//ModuleState returns the state of a module, the second return value is false if the module isn't on the bus
+func (bus *Bus) ModuleState(identifier ModuleIdentifier) (ModuleState, bool) {
+	bus.busMutex.RLock()
+	defer bus.busMutex.RUnlock()
+
+	entry, ok := bus.modules[identifier]
+	if !ok {
+		return StateStopped, false
+	}
+	return entry.state, true
+}
+
+//dependenciesOf returns every dependency of a module, busMutex must be locked
+func (bus *Bus) dependenciesOf(entry *moduleEntry) []ModuleIdentifier {
+	identifier := entry.module.GetIdentifier()
+	dependencies := append([]ModuleIdentifier{}, bus.dependencies[identifier]...)
+
+	if dependent, ok := entry.module.(DependentModule); ok {
+		dependencies = append(dependencies, dependent.Dependencies()...)
+	}
+
+	return dependencies
+}
+
+//dependsOn returns whether or not the first module depends on the second one, busMutex must be locked
+func (bus *Bus) dependsOn(entry, other *moduleEntry) bool {
+	if entry == other {
+		return false
+	}
+
+	for _, dependency := range bus.dependenciesOf(entry) {
+		if other.module.GetIdentifier().Compare(dependency) == 2 {
+			return true
+		}
+	}
+	return false
+}
+
+//waitingFor returns the dependencies of a module that aren't running, busMutex must be locked
+func (bus *Bus) waitingFor(entry *moduleEntry) []string {
+	waiting := make([]string, 0)
+
+	for _, dependency := range bus.dependenciesOf(entry) {
+		if dependency.SubIdent != "*" {
+			if other, ok := bus.modules[dependency]; !ok || other.state != StateRunning {
+				waiting = append(waiting, dependency.String())
+			}
+			continue
+		}
+
+		for _, other := range bus.modules {
+			if other != entry && other.state != StateRunning && bus.dependsOn(entry, other) {
+				waiting = append(waiting, other.module.GetIdentifier().String())
+			}
+		}
+	}
+
+	sort.Strings(waiting)
+	return waiting
+}
+
+//sortedEntries returns the modules sorted by their identifiers to keep the order of independent modules stable,
+//busMutex must be locked
+func (bus *Bus) sortedEntries() []*moduleEntry {
+	entries := make([]*moduleEntry, 0, len(bus.modules))
+	for _, entry := range bus.modules {
+		entries = append(entries, entry)
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].module.GetIdentifier().String() < entries[j].module.GetIdentifier().String()
+	})
+
+	return entries
+}
+
+//Start starts the registered modules, every module after its dependencies, RunSync and RunAsync call it
+//Modules registered after the bus has started are started as soon as their dependencies are running
+func (bus *Bus) Start() {
+	bus.lifecycleMutex.Lock()
+	defer bus.lifecycleMutex.Unlock()
+
+	bus.busMutex.Lock()
+	bus.started = true
+	bus.busMutex.Unlock()
+
+	bus.startReady()
+
+	bus.busMutex.RLock()
+	defer bus.busMutex.RUnlock()
+
+	for _, entry := range bus.sortedEntries() {
+		if entry.state == StateRegistered {
+			log.Printf("Module %s is waiting for: %s", entry.module.GetIdentifier().String(), strings.Join(bus.waitingFor(entry), ", "))
+		}
+	}
+}
+
+//startReady starts registered modules with running dependencies until there are none left, lifecycleMutex must be held
+func (bus *Bus) startReady() {
+	for {
+		var entry *moduleEntry
+		var transition ModuleStateMessage
+
+		bus.busMutex.Lock()
+		if bus.started {
+			for _, candidate := range bus.sortedEntries() {
+				if candidate.state == StateRegistered && len(bus.waitingFor(candidate)) == 0 {
+					entry = candidate
+					transition = entry.setState(StateStarting)
+					break
+				}
+			}
+		}
+		bus.busMutex.Unlock()
+
+		if entry == nil {
+			return
+		}
+
+		bus.NewMessage(transition)
+		bus.startModule(entry)
+	}
+}
+
+//startModule calls OnRegister and starts delivering messages to the module, lifecycleMutex must be held
+func (bus *Bus) startModule(entry *moduleEntry) {
+	identifier := entry.module.GetIdentifier()
+
+	err := protect(func() { entry.module.OnRegister(bus) })
+
+	bus.busMutex.Lock()
+	var transition ModuleStateMessage
+	if err != nil {
+		transition = entry.setState(StateFailed)
+		entry.inbox.close()
+	} else {
+		transition = entry.setState(StateRunning)
+		entry.registered = true
+		entry.workerStarted = true
+		go bus.moduleWorker(entry)
+	}
+	bus.busMutex.Unlock()
+
+	if err != nil {
+		logPanic(identifier, "while starting", err)
+		bus.failRequests(identifier)
+	}
+
+	bus.NewMessage(transition)
+}
+
+//unregister detaches a module and stops it, it returns false if there was no such module, lifecycleMutex must be held
+func (bus *Bus) unregister(identifier ModuleIdentifier) bool {
+	bus.busMutex.Lock()
+	entry := bus.detachModule(identifier)
+	var transition ModuleStateMessage
+	if entry != nil {
+		transition = entry.setState(StateStopping)
+	}
+	bus.busMutex.Unlock()
+
+	if entry == nil {
+		return false
+	}
+
+	bus.NewMessage(transition)
+	bus.stop(entry)
+
+	bus.busMutex.Lock()
+	transition = entry.setState(StateStopped)
+	bus.busMutex.Unlock()
+
+	bus.NewMessage(transition)
+	return true
+}
+
+//nextToStop returns a module that no other module depends on, any module is returned if there are cyclic dependencies
+//busMutex must be locked
+func (bus *Bus) nextToStop() *moduleEntry {
+	entries := bus.sortedEntries()
+	if len(entries) == 0 {
+		return nil
+	}
+
+	for _, entry := range entries {
+		needed := false
+		for _, other := range entries {
+			if bus.dependsOn(other, entry) {
+				needed = true
+				break
+			}
+		}
+
+		if !needed {
+			return entry
+		}
+	}
+
+	log.Printf("Modules have cyclic dependencies, stopping %s first", entries[0].module.GetIdentifier().String())
+	return entries[0]
+}
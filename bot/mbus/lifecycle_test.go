@@ -0,0 +1,111 @@
+package mbus_test
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/xor-shift/Shiba/bot/mbus"
+)
+
+//orderModule writes its lifecycle calls to a shared log
+type orderModule struct {
+	ident        mbus.ModuleIdentifier
+	dependencies []mbus.ModuleIdentifier
+	panics       bool
+
+	mutex *sync.Mutex
+	log   *[]string
+}
+
+func (mod *orderModule) GetIdentifier() mbus.ModuleIdentifier  { return mod.ident }
+func (mod *orderModule) Dependencies() []mbus.ModuleIdentifier { return mod.dependencies }
+func (mod *orderModule) Subscriptions() []mbus.Subscription    { return nil }
+func (mod *orderModule) OnMessage(msg mbus.Message)            {}
+func (mod *orderModule) OnUnregister()                         { mod.write("stop") }
+
+func (mod *orderModule) OnRegister(bus *mbus.Bus) {
+	if mod.panics {
+		panic("lifecycle test")
+	}
+	mod.write("start")
+}
+
+func (mod *orderModule) write(event string) {
+	mod.mutex.Lock()
+	defer mod.mutex.Unlock()
+
+	*mod.log = append(*mod.log, event+" "+mod.ident.String())
+}
+
+func TestBus_Lifecycle(t *testing.T) {
+	mutex := &sync.Mutex{}
+	events := make([]string, 0)
+
+	Module := func(mainIdent, subIdent string, dependencies ...mbus.ModuleIdentifier) *orderModule {
+		return &orderModule{
+			ident:        mbus.ModuleIdentifier{MainIdent: mainIdent, SubIdent: subIdent},
+			dependencies: dependencies,
+			mutex:        mutex,
+			log:          &events,
+		}
+	}
+
+	bus := mbus.New()
+
+	command := Module("Module", "Command", mbus.ModuleIdentifier{MainIdent: "Module", SubIdent: "Reaction"})
+	reaction := Module("Module", "Reaction")
+	broken := Module("Module", "Broken")
+	broken.panics = true
+	waiting := Module("Module", "Waiting", broken.ident)
+
+	bus.AddDependencies(reaction.ident, mbus.ModuleIdentifier{MainIdent: "IRC", SubIdent: "*"})
+	for _, mod := range []*orderModule{command, reaction, Module("IRC", "b"), Module("IRC", "a"), broken, waiting} {
+		bus.RegisterModule(mod)
+	}
+
+	//a middleware sees every message published until the bus has stopped, modules are gone by then
+	states := make([]mbus.ModuleState, 0)
+	bus.Use(func(msg mbus.Message, next func(msg mbus.Message)) {
+		if transition, ok := msg.(mbus.ModuleStateMessage); ok && transition.Module == reaction.ident {
+			states = append(states, transition.State)
+		}
+		next(msg)
+	})
+
+	bus.RunAsync()
+
+	if state, _ := bus.ModuleState(broken.ident); state != mbus.StateFailed {
+		t.Errorf("expected the broken module to have failed, it is %s", state)
+	}
+	if state, _ := bus.ModuleState(waiting.ident); state != mbus.StateRegistered {
+		t.Errorf("expected the module depending on the broken one to wait, it is %s", state)
+	}
+
+	//messages for a module that never starts overflow its inbox without holding up the others
+	capture := targetedCaptureModule{newCaptureModule("capture")}
+	bus.RegisterModule(capture)
+	for i := 0; i < 3*mbus.DefaultInboxOptions.Size; i++ {
+		bus.NewMessage(mbus.ModuleControlMessage{TargetModule: waiting.ident})
+	}
+	bus.NewMessage(mbus.ModuleControlMessage{TargetModule: capture.ident})
+	capture.next(t)
+	bus.UnregisterModule(capture.ident)
+
+	bus.Stop()
+
+	//independent modules start and stop in the order of their identifiers
+	expected := []string{
+		"start IRC:a", "start IRC:b", "start Module:Reaction", "start Module:Command",
+		"stop Module:Command", "stop Module:Reaction", "stop IRC:a", "stop IRC:b",
+	}
+	if strings.Join(events, ", ") != strings.Join(expected, ", ") {
+		t.Errorf("expected the lifecycle %v, got %v", expected, events)
+	}
+
+	expectedStates := []mbus.ModuleState{mbus.StateRegistered, mbus.StateStarting, mbus.StateRunning, mbus.StateStopping, mbus.StateStopped}
+	if fmt.Sprint(states) != fmt.Sprint(expectedStates) {
+		t.Errorf("expected the transitions %v, got %v", expectedStates, states)
+	}
+}
@@ -3,133 +3,365 @@ package mbus
 import (
 	"log"
 	"sync"
+	"sync/atomic"
 )
 
 type Bus struct {
 	workersWG *sync.WaitGroup
+	//lifecycleMutex serialises starting and stopping modules, it is taken before busMutex
+	lifecycleMutex *sync.Mutex
 	//all actions should read lock this, module modifications etc. will write lock it
 	busMutex *sync.RWMutex
 	//no mutex for this is needed, busMutex should suffice
-	modules      map[ModuleIdentifier]Module
-	messageQueue chan Message
+	modules map[ModuleIdentifier]*moduleEntry
+	//queue holds the published messages until the message worker routes them, it is unbounded so that publishing never
+	//waits for the message worker, which might be waiting for the inbox of the module that is publishing
+	queue []Message
+	//queueMutex guards queue, stopped and draining, queueCond is signalled when a message is queued or the bus stops
+	queueMutex *sync.Mutex
+	queueCond  *sync.Cond
+	stopped    bool
+	draining   bool
+	//pending is the number of published messages that haven't been delivered or discarded yet, see settle
+	pending int64
+	//typeIndex holds the modules that only subscribe to specific message types, unindexed holds the rest
+	typeIndex map[int][]*moduleEntry
+	unindexed []*moduleEntry
+	//middlewares is replaced instead of being modified, see Use
+	middlewares []Middleware
+	//dependencies holds the dependencies added with AddDependencies
+	dependencies map[ModuleIdentifier][]ModuleIdentifier
+	started      bool
+	policy       SupervisorPolicy
+	clock        Clock
+
+	requestsMutex *sync.Mutex
+	requests      map[uint64]pendingRequest
+	lastRequestID uint64
+}
+
+//moduleEntry is a registered module with its inbox, every module has a goroutine that delivers its messages in order
+type moduleEntry struct {
+	module Module
+	inbox  *inbox
+	done   chan struct{}
+
+	state ModuleState
+	//workerStarted is set once OnRegister has returned and the worker has been started
+	workerStarted bool
+	//registered is set while OnRegister has been called without a matching OnUnregister, guarded by busMutex
+	registered bool
+	health     *moduleHealth
+
+	//subscribed is set if the module only receives the untargeted messages matching its subscriptions
+	subscribed    bool
+	subscriptions []Subscription
 }
 
 func New() *Bus {
+	queueMutex := &sync.Mutex{}
 	bus := &Bus{
 		busMutex:     &sync.RWMutex{},
-		modules:      make(map[ModuleIdentifier]Module),
+		dependencies: make(map[ModuleIdentifier][]ModuleIdentifier),
+		policy:       DefaultSupervisorPolicy,
+		clock:        realClock{},
+		modules:      make(map[ModuleIdentifier]*moduleEntry),
+		typeIndex:    make(map[int][]*moduleEntry),
+		unindexed:    make([]*moduleEntry, 0),
 		workersWG:    &sync.WaitGroup{},
-		messageQueue: make(chan Message, 64),
+
+		lifecycleMutex: &sync.Mutex{},
+		queue:          make([]Message, 0),
+		queueMutex:     queueMutex,
+		queueCond:      sync.NewCond(queueMutex),
+
+		requestsMutex: &sync.Mutex{},
+		requests:      make(map[uint64]pendingRequest),
 	}
 
 	return bus
 }
 
+//Stop stops every module, every module before its dependencies, and then the message worker, undelivered messages are
+//discarded, see Shutdown
+//Messages can't be published once the bus has stopped
 func (bus *Bus) Stop() {
-	bus.busMutex.Lock()
-	defer bus.busMutex.Unlock()
+	bus.lifecycleMutex.Lock()
+	defer bus.lifecycleMutex.Unlock()
 
-	for _, v := range bus.modules {
-		v.OnUnregister()
+	for {
+		bus.busMutex.Lock()
+		bus.started = false
+		entry := bus.nextToStop()
+		bus.busMutex.Unlock()
+
+		if entry == nil {
+			break
+		}
+		bus.unregister(entry.module.GetIdentifier())
 	}
 
-	close(bus.messageQueue)
+	bus.queueMutex.Lock()
+	bus.stopped = true
+	bus.queueCond.Broadcast()
+	bus.queueMutex.Unlock()
 
 	bus.Wait()
 }
 
+//RunSync starts the modules and routes messages until the bus is stopped
 func (bus *Bus) RunSync() {
+	go bus.Start()
 	bus.messageWorker(false)
 }
 
+//RunAsync starts the modules and routes messages in the background
 func (bus *Bus) RunAsync() {
 	bus.workersWG.Add(1)
 	go bus.messageWorker(true)
+	bus.Start()
 }
 
 func (bus *Bus) Wait() {
 	bus.workersWG.Wait()
 }
 
-func (bus *Bus) messageWorker(async bool) {
-	log.Println("Message worker has started")
+//deliver hands a message to a module, a panic is returned as a PanicError
+func deliver(module Module, d delivery) error {
+	return protect(func() {
+		if d.onMessage {
+			module.OnMessage(d.msg)
+		}
+		for _, handler := range d.handlers {
+			handler(d.msg)
+		}
+	})
+}
 
-	if async {
-		defer bus.workersWG.Done()
+//moduleWorker delivers the messages in the inbox of a module until it's closed or the module is disabled
+func (bus *Bus) moduleWorker(entry *moduleEntry) {
+	defer close(entry.done)
+
+	for {
+		d, ok := entry.inbox.pop()
+		if !ok {
+			return
+		}
+
+		if !entry.health.allow(bus.Now()) {
+			bus.settle(1)
+			continue
+		}
+
+		err := deliver(entry.module, d)
+		bus.settle(1)
+
+		if err != nil && !bus.supervise(entry, err) {
+			return
+		}
 	}
+}
 
-	TriggerMessage := func(module Module, message Message) {
-		defer func() {
-			if r := recover(); r != nil {
-				log.Printf("Bus message handler for module %s panicked, More informtion:\n%T", module.GetIdentifier().String(), r)
-			}
-		}()
+//setRegistered records whether OnRegister has been called without a matching OnUnregister
+func (bus *Bus) setRegistered(entry *moduleEntry, registered bool) {
+	bus.busMutex.Lock()
+	defer bus.busMutex.Unlock()
+
+	entry.registered = registered
+}
+
+func (bus *Bus) isRegistered(entry *moduleEntry) bool {
+	bus.busMutex.RLock()
+	defer bus.busMutex.RUnlock()
+
+	return entry.registered
+}
 
-		module.OnMessage(message)
+//stop waits for the worker of a detached module to finish its current message and unregisters the module
+//Modules that haven't been started successfully or have been disabled are just dropped
+func (bus *Bus) stop(entry *moduleEntry) {
+	if !entry.workerStarted {
+		return
 	}
 
-	running := true
-	for running {
-		select {
-		case msg, ok := <-bus.messageQueue:
-			if !ok {
-				running = false
-				break
-			}
+	<-entry.done
+	if bus.isRegistered(entry) {
+		if err := protect(entry.module.OnUnregister); err != nil {
+			logPanic(entry.module.GetIdentifier(), "while being unregistered", err)
+		}
+	}
+}
 
-			bus.busMutex.RLock()
-
-			if tMsg, ok := msg.(TargetedMessage); ok {
-				tIdent := tMsg.GetTargetIdentifier()
-				if tIdent.SubIdent == "*" {
-					for k, v := range bus.modules {
-						if k.MainIdent == tIdent.MainIdent {
-							TriggerMessage(v, msg)
-						}
-					}
-				} else {
-					if target, ok := bus.modules[tIdent]; ok {
-						TriggerMessage(target, msg)
-					}
-				}
-			} else {
-				for _, v := range bus.modules {
-					TriggerMessage(v, msg)
+type recipient struct {
+	inbox    *inbox
+	delivery delivery
+	//wait is false for modules that haven't been started, they might never be and waiting on them would stall the bus
+	wait bool
+}
+
+//recipients returns the inboxes a message should be put into, targeted messages ignore subscriptions
+func (bus *Bus) recipients(msg Message) []recipient {
+	bus.busMutex.RLock()
+	defer bus.busMutex.RUnlock()
+
+	recipients := make([]recipient, 0)
+	Targeted := func(entry *moduleEntry) {
+		recipients = append(recipients, recipient{entry.inbox, delivery{msg: msg, onMessage: true}, entry.workerStarted})
+	}
+
+	if tMsg, ok := msg.(TargetedMessage); ok {
+		tIdent := tMsg.GetTargetIdentifier()
+		if tIdent.SubIdent == "*" {
+			for k, v := range bus.modules {
+				if k.MainIdent == tIdent.MainIdent {
+					Targeted(v)
 				}
 			}
+		} else {
+			if target, ok := bus.modules[tIdent]; ok {
+				Targeted(target)
+			}
+		}
+
+		return recipients
+	}
+
+	for _, candidates := range [][]*moduleEntry{bus.typeIndex[msg.GetType()], bus.unindexed} {
+		for _, entry := range candidates {
+			if d, ok := entry.match(msg); ok {
+				recipients = append(recipients, recipient{entry.inbox, d, entry.workerStarted})
+			}
+		}
+	}
+
+	return recipients
+}
+
+//messageWorker runs published messages through the middlewares and routes them to the inboxes of modules
+//The bus isn't locked while waiting on a full inbox
+func (bus *Bus) messageWorker(async bool) {
+	log.Println("Message worker has started")
+
+	if async {
+		defer bus.workersWG.Done()
+	}
 
-			bus.busMutex.RUnlock()
+	for {
+		msg, ok := bus.nextMessage()
+		if !ok {
+			break
 		}
+
+		bus.dispatch(msg)
+		bus.settle(1)
 	}
 
 	log.Println("Message worker is exiting")
 }
 
+//nextMessage waits for a published message, it returns false once the bus has stopped and the queue is empty
+func (bus *Bus) nextMessage() (Message, bool) {
+	bus.queueMutex.Lock()
+	defer bus.queueMutex.Unlock()
+
+	for len(bus.queue) == 0 && !bus.stopped {
+		bus.queueCond.Wait()
+	}
+
+	if len(bus.queue) == 0 {
+		return nil, false
+	}
+
+	msg := bus.queue[0]
+	bus.queue[0] = nil
+	bus.queue = bus.queue[1:]
+	return msg, true
+}
+
 func (bus *Bus) RegisterModule(module Module) {
+	bus.RegisterModuleWithInbox(module, DefaultInboxOptions)
+}
+
+//RegisterModuleWithInbox registers a module whose inbox has the given size and overflow policy
+//A module that is registered with the identifier of another one replaces it
+//The module is started right away if the bus has been started and its dependencies are running, messages published
+//until it starts wait in its inbox, once the inbox is full they are dropped instead of holding up the bus
+func (bus *Bus) RegisterModuleWithInbox(module Module, options InboxOptions) {
+	bus.lifecycleMutex.Lock()
+	defer bus.lifecycleMutex.Unlock()
+
 	identifier := module.GetIdentifier()
+	bus.unregister(identifier)
+
+	entry := &moduleEntry{
+		module: module,
+		inbox:  newInbox(identifier, options, bus.settle),
+		done:   make(chan struct{}),
+		state:  StateRegistered,
+		health: newModuleHealth(identifier),
+	}
+
+	if subscriber, ok := module.(Subscriber); ok {
+		entry.subscribed = true
+		entry.subscriptions = subscriber.Subscriptions()
+	}
 
 	bus.busMutex.Lock()
-	defer bus.busMutex.Unlock()
+	bus.modules[identifier] = entry
+	bus.reindex()
+	bus.busMutex.Unlock()
 
-	bus.unregisterModule(identifier)
-	bus.modules[identifier] = module
-	module.OnRegister(bus)
+	bus.NewMessage(ModuleStateMessage{
+		Module:   identifier,
+		Previous: StateStopped,
+		State:    StateRegistered,
+	})
+
+	bus.startReady()
 }
 
+//UnregisterModule stops a module and removes it from the bus, modules that depend on it keep running
 func (bus *Bus) UnregisterModule(identifier ModuleIdentifier) {
-	bus.busMutex.Lock()
-	defer bus.busMutex.Unlock()
+	bus.lifecycleMutex.Lock()
+	defer bus.lifecycleMutex.Unlock()
 
-	bus.UnregisterModule(identifier)
+	if bus.unregister(identifier) {
+		//modules waiting for every module with a main identifier might be able to start now
+		bus.startReady()
+	}
 }
 
-func (bus *Bus) unregisterModule(identifier ModuleIdentifier) {
-	if mod, ok := bus.modules[identifier]; ok {
-		mod.OnUnregister()
-		delete(bus.modules, identifier)
+//detachModule removes a module from the bus and closes its inbox, busMutex must be write locked
+//The returned entry (nil if there was no such module) has to be stopped after unlocking
+func (bus *Bus) detachModule(identifier ModuleIdentifier) *moduleEntry {
+	entry, ok := bus.modules[identifier]
+	if !ok {
+		return nil
 	}
+
+	delete(bus.modules, identifier)
+	bus.reindex()
+	entry.inbox.close()
+	bus.failRequests(identifier)
+
+	return entry
 }
 
-func (bus *Bus) NewMessage(message Message) {
-	bus.messageQueue <- message
+//NewMessage publishes a message without waiting for it to be routed, it fails once the bus has stopped and refuses
+//incoming chat messages while the bus is shutting down
+func (bus *Bus) NewMessage(message Message) error {
+	bus.queueMutex.Lock()
+	defer bus.queueMutex.Unlock()
+
+	if bus.stopped {
+		return ErrBusStopped
+	}
+	if _, ok := message.(IncomingChatMessage); ok && bus.draining {
+		return ErrShuttingDown
+	}
+
+	atomic.AddInt64(&bus.pending, 1)
+	bus.queue = append(bus.queue, message)
+	bus.queueCond.Signal()
+	return nil
 }
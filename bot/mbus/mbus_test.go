@@ -0,0 +1,74 @@
+package mbus_test
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/xor-shift/Shiba/bot/mbus"
+	"github.com/xor-shift/Shiba/bot/message"
+)
+
+//replyModule replies to every chat message after a while, like the command and reaction modules do
+type replyModule struct {
+	bus *mbus.Bus
+}
+
+func (mod *replyModule) GetIdentifier() mbus.ModuleIdentifier {
+	return mbus.ModuleIdentifier{MainIdent: "Test", SubIdent: "reply"}
+}
+
+func (mod *replyModule) Subscriptions() []mbus.Subscription {
+	return []mbus.Subscription{{Types: []int{mbus.MTypIncomingChat}}}
+}
+
+func (mod *replyModule) OnRegister(bus *mbus.Bus) { mod.bus = bus }
+func (mod *replyModule) OnUnregister()            {}
+
+func (mod *replyModule) OnMessage(msg mbus.Message) {
+	time.Sleep(100 * time.Microsecond)
+	mod.bus.NewMessage(msg.(mbus.IncomingChatMessage).MakeReply(message.PlaintextToMessage("reply")))
+}
+
+//countModule counts the messages targeted at it
+type countModule struct {
+	count int64
+}
+
+func (mod *countModule) GetIdentifier() mbus.ModuleIdentifier {
+	return mbus.ModuleIdentifier{MainIdent: "Test", SubIdent: "count"}
+}
+
+func (mod *countModule) Subscriptions() []mbus.Subscription { return nil }
+func (mod *countModule) OnRegister(bus *mbus.Bus)           {}
+func (mod *countModule) OnUnregister()                      {}
+func (mod *countModule) OnMessage(msg mbus.Message)         { atomic.AddInt64(&mod.count, 1) }
+
+func TestBus_ReplyFlood(t *testing.T) {
+	//more messages than the inbox of the replying module and the queue of the bus used to hold together
+	for k, count := range []int{100, 200, 1000} {
+		bus := mbus.New()
+		counter := &countModule{}
+		bus.RegisterModule(counter)
+		bus.RegisterModule(&replyModule{})
+		bus.RunAsync()
+
+		for i := 0; i < count; i++ {
+			bus.NewMessage(mbus.IncomingChatMessage{SourceModule: counter.GetIdentifier(), Message: message.PlaintextToMessage("hi")})
+		}
+
+		//a deadlocked bus can't be stopped either
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		err := bus.WaitIdle(ctx)
+		cancel()
+		if err != nil {
+			t.Fatalf("(test %d) the bus didn't get idle: %s", k, err)
+		}
+		bus.Stop()
+
+		if replies := atomic.LoadInt64(&counter.count); replies != int64(count) {
+			t.Errorf("(test %d) got %d replies, expected %d", k, replies, count)
+		}
+	}
+}
@@ -8,6 +8,11 @@ const (
 	MTypOutgoingChat         = iota
 	MTypNewModuleRegistered  = iota
 	MTypModuleControlMessage = iota
+	MTypPlatformConnected    = iota
+	MTypPlatformDisconnected = iota
+	MTypRequest              = iota
+	MTypModuleState          = iota
+	MTypModuleHealth         = iota
 )
 
 type Message interface {
@@ -24,9 +29,12 @@ type IncomingChatMessage struct {
 	SenderIdent  string
 	ReplyTo      string
 	Message      message.Message
+	//Tags holds platform specific metadata such as IRCv3 message tags (server-time, msgid, account etc.), may be nil
+	Tags map[string]string
 }
 
-func (msg IncomingChatMessage) GetType() int { return MTypIncomingChat }
+func (msg IncomingChatMessage) GetType() int                          { return MTypIncomingChat }
+func (msg IncomingChatMessage) GetSourceIdentifier() ModuleIdentifier { return msg.SourceModule }
 
 func (msg IncomingChatMessage) MakeReply(replyMessage message.Message) OutgoingChatMessage {
 	return OutgoingChatMessage{
@@ -59,3 +67,22 @@ type ModuleControlMessage struct {
 
 func (msg ModuleControlMessage) GetType() int                          { return MTypModuleControlMessage }
 func (msg ModuleControlMessage) GetTargetIdentifier() ModuleIdentifier { return msg.TargetModule }
+
+//PlatformConnectedMessage is published by a platform when it (re)establishes its connection
+type PlatformConnectedMessage struct {
+	SourceModule ModuleIdentifier
+}
+
+func (msg PlatformConnectedMessage) GetType() int                          { return MTypPlatformConnected }
+func (msg PlatformConnectedMessage) GetSourceIdentifier() ModuleIdentifier { return msg.SourceModule }
+
+//PlatformDisconnectedMessage is published by a platform when it loses its connection, Reason may be empty
+type PlatformDisconnectedMessage struct {
+	SourceModule ModuleIdentifier
+	Reason       string
+}
+
+func (msg PlatformDisconnectedMessage) GetType() int { return MTypPlatformDisconnected }
+func (msg PlatformDisconnectedMessage) GetSourceIdentifier() ModuleIdentifier {
+	return msg.SourceModule
+}
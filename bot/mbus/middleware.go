@@ -0,0 +1,159 @@
+package mbus
+
+import (
+	"log"
+	"regexp"
+	"sync"
+	"sync/atomic"
+
+	"github.com/xor-shift/Shiba/common/ratelimit"
+)
+
+//Middleware sees every published message before it is routed, in the order the middlewares were added
+//Calling next passes a message on to the rest of the chain: not calling it drops the message, calling it with another
+//message rewrites it and calling it more than once fans it out
+type Middleware func(msg Message, next func(msg Message))
+
+//Use appends middlewares to the chain, they apply to the messages routed after the call
+func (bus *Bus) Use(middlewares ...Middleware) {
+	bus.busMutex.Lock()
+	defer bus.busMutex.Unlock()
+
+	//the chain is copied so that dispatch can use its snapshot without locking
+	chain := make([]Middleware, 0, len(bus.middlewares)+len(middlewares))
+	chain = append(chain, bus.middlewares...)
+	bus.middlewares = append(chain, middlewares...)
+}
+
+//dispatch runs a message through the middleware chain and routes what comes out of it
+func (bus *Bus) dispatch(msg Message) {
+	bus.busMutex.RLock()
+	middlewares := bus.middlewares
+	bus.busMutex.RUnlock()
+
+	var Next func(i int) func(msg Message)
+	Next = func(i int) func(msg Message) {
+		if i == len(middlewares) {
+			return bus.route
+		}
+
+		return func(msg Message) {
+			defer func() {
+				if r := recover(); r != nil {
+					log.Printf("Bus middleware #%d panicked on a %T, dropping it. More informtion:\n%v", i, msg, r)
+				}
+			}()
+
+			middlewares[i](msg, Next(i+1))
+		}
+	}
+
+	Next(0)(msg)
+}
+
+//route puts a message into the inboxes of its recipients
+func (bus *Bus) route(msg Message) {
+	for _, recipient := range bus.recipients(msg) {
+		atomic.AddInt64(&bus.pending, 1)
+		if !recipient.inbox.push(recipient.delivery, recipient.wait) {
+			bus.settle(1)
+		}
+	}
+}
+
+//IgnoreList drops the incoming chat messages of the ignored sender identities
+type IgnoreList struct {
+	mutex   *sync.RWMutex
+	senders map[string]bool
+}
+
+func NewIgnoreList(senderIdents ...string) *IgnoreList {
+	list := &IgnoreList{
+		mutex:   &sync.RWMutex{},
+		senders: make(map[string]bool),
+	}
+
+	for _, ident := range senderIdents {
+		list.senders[ident] = true
+	}
+
+	return list
+}
+
+func (list *IgnoreList) Add(senderIdent string) {
+	list.mutex.Lock()
+	defer list.mutex.Unlock()
+
+	list.senders[senderIdent] = true
+}
+
+func (list *IgnoreList) Remove(senderIdent string) {
+	list.mutex.Lock()
+	defer list.mutex.Unlock()
+
+	delete(list.senders, senderIdent)
+}
+
+func (list *IgnoreList) Contains(senderIdent string) bool {
+	list.mutex.RLock()
+	defer list.mutex.RUnlock()
+
+	return list.senders[senderIdent]
+}
+
+func (list *IgnoreList) Middleware() Middleware {
+	return func(msg Message, next func(msg Message)) {
+		if inChatMessage, ok := msg.(IncomingChatMessage); ok && list.Contains(inChatMessage.SenderIdent) {
+			return
+		}
+		next(msg)
+	}
+}
+
+//RateLimit drops the incoming chat messages of senders that exceed their rate in the limiter
+func RateLimit(limiter *ratelimit.RateLimiter) Middleware {
+	//the limiter isn't safe for concurrent use
+	mutex := &sync.Mutex{}
+
+	return func(msg Message, next func(msg Message)) {
+		if inChatMessage, ok := msg.(IncomingChatMessage); ok {
+			mutex.Lock()
+			allowed := limiter.Check(inChatMessage.SenderIdent)
+			mutex.Unlock()
+
+			if !allowed {
+				return
+			}
+		}
+		next(msg)
+	}
+}
+
+//LogMessages logs the messages of the given types, or of every type if none are given
+func LogMessages(types ...int) Middleware {
+	return func(msg Message, next func(msg Message)) {
+		logged := len(types) == 0
+		for _, typ := range types {
+			if typ == msg.GetType() {
+				logged = true
+				break
+			}
+		}
+
+		if logged {
+			log.Printf("Bus message %T: %+v", msg, msg)
+		}
+		next(msg)
+	}
+}
+
+//Redact replaces the matches of the expression in the text of outgoing chat messages with repl
+func Redact(re *regexp.Regexp, repl string) Middleware {
+	return func(msg Message, next func(msg Message)) {
+		if outChatMessage, ok := msg.(OutgoingChatMessage); ok {
+			outChatMessage.Message = outChatMessage.Message.ReplaceAllRegexp(re, repl)
+			msg = outChatMessage
+		}
+		next(msg)
+	}
+}
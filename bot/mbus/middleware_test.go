@@ -0,0 +1,212 @@
+package mbus_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	_ "github.com/mattn/go-sqlite3"
+
+	"github.com/xor-shift/Shiba/bot/mbus"
+	"github.com/xor-shift/Shiba/bot/message"
+	"github.com/xor-shift/Shiba/bot/modules/commandMod"
+	"github.com/xor-shift/Shiba/bot/modules/reactionMod"
+)
+
+//captureModule forwards the messages it gets to a channel, it gets every message
+type captureModule struct {
+	ident    mbus.ModuleIdentifier
+	messages chan mbus.Message
+}
+
+func newCaptureModule(subIdent string) *captureModule {
+	return &captureModule{
+		ident:    mbus.ModuleIdentifier{MainIdent: "Test", SubIdent: subIdent},
+		messages: make(chan mbus.Message, 64),
+	}
+}
+
+func (mod *captureModule) GetIdentifier() mbus.ModuleIdentifier { return mod.ident }
+func (mod *captureModule) OnRegister(bus *mbus.Bus)             {}
+func (mod *captureModule) OnUnregister()                        {}
+func (mod *captureModule) OnMessage(msg mbus.Message)           { mod.messages <- msg }
+
+//targetedCaptureModule only gets the messages targeted at it
+type targetedCaptureModule struct {
+	*captureModule
+}
+
+func (mod targetedCaptureModule) Subscriptions() []mbus.Subscription { return nil }
+
+func (mod *captureModule) next(t *testing.T) mbus.Message {
+	select {
+	case msg := <-mod.messages:
+		return msg
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for a message")
+		return nil
+	}
+}
+
+var endMarker = mbus.PlatformConnectedMessage{SourceModule: mbus.ModuleIdentifier{MainIdent: "Test", SubIdent: "end"}}
+
+//reasonMiddleware runs f on the reasons of disconnection messages, every other message is passed as is
+func reasonMiddleware(f func(reason string, next func(reason string))) mbus.Middleware {
+	return func(msg mbus.Message, next func(msg mbus.Message)) {
+		disconnected, ok := msg.(mbus.PlatformDisconnectedMessage)
+		if !ok {
+			next(msg)
+			return
+		}
+
+		f(disconnected.Reason, func(reason string) {
+			next(mbus.PlatformDisconnectedMessage{SourceModule: disconnected.SourceModule, Reason: reason})
+		})
+	}
+}
+
+func TestBus_Use(t *testing.T) {
+	tests := []struct {
+		middlewares []mbus.Middleware
+		input       []string
+		expected    []string
+	}{
+		{nil, []string{"a", "b"}, []string{"a", "b"}},
+		{[]mbus.Middleware{reasonMiddleware(func(reason string, next func(reason string)) {
+			if reason != "drop" {
+				next(reason)
+			}
+		})}, []string{"a", "drop", "b"}, []string{"a", "b"}},
+		{[]mbus.Middleware{reasonMiddleware(func(reason string, next func(reason string)) {
+			next(reason + "!")
+		})}, []string{"a", "b"}, []string{"a!", "b!"}},
+		{[]mbus.Middleware{reasonMiddleware(func(reason string, next func(reason string)) {
+			next(reason + "1")
+			next(reason + "2")
+		})}, []string{"a", "b"}, []string{"a1", "a2", "b1", "b2"}},
+		{[]mbus.Middleware{
+			reasonMiddleware(func(reason string, next func(reason string)) { next(reason + "x") }),
+			reasonMiddleware(func(reason string, next func(reason string)) { next(reason + "y") }),
+		}, []string{"a"}, []string{"axy"}},
+		{[]mbus.Middleware{
+			reasonMiddleware(func(reason string, next func(reason string)) {
+				if reason == "panic" {
+					panic("middleware test")
+				}
+				next(reason)
+			}),
+		}, []string{"a", "panic", "b"}, []string{"a", "b"}},
+	}
+
+	for k, v := range tests {
+		bus := mbus.New()
+		capture := newCaptureModule("capture")
+		bus.RegisterModule(capture)
+		bus.Use(v.middlewares...)
+		bus.RunAsync()
+
+		for _, reason := range v.input {
+			bus.NewMessage(mbus.PlatformDisconnectedMessage{SourceModule: capture.ident, Reason: reason})
+		}
+		bus.NewMessage(endMarker)
+
+		got := make([]string, 0)
+		for msg := capture.next(t); msg != endMarker; msg = capture.next(t) {
+			if disconnected, ok := msg.(mbus.PlatformDisconnectedMessage); ok {
+				got = append(got, disconnected.Reason)
+			}
+		}
+
+		if len(got) != len(v.expected) {
+			t.Errorf("(test %d) expected %v, got %v", k, v.expected, got)
+		} else {
+			for i := range got {
+				if got[i] != v.expected[i] {
+					t.Errorf("(test %d) expected %v, got %v", k, v.expected, got)
+					break
+				}
+			}
+		}
+
+		bus.Stop()
+	}
+}
+
+func TestIgnoreList_Middleware(t *testing.T) {
+	dir := t.TempDir()
+	db, err := sqlx.Connect("sqlite3", filepath.Join(dir, "test.sq3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	schema, err := os.ReadFile("../schema.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.MustExec(string(schema))
+
+	bus := mbus.New()
+	platform := targetedCaptureModule{newCaptureModule("platform")}
+	cmdMod := commandMod.New(db, ";")
+	cmdMod.RegisterCommand(commandMod.Command{
+		Ident:   "hi",
+		MinPerm: 0,
+		MinArgs: -1,
+		MaxArgs: -1,
+		Callback: func(argv []string, origMessage mbus.IncomingChatMessage, bus *mbus.Bus) {
+			bus.NewMessage(origMessage.MakeReply(message.PlaintextToMessage("command")))
+		},
+	})
+
+	ignoreList := mbus.NewIgnoreList("Test:platform:ignored")
+	bus.Use(ignoreList.Middleware())
+	bus.RegisterModule(platform)
+	bus.RegisterModule(cmdMod)
+	bus.RegisterModule(reactionMod.New(db))
+	bus.RunAsync()
+	defer bus.Stop()
+
+	for _, channel := range []string{"#ignored", "#allowed"} {
+		bus.NewMessage(mbus.ModuleControlMessage{
+			TargetModule: mbus.ModuleIdentifier{MainIdent: "Module", SubIdent: "Reaction"},
+			StrArgv:      []string{"add", platform.ident.String() + ":" + channel, "^;hi$", message.PlaintextToMessage("reaction").Encode(), "test"},
+		})
+	}
+
+	//both modules get the messages in order, so once the replies to the allowed user arrive any reply to the ignored one
+	//would have arrived as well
+	for _, sender := range []string{"ignored", "allowed"} {
+		bus.NewMessage(mbus.IncomingChatMessage{
+			SourceModule: platform.ident,
+			SenderIdent:  platform.ident.String() + ":" + sender,
+			ReplyTo:      "#" + sender,
+			Message:      message.PlaintextToMessage(";hi"),
+		})
+	}
+
+	replies := make(map[string]bool)
+	for len(replies) != 2 {
+		reply, ok := platform.next(t).(mbus.OutgoingChatMessage)
+		if !ok {
+			continue
+		}
+
+		if reply.To != "#allowed" {
+			t.Fatalf("a module replied to an ignored user: %q to %s", reply.Message.String(), reply.To)
+		}
+		replies[reply.Message.String()] = true
+	}
+
+	if !replies["command"] || !replies["reaction"] {
+		t.Errorf("expected replies from both modules, got %v", replies)
+	}
+
+	select {
+	case msg := <-platform.messages:
+		t.Errorf("unexpected message: %+v", msg)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -0,0 +1,253 @@
+package mbus
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"reflect"
+	"sync"
+	"time"
+)
+
+const (
+	//maxRecordLength is the longest line a RecordReader accepts
+	maxRecordLength = 1 << 20
+)
+
+var (
+	ErrUnknownMessageType = errors.New("unknown message type")
+
+	messageTypesMutex = &sync.RWMutex{}
+	messageTypes      = make(map[string]reflect.Type)
+	messageTypeNames  = make(map[reflect.Type]string)
+)
+
+func init() {
+	RegisterMessageType("incoming_chat", IncomingChatMessage{})
+	RegisterMessageType("outgoing_chat", OutgoingChatMessage{})
+	RegisterMessageType("module_registered", ModuleRegisteredMessage{})
+	RegisterMessageType("module_control", ModuleControlMessage{})
+	RegisterMessageType("platform_connected", PlatformConnectedMessage{})
+	RegisterMessageType("platform_disconnected", PlatformDisconnectedMessage{})
+	RegisterMessageType("request", RequestMessage{})
+	RegisterMessageType("module_state", ModuleStateMessage{})
+	RegisterMessageType("module_health", ModuleHealthMessage{})
+}
+
+//RegisterMessageType makes a concrete message type serialisable under a stable name, the prototype is any value of the
+//type, usually the zero value
+//Types that aren't registered can't be recorded, the fields of registered types go through encoding/json
+func RegisterMessageType(name string, prototype Message) {
+	messageTypesMutex.Lock()
+	defer messageTypesMutex.Unlock()
+
+	typ := reflect.TypeOf(prototype)
+	if existing, ok := messageTypes[name]; ok && existing != typ {
+		panic(fmt.Sprintf("message type name %q is already registered for %s", name, existing))
+	}
+
+	messageTypes[name] = typ
+	messageTypeNames[typ] = name
+}
+
+//envelope is the serialised form of a message
+type envelope struct {
+	Type    string          `json:"type"`
+	Message json.RawMessage `json:"message"`
+}
+
+//MarshalMessage serialises a message of a registered type along with its type name
+func MarshalMessage(msg Message) ([]byte, error) {
+	messageTypesMutex.RLock()
+	name, ok := messageTypeNames[reflect.TypeOf(msg)]
+	messageTypesMutex.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("%w: %T", ErrUnknownMessageType, msg)
+	}
+
+	raw, err := json.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(envelope{Type: name, Message: raw})
+}
+
+//UnmarshalMessage reads a message written by MarshalMessage
+func UnmarshalMessage(data []byte) (Message, error) {
+	env := envelope{}
+	if err := json.Unmarshal(data, &env); err != nil {
+		return nil, err
+	}
+
+	messageTypesMutex.RLock()
+	typ, ok := messageTypes[env.Type]
+	messageTypesMutex.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownMessageType, env.Type)
+	}
+
+	if typ.Kind() == reflect.Ptr {
+		value := reflect.New(typ.Elem())
+		if err := json.Unmarshal(env.Message, value.Interface()); err != nil {
+			return nil, err
+		}
+		return value.Interface().(Message), nil
+	}
+
+	value := reflect.New(typ)
+	if err := json.Unmarshal(env.Message, value.Interface()); err != nil {
+		return nil, err
+	}
+	return value.Elem().Interface().(Message), nil
+}
+
+//MarshalJSON writes the payload along with its type name since it's an interface
+func (msg RequestMessage) MarshalJSON() ([]byte, error) {
+	type plain RequestMessage
+
+	var payload json.RawMessage
+	if msg.Payload != nil {
+		var err error
+		if payload, err = MarshalMessage(msg.Payload); err != nil {
+			return nil, err
+		}
+	}
+
+	return json.Marshal(struct {
+		plain
+		Payload json.RawMessage
+	}{plain(msg), payload})
+}
+
+func (msg *RequestMessage) UnmarshalJSON(data []byte) error {
+	type plain RequestMessage
+
+	decoded := struct {
+		plain
+		Payload json.RawMessage
+	}{}
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return err
+	}
+
+	*msg = RequestMessage(decoded.plain)
+	msg.Payload = nil
+
+	if len(decoded.Payload) != 0 && string(decoded.Payload) != "null" {
+		payload, err := UnmarshalMessage(decoded.Payload)
+		if err != nil {
+			return err
+		}
+		msg.Payload = payload
+	}
+
+	return nil
+}
+
+//RecordedMessage is a message published on the bus at some time
+type RecordedMessage struct {
+	Time    time.Time
+	Message Message
+}
+
+type recordedEnvelope struct {
+	Time    time.Time       `json:"time"`
+	Message json.RawMessage `json:"message"`
+}
+
+//Recorder is given every message published on the bus, see Record
+type Recorder interface {
+	Record(record RecordedMessage) error
+}
+
+//Record returns a middleware that passes every message to the recorder, it should be the first one to see everything
+//Messages that can't be recorded are logged and still delivered
+func Record(bus *Bus, recorder Recorder) Middleware {
+	return func(msg Message, next func(msg Message)) {
+		if err := recorder.Record(RecordedMessage{Time: bus.Now(), Message: msg}); err != nil {
+			log.Printf("Failed to record a %T: %s", msg, err)
+		}
+		next(msg)
+	}
+}
+
+//JSONRecorder writes recorded messages as lines of JSON
+type JSONRecorder struct {
+	mutex  *sync.Mutex
+	writer io.Writer
+}
+
+func NewJSONRecorder(writer io.Writer) *JSONRecorder {
+	return &JSONRecorder{
+		mutex:  &sync.Mutex{},
+		writer: writer,
+	}
+}
+
+func (recorder *JSONRecorder) Record(record RecordedMessage) error {
+	raw, err := MarshalMessage(record.Message)
+	if err != nil {
+		return err
+	}
+
+	line, err := json.Marshal(recordedEnvelope{Time: record.Time, Message: raw})
+	if err != nil {
+		return err
+	}
+
+	recorder.mutex.Lock()
+	defer recorder.mutex.Unlock()
+
+	_, err = recorder.writer.Write(append(line, '\n'))
+	return err
+}
+
+//RecordReader reads the messages written by a JSONRecorder
+type RecordReader struct {
+	scanner *bufio.Scanner
+	line    int
+}
+
+func NewRecordReader(reader io.Reader) *RecordReader {
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 0, 4096), maxRecordLength)
+
+	return &RecordReader{
+		scanner: scanner,
+	}
+}
+
+//Next returns the next recorded message, io.EOF is returned at the end of the recording
+func (reader *RecordReader) Next() (RecordedMessage, error) {
+	for reader.scanner.Scan() {
+		reader.line++
+
+		line := reader.scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+
+		env := recordedEnvelope{}
+		if err := json.Unmarshal(line, &env); err != nil {
+			return RecordedMessage{}, fmt.Errorf("line %d: %w", reader.line, err)
+		}
+
+		msg, err := UnmarshalMessage(env.Message)
+		if err != nil {
+			return RecordedMessage{}, fmt.Errorf("line %d: %w", reader.line, err)
+		}
+
+		return RecordedMessage{Time: env.Time, Message: msg}, nil
+	}
+
+	if err := reader.scanner.Err(); err != nil {
+		return RecordedMessage{}, err
+	}
+	return RecordedMessage{}, io.EOF
+}
@@ -0,0 +1,188 @@
+package mbus_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/xor-shift/Shiba/bot/mbus"
+	"github.com/xor-shift/Shiba/bot/message"
+)
+
+//pingPayload is a request payload that is only serialisable once registered
+type pingPayload struct {
+	Text string
+}
+
+func (msg pingPayload) GetType() int { return mbus.MTypGeneric }
+
+type unregisteredPayload struct{}
+
+func (msg unregisteredPayload) GetType() int { return mbus.MTypGeneric }
+
+func init() {
+	mbus.RegisterMessageType("test.ping", pingPayload{})
+}
+
+func TestMarshalMessage(t *testing.T) {
+	platform := mbus.ModuleIdentifier{MainIdent: "IRC", SubIdent: "net"}
+
+	tests := []struct {
+		msg mbus.Message
+		err error
+	}{
+		{msg: mbus.IncomingChatMessage{
+			SourceModule: platform,
+			SenderIdent:  "IRC:net:nick!user@host",
+			ReplyTo:      "#chan",
+			Message: message.Message{
+				{Kind: message.NodeText, Text: "hi "},
+				{Kind: message.NodeMention, Text: "other", Target: "IRC:net:other"},
+			},
+			Tags: map[string]string{"msgid": "abc"},
+		}},
+		{msg: mbus.OutgoingChatMessage{TargetModule: platform, To: "#chan", Message: message.PlaintextToMessage("hello")}},
+		{msg: mbus.PlatformDisconnectedMessage{SourceModule: platform, Reason: "EOF"}},
+		{msg: mbus.RequestMessage{ID: 3, TargetModule: platform, Payload: pingPayload{Text: "ping"}}},
+		{msg: mbus.RequestMessage{ID: 4, TargetModule: platform}},
+		{msg: mbus.RequestMessage{ID: 5, TargetModule: platform, Payload: unregisteredPayload{}}, err: mbus.ErrUnknownMessageType},
+		{msg: unregisteredPayload{}, err: mbus.ErrUnknownMessageType},
+	}
+
+	for k, test := range tests {
+		data, err := mbus.MarshalMessage(test.msg)
+		if !errors.Is(err, test.err) {
+			t.Errorf("(test %d) got error %v, expected %v", k, err, test.err)
+			continue
+		} else if err != nil {
+			continue
+		}
+
+		decoded, err := mbus.UnmarshalMessage(data)
+		if err != nil {
+			t.Errorf("(test %d) failed to unmarshal %s: %s", k, data, err)
+		} else if !reflect.DeepEqual(decoded, test.msg) {
+			t.Errorf("(test %d) got %#v, expected %#v", k, decoded, test.msg)
+		}
+	}
+
+	if _, err := mbus.UnmarshalMessage([]byte(`{"type":"nope","message":{}}`)); !errors.Is(err, mbus.ErrUnknownMessageType) {
+		t.Errorf("got error %v for an unknown type name, expected %v", err, mbus.ErrUnknownMessageType)
+	}
+}
+
+//stampModule replies to chat messages with their text and the time of the bus
+type stampModule struct {
+	bus *mbus.Bus
+}
+
+func (mod *stampModule) GetIdentifier() mbus.ModuleIdentifier {
+	return mbus.ModuleIdentifier{MainIdent: "Test", SubIdent: "stamp"}
+}
+
+func (mod *stampModule) Subscriptions() []mbus.Subscription {
+	return []mbus.Subscription{{Types: []int{mbus.MTypIncomingChat}}}
+}
+
+func (mod *stampModule) OnRegister(bus *mbus.Bus) { mod.bus = bus }
+func (mod *stampModule) OnUnregister()            {}
+
+func (mod *stampModule) OnMessage(msg mbus.Message) {
+	inChat := msg.(mbus.IncomingChatMessage)
+	text := message.MessageToPlaintext(inChat.Message) + " " + mod.bus.Now().UTC().Format(time.RFC3339)
+	mod.bus.NewMessage(inChat.MakeReply(message.PlaintextToMessage(text)))
+}
+
+func TestReplayer_Replay(t *testing.T) {
+	platform := targetedCaptureModule{newCaptureModule("platform")}
+	texts := []string{"one", "two", "three"}
+
+	recording := &bytes.Buffer{}
+	recorded := mbus.New()
+	recorded.Use(mbus.Record(recorded, mbus.NewJSONRecorder(recording)))
+	recorded.RegisterModule(platform)
+	recorded.RegisterModule(&stampModule{})
+	recorded.RunAsync()
+
+	for _, text := range texts {
+		recorded.NewMessage(mbus.IncomingChatMessage{
+			SourceModule: platform.ident,
+			SenderIdent:  "Test:platform:someone",
+			ReplyTo:      "#chan",
+			Message:      message.PlaintextToMessage(text),
+		})
+		platform.next(t)
+	}
+
+	if err := recorded.Shutdown(context.Background()); err != nil {
+		t.Fatalf("failed to shut the recorded bus down: %s", err)
+	}
+
+	//the recorded times are rewritten so that the replies can be predicted, lifecycle events are left out
+	start := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	times := make([]time.Time, 0)
+	rewritten := &bytes.Buffer{}
+	recorder := mbus.NewJSONRecorder(rewritten)
+	reader := mbus.NewRecordReader(recording)
+	for {
+		record, err := reader.Next()
+		if err != nil {
+			break
+		}
+
+		switch record.Message.(type) {
+		case mbus.IncomingChatMessage, mbus.OutgoingChatMessage:
+		default:
+			continue
+		}
+
+		record.Time = start.Add(time.Duration(len(times)) * time.Minute)
+		times = append(times, record.Time)
+		if err := recorder.Record(record); err != nil {
+			t.Fatalf("failed to rewrite the recording: %s", err)
+		}
+	}
+
+	//every chat message was recorded along with its reply
+	if len(times) != 2*len(texts) {
+		t.Fatalf("recorded %d messages, expected %d:\n%s", len(times), 2*len(texts), rewritten.String())
+	}
+
+	replayed := mbus.New()
+	replayed.RegisterModule(&stampModule{})
+	replayed.RunAsync()
+
+	replies := make([]string, 0)
+	replayer := mbus.NewReplayer(replayed)
+	replayer.OnOutgoing = func(at time.Time, msg mbus.OutgoingChatMessage) {
+		if msg.TargetModule != platform.ident || msg.To != "#chan" {
+			t.Errorf("got a reply for %s %s", msg.TargetModule, msg.To)
+		}
+		replies = append(replies, at.UTC().Format(time.RFC3339)+" "+message.MessageToPlaintext(msg.Message))
+	}
+
+	published, err := replayer.Replay(context.Background(), mbus.NewRecordReader(rewritten))
+	if err != nil {
+		t.Fatalf("failed to replay: %s", err)
+	} else if published != len(texts) {
+		t.Errorf("published %d messages, expected %d", published, len(texts))
+	}
+
+	if err := replayed.Shutdown(context.Background()); err != nil {
+		t.Fatalf("failed to shut the replayed bus down: %s", err)
+	}
+
+	expected := make([]string, 0)
+	for k, text := range texts {
+		at := times[2*k].Format(time.RFC3339)
+		expected = append(expected, at+" "+text+" "+at)
+	}
+
+	if strings.Join(replies, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("got replies:\n%s\nexpected:\n%s", strings.Join(replies, "\n"), strings.Join(expected, "\n"))
+	}
+}
@@ -0,0 +1,113 @@
+package mbus
+
+import (
+	"context"
+	"io"
+	"log"
+	"time"
+)
+
+//ExternalMessages matches the messages that come from outside of the bot, the modules publish everything else themselves
+//when they are replayed
+func ExternalMessages(msg Message) bool {
+	switch msg.(type) {
+	case IncomingChatMessage, PlatformConnectedMessage, PlatformDisconnectedMessage:
+		return true
+	}
+	return false
+}
+
+//Replayer publishes recorded messages on a bus with the clock of the bus set to the recorded times
+type Replayer struct {
+	bus   *Bus
+	clock *VirtualClock
+
+	//Filter picks the recorded messages to publish, ExternalMessages by default
+	Filter func(msg Message) bool
+	//OnOutgoing is called with the chat messages sent to the platforms that are stood in for, they are logged by default
+	OnOutgoing func(at time.Time, msg OutgoingChatMessage)
+}
+
+//NewReplayer creates a replayer for a bus and gives the bus a virtual clock, the bus should have the modules under test
+//but no real platforms
+func NewReplayer(bus *Bus) *Replayer {
+	clock := NewVirtualClock(time.Time{})
+	bus.SetClock(clock)
+
+	return &Replayer{
+		bus:    bus,
+		clock:  clock,
+		Filter: ExternalMessages,
+		OnOutgoing: func(at time.Time, msg OutgoingChatMessage) {
+			log.Printf("[%s] %s %s: %s", at.Format(time.RFC3339), msg.TargetModule.String(), msg.To, msg.Message.String())
+		},
+	}
+}
+
+//Replay publishes the recorded messages one by one, waiting for the bus to be idle after each of them so that the modules
+//handle them in the same order every time, the bus has to be running
+//Platforms that published the recorded messages are stood in for unless a module with their identifier is on the bus
+//It returns the number of messages that were published
+func (replayer *Replayer) Replay(ctx context.Context, reader *RecordReader) (int, error) {
+	published := 0
+
+	for {
+		record, err := reader.Next()
+		if err == io.EOF {
+			return published, nil
+		} else if err != nil {
+			return published, err
+		}
+
+		if !replayer.Filter(record.Message) {
+			continue
+		}
+
+		if sourced, ok := record.Message.(SourcedMessage); ok {
+			replayer.standIn(sourced.GetSourceIdentifier())
+		}
+
+		replayer.clock.Set(record.Time)
+		if err := replayer.bus.NewMessage(record.Message); err != nil {
+			return published, err
+		}
+		published++
+
+		if err := replayer.bus.WaitIdle(ctx); err != nil {
+			return published, err
+		}
+	}
+}
+
+//standIn registers a stand-in platform unless there is already a module with the identifier
+func (replayer *Replayer) standIn(identifier ModuleIdentifier) {
+	if _, ok := replayer.bus.ModuleState(identifier); ok {
+		return
+	}
+
+	replayer.bus.RegisterModule(&standInPlatform{
+		identifier: identifier,
+		replayer:   replayer,
+	})
+}
+
+//standInPlatform receives the messages sent to a platform during a replay
+type standInPlatform struct {
+	identifier ModuleIdentifier
+	replayer   *Replayer
+}
+
+func (plat *standInPlatform) GetIdentifier() ModuleIdentifier { return plat.identifier }
+func (plat *standInPlatform) OnRegister(bus *Bus)             {}
+func (plat *standInPlatform) OnUnregister()                   {}
+
+//Subscriptions is empty, platforms only handle the messages targeted at them
+func (plat *standInPlatform) Subscriptions() []Subscription {
+	return nil
+}
+
+func (plat *standInPlatform) OnMessage(msg Message) {
+	if outChatMSG, ok := msg.(OutgoingChatMessage); ok && plat.replayer.OnOutgoing != nil {
+		plat.replayer.OnOutgoing(plat.replayer.clock.Now(), outChatMSG)
+	}
+}
@@ -0,0 +1,124 @@
+package mbus
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+const (
+	//DefaultRequestTimeout is used for requests with a context that has no deadline
+	DefaultRequestTimeout = 10 * time.Second
+)
+
+var (
+	ErrNoSuchModule    = errors.New("no such module")
+	ErrWildcardRequest = errors.New("requests can't target wildcard identifiers")
+)
+
+//RequestMessage carries the payload of Bus.Request to the target module, which answers it with Bus.Reply
+type RequestMessage struct {
+	ID           uint64
+	TargetModule ModuleIdentifier
+	Payload      Message
+}
+
+func (msg RequestMessage) GetType() int                          { return MTypRequest }
+func (msg RequestMessage) GetTargetIdentifier() ModuleIdentifier { return msg.TargetModule }
+
+type requestResult struct {
+	reply Message
+	err   error
+}
+
+type pendingRequest struct {
+	target  ModuleIdentifier
+	results chan requestResult
+}
+
+//Request sends the payload to the target module and waits for its reply, DefaultRequestTimeout is used if ctx has no deadline
+//It must not be called from the OnMessage of the target module since the reply could never be delivered
+func (bus *Bus) Request(ctx context.Context, target ModuleIdentifier, payload Message) (Message, error) {
+	if target.SubIdent == "*" {
+		return nil, ErrWildcardRequest
+	}
+
+	bus.busMutex.RLock()
+	entry, exists := bus.modules[target]
+	failed := exists && entry.state == StateFailed
+	bus.busMutex.RUnlock()
+
+	if !exists {
+		return nil, fmt.Errorf("%w: %s", ErrNoSuchModule, target.String())
+	} else if failed {
+		return nil, fmt.Errorf("%w: %s", ErrModuleFailed, target.String())
+	}
+
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, DefaultRequestTimeout)
+		defer cancel()
+	}
+
+	pending := pendingRequest{
+		target:  target,
+		results: make(chan requestResult, 1),
+	}
+
+	bus.requestsMutex.Lock()
+	bus.lastRequestID++
+	id := bus.lastRequestID
+	bus.requests[id] = pending
+	bus.requestsMutex.Unlock()
+
+	defer func() {
+		bus.requestsMutex.Lock()
+		delete(bus.requests, id)
+		bus.requestsMutex.Unlock()
+	}()
+
+	if err := bus.NewMessage(RequestMessage{
+		ID:           id,
+		TargetModule: target,
+		Payload:      payload,
+	}); err != nil {
+		return nil, fmt.Errorf("request %d to %s: %w", id, target.String(), err)
+	}
+
+	select {
+	case result := <-pending.results:
+		return result.reply, result.err
+	case <-ctx.Done():
+		return nil, fmt.Errorf("request %d to %s: %w", id, target.String(), ctx.Err())
+	}
+}
+
+//Reply answers a request, replies to requests that have already timed out are dropped
+func (bus *Bus) Reply(request RequestMessage, reply Message, err error) {
+	bus.requestsMutex.Lock()
+	defer bus.requestsMutex.Unlock()
+
+	pending, ok := bus.requests[request.ID]
+	if !ok {
+		log.Printf("Dropping the reply to request %d to %s, the requester stopped waiting", request.ID, request.TargetModule.String())
+		return
+	}
+
+	delete(bus.requests, request.ID)
+	pending.results <- requestResult{reply, err}
+}
+
+//failRequests fails the pending requests to a module that is being unregistered
+func (bus *Bus) failRequests(target ModuleIdentifier) {
+	bus.requestsMutex.Lock()
+	defer bus.requestsMutex.Unlock()
+
+	for id, pending := range bus.requests {
+		if pending.target == target {
+			delete(bus.requests, id)
+			pending.results <- requestResult{nil, fmt.Errorf("%w: %s was unregistered", ErrNoSuchModule, target.String())}
+		}
+	}
+}
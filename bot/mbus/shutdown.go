@@ -0,0 +1,60 @@
+package mbus
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	//idlePollInterval is how often WaitIdle checks whether the published messages have been delivered
+	idlePollInterval = time.Millisecond
+)
+
+var (
+	ErrBusStopped   = errors.New("the bus has been stopped")
+	ErrShuttingDown = errors.New("the bus is shutting down")
+)
+
+//settle marks published messages as delivered or discarded
+func (bus *Bus) settle(count int) {
+	atomic.AddInt64(&bus.pending, -int64(count))
+}
+
+//Shutdown stops the bus gracefully: incoming chat messages are refused, the messages that have already been published
+//(and the ones published while handling them) are delivered until the bus is idle or ctx is done, and then the modules
+//are stopped in order
+//The error of ctx is returned if undelivered messages had to be discarded, the bus is stopped either way
+func (bus *Bus) Shutdown(ctx context.Context) error {
+	bus.queueMutex.Lock()
+	bus.draining = true
+	bus.queueMutex.Unlock()
+
+	err := bus.WaitIdle(ctx)
+	if err != nil {
+		log.Printf("Stopped draining the bus with %d message(s) undelivered", atomic.LoadInt64(&bus.pending))
+	}
+	bus.Stop()
+
+	return err
+}
+
+//WaitIdle waits until every published message, including the ones published while handling them, has been delivered or
+//discarded
+//Messages for modules that are still waiting for their dependencies are never delivered, so they run out the deadline
+func (bus *Bus) WaitIdle(ctx context.Context) error {
+	ticker := time.NewTicker(idlePollInterval)
+	defer ticker.Stop()
+
+	for atomic.LoadInt64(&bus.pending) != 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,144 @@
+package mbus_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/xor-shift/Shiba/bot/mbus"
+	"github.com/xor-shift/Shiba/bot/message"
+)
+
+//echoModule replies to disconnection messages with their reasons after a while
+type echoModule struct {
+	bus    *mbus.Bus
+	target mbus.ModuleIdentifier
+	//refused gets the error of publishing an incoming chat message once the bus refuses it
+	refused chan error
+	release chan struct{}
+}
+
+func (mod *echoModule) GetIdentifier() mbus.ModuleIdentifier {
+	return mbus.ModuleIdentifier{MainIdent: "Test", SubIdent: "echo"}
+}
+
+func (mod *echoModule) Subscriptions() []mbus.Subscription {
+	return []mbus.Subscription{{Types: []int{mbus.MTypPlatformDisconnected}}}
+}
+
+func (mod *echoModule) OnRegister(bus *mbus.Bus) { mod.bus = bus }
+func (mod *echoModule) OnUnregister()            {}
+
+func (mod *echoModule) OnMessage(msg mbus.Message) {
+	reason := msg.(mbus.PlatformDisconnectedMessage).Reason
+
+	switch reason {
+	case "block":
+		<-mod.release
+	case "probe":
+		for i := 0; i < 1000; i++ {
+			if err := mod.bus.NewMessage(mbus.IncomingChatMessage{SourceModule: mod.target}); err != nil {
+				mod.refused <- err
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+		mod.refused <- nil
+	default:
+		time.Sleep(10 * time.Millisecond)
+		mod.bus.NewMessage(mbus.OutgoingChatMessage{TargetModule: mod.target, Message: message.PlaintextToMessage(reason)})
+	}
+}
+
+func TestBus_Shutdown(t *testing.T) {
+	bus := mbus.New()
+	capture := targetedCaptureModule{newCaptureModule("capture")}
+	echo := &echoModule{target: capture.ident, refused: make(chan error, 1)}
+	bus.RegisterModule(capture)
+	bus.RegisterModule(echo)
+	bus.RunAsync()
+
+	expected := []string{"a", "b", "c", "d"}
+	for _, reason := range expected {
+		bus.NewMessage(mbus.PlatformDisconnectedMessage{Reason: reason})
+	}
+	bus.NewMessage(mbus.PlatformDisconnectedMessage{Reason: "probe"})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := bus.Shutdown(ctx); err != nil {
+		t.Errorf("expected a clean shutdown, got %s", err)
+	}
+
+	if err := <-echo.refused; !errors.Is(err, mbus.ErrShuttingDown) {
+		t.Errorf("expected incoming chat messages to be refused while shutting down, got %v", err)
+	}
+
+	got := make([]string, 0)
+	for len(capture.messages) != 0 {
+		if reply, ok := (<-capture.messages).(mbus.OutgoingChatMessage); ok {
+			got = append(got, reply.Message.String())
+		}
+	}
+
+	if len(got) != len(expected) {
+		t.Errorf("expected every reply to be delivered before stopping, got %v", got)
+	} else {
+		for i := range got {
+			if got[i] != expected[i] {
+				t.Errorf("expected the replies %v, got %v", expected, got)
+				break
+			}
+		}
+	}
+
+	if err := bus.NewMessage(mbus.PlatformConnectedMessage{}); !errors.Is(err, mbus.ErrBusStopped) {
+		t.Errorf("expected publishing to fail after shutting down, got %v", err)
+	}
+	bus.Stop()
+}
+
+func TestBus_Shutdown_Deadline(t *testing.T) {
+	bus := mbus.New()
+	echo := &echoModule{release: make(chan struct{})}
+	bus.RegisterModule(echo)
+	bus.RunAsync()
+
+	bus.NewMessage(mbus.PlatformDisconnectedMessage{Reason: "block"})
+	bus.NewMessage(mbus.PlatformDisconnectedMessage{Reason: "a"})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	result := make(chan error)
+	go func() {
+		result <- bus.Shutdown(ctx)
+	}()
+
+	<-ctx.Done()
+	close(echo.release)
+
+	if err := <-result; !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the deadline to be exceeded, got %v", err)
+	}
+}
+
+func TestBus_Request_Stopped(t *testing.T) {
+	bus := mbus.New()
+	bus.RunAsync()
+	bus.Stop()
+
+	//modules can still be registered but nothing reaches them
+	echo := &echoModule{}
+	bus.RegisterModule(echo)
+
+	start := time.Now()
+	if _, err := bus.Request(context.Background(), echo.GetIdentifier(), mbus.PlatformDisconnectedMessage{}); !errors.Is(err, mbus.ErrBusStopped) {
+		t.Errorf("got error %v, expected %v", err, mbus.ErrBusStopped)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("the request took %s to fail", elapsed)
+	}
+}
@@ -0,0 +1,165 @@
+package mbus
+
+import (
+	"fmt"
+)
+
+//Subscription selects the untargeted messages a module receives, every non-empty criterion has to match
+type Subscription struct {
+	//Types lists message types (the MTyp constants), empty matches every type
+	Types []int
+	//Sources lists the modules that publish the messages, wildcard sub-identifiers are allowed
+	//Messages that don't implement SourcedMessage never match a non-empty list
+	Sources []ModuleIdentifier
+	//Filter is an optional predicate
+	Filter func(msg Message) bool
+	//Handler is called with the matching messages instead of OnMessage if set
+	Handler func(msg Message)
+}
+
+//Subscriber is implemented by modules that declare what they want, modules that don't implement it receive every message
+//Targeted messages are always delivered to OnMessage, regardless of the subscriptions
+type Subscriber interface {
+	Module
+	Subscriptions() []Subscription
+}
+
+//SourcedMessage is implemented by messages that have a source module, used to match Subscription.Sources
+type SourcedMessage interface {
+	Message
+	GetSourceIdentifier() ModuleIdentifier
+}
+
+func (sub Subscription) matches(msg Message) bool {
+	if len(sub.Types) != 0 {
+		found := false
+		for _, typ := range sub.Types {
+			if typ == msg.GetType() {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if len(sub.Sources) != 0 {
+		sMsg, ok := msg.(SourcedMessage)
+		if !ok {
+			return false
+		}
+
+		found := false
+		for _, source := range sub.Sources {
+			if sMsg.GetSourceIdentifier().Compare(source) == 2 {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	return sub.Filter == nil || sub.Filter(msg)
+}
+
+//delivery is a message in an inbox along with what to call with it
+type delivery struct {
+	msg       Message
+	onMessage bool
+	handlers  []func(msg Message)
+}
+
+//match returns how a message is delivered to the module, the second return value is false if it isn't
+func (entry *moduleEntry) match(msg Message) (delivery, bool) {
+	if !entry.subscribed {
+		return delivery{msg: msg, onMessage: true}, true
+	}
+
+	d := delivery{msg: msg}
+	for _, sub := range entry.subscriptions {
+		if !sub.matches(msg) {
+			continue
+		}
+
+		if sub.Handler == nil {
+			d.onMessage = true
+		} else {
+			d.handlers = append(d.handlers, sub.Handler)
+		}
+	}
+
+	return d, d.onMessage || len(d.handlers) != 0
+}
+
+//reindex rebuilds the index of modules by the message types they subscribe to, busMutex must be write locked
+func (bus *Bus) reindex() {
+	bus.typeIndex = make(map[int][]*moduleEntry)
+	bus.unindexed = make([]*moduleEntry, 0)
+
+	for _, entry := range bus.modules {
+		types := make(map[int]bool)
+		indexable := entry.subscribed
+
+		for _, sub := range entry.subscriptions {
+			if len(sub.Types) == 0 {
+				indexable = false
+				break
+			}
+			for _, typ := range sub.Types {
+				types[typ] = true
+			}
+		}
+
+		if !indexable {
+			bus.unindexed = append(bus.unindexed, entry)
+			continue
+		}
+
+		for typ := range types {
+			bus.typeIndex[typ] = append(bus.typeIndex[typ], entry)
+		}
+	}
+}
+
+//Subscribe adds a subscription to a registered module, from then on it only receives the untargeted messages that match
+//one of its subscriptions
+func (bus *Bus) Subscribe(module Module, subscription Subscription) error {
+	bus.busMutex.Lock()
+	defer bus.busMutex.Unlock()
+
+	entry, ok := bus.modules[module.GetIdentifier()]
+	if !ok || entry.module != module {
+		return fmt.Errorf("%w: %s", ErrNoSuchModule, module.GetIdentifier().String())
+	}
+
+	entry.subscribed = true
+	entry.subscriptions = append(entry.subscriptions, subscription)
+	bus.reindex()
+
+	return nil
+}
+
+//Subscribe makes the module receive messages of type T with the handler, optionally only those published by the sources
+func Subscribe[T Message](bus *Bus, module Module, handler func(msg T), sources ...ModuleIdentifier) error {
+	subscription := Subscription{
+		Sources: sources,
+		Filter: func(msg Message) bool {
+			_, ok := msg.(T)
+			return ok
+		},
+		Handler: func(msg Message) {
+			handler(msg.(T))
+		},
+	}
+
+	//the type can only be indexed if T is a concrete type
+	var zero T
+	if Message(zero) != nil {
+		subscription.Types = []int{zero.GetType()}
+	}
+
+	return bus.Subscribe(module, subscription)
+}
@@ -0,0 +1,312 @@
+package mbus
+
+import (
+	"fmt"
+	"log"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+//SupervisorPolicy decides what happens to modules that panic while handling messages
+type SupervisorPolicy struct {
+	//Window is the period in which panics are counted, a module that doesn't panic for this long is considered healthy again
+	Window time.Duration
+	//RestartAfter is the number of panics in the window after which the module is restarted with OnUnregister and OnRegister,
+	//every RestartAfter panics the module is restarted again, 0 disables restarts
+	RestartAfter int
+	//DisableAfter is the number of panics in the window after which the module is unregistered and marked as failed,
+	//0 never disables modules
+	DisableAfter int
+	//Backoff is how long the messages of a restarted module are dropped for, it doubles with every restart up to MaxBackoff
+	//and is reset once the module is healthy again
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+}
+
+var (
+	DefaultSupervisorPolicy = SupervisorPolicy{
+		Window:       time.Minute,
+		RestartAfter: 3,
+		DisableAfter: 10,
+		Backoff:      time.Second,
+		MaxBackoff:   time.Minute,
+	}
+)
+
+//PanicError is a recovered panic along with the stack of the goroutine that panicked
+type PanicError struct {
+	Value interface{}
+	Stack []byte
+}
+
+func (err PanicError) Error() string {
+	return fmt.Sprintf("panic: %v", err.Value)
+}
+
+//protect calls f and turns a panic in it into a PanicError
+func protect(f func()) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = PanicError{
+				Value: r,
+				Stack: debug.Stack(),
+			}
+		}
+	}()
+
+	f()
+	return nil
+}
+
+//logPanic logs an error returned by protect, including the stack if it was a panic
+func logPanic(identifier ModuleIdentifier, action string, err error) {
+	if panicErr, ok := err.(PanicError); ok {
+		log.Printf("Module %s panicked %s: %v\n%s", identifier.String(), action, panicErr.Value, panicErr.Stack)
+		return
+	}
+	log.Printf("Module %s failed %s: %s", identifier.String(), action, err)
+}
+
+//ModuleHealth describes how well a module has been doing since it was registered
+type ModuleHealth struct {
+	Module ModuleIdentifier
+	State  ModuleState
+
+	Panics uint64
+	//RecentPanics is the number of panics within the window of the supervisor policy
+	RecentPanics int
+	Restarts     uint64
+	LastPanic    string
+	LastPanicAt  time.Time
+
+	//OpenUntil is set while the messages of the module are being dropped after a restart
+	OpenUntil time.Time
+	//Dropped is the number of messages dropped while the module was backing off
+	Dropped uint64
+}
+
+func (health ModuleHealth) String() string {
+	str := fmt.Sprintf("%s: %s, %d panic(s), %d recently, %d restart(s)", health.Module.String(), health.State, health.Panics, health.RecentPanics, health.Restarts)
+	if health.Panics != 0 {
+		str += fmt.Sprintf(", last at %s: %s", health.LastPanicAt.Format(time.RFC3339), health.LastPanic)
+	}
+	if !health.OpenUntil.IsZero() {
+		str += fmt.Sprintf(", backing off until %s", health.OpenUntil.Format(time.RFC3339))
+	}
+	return str
+}
+
+//ModuleHealthMessage is published whenever a module panics, is restarted or is disabled
+type ModuleHealthMessage struct {
+	Health ModuleHealth
+}
+
+func (msg ModuleHealthMessage) GetType() int                          { return MTypModuleHealth }
+func (msg ModuleHealthMessage) GetSourceIdentifier() ModuleIdentifier { return msg.Health.Module }
+
+//moduleHealth is the supervision state of a module, it is written by the worker of the module
+type moduleHealth struct {
+	mutex   *sync.Mutex
+	health  ModuleHealth
+	recent  []time.Time
+	backoff time.Duration
+}
+
+func newModuleHealth(identifier ModuleIdentifier) *moduleHealth {
+	return &moduleHealth{
+		mutex:  &sync.Mutex{},
+		health: ModuleHealth{Module: identifier},
+	}
+}
+
+//recordPanic counts a panic and returns the number of panics within the window
+func (h *moduleHealth) recordPanic(err error, now time.Time, policy SupervisorPolicy) int {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	recent := h.recent[:0]
+	for _, at := range h.recent {
+		if now.Sub(at) < policy.Window {
+			recent = append(recent, at)
+		}
+	}
+	if len(recent) == 0 {
+		h.backoff = 0
+	}
+
+	h.recent = append(recent, now)
+	h.health.Panics++
+	h.health.RecentPanics = len(h.recent)
+	h.health.LastPanic = err.Error()
+	h.health.LastPanicAt = now
+
+	return len(h.recent)
+}
+
+//open starts dropping messages for the next backoff period
+func (h *moduleHealth) open(now time.Time, policy SupervisorPolicy) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.health.Restarts++
+
+	if h.backoff == 0 {
+		h.backoff = policy.Backoff
+	} else {
+		h.backoff *= 2
+	}
+	if policy.MaxBackoff > 0 && h.backoff > policy.MaxBackoff {
+		h.backoff = policy.MaxBackoff
+	}
+
+	if h.backoff > 0 {
+		h.health.OpenUntil = now.Add(h.backoff)
+	}
+}
+
+//allow returns whether or not a message can be delivered, messages that can't are counted as dropped
+func (h *moduleHealth) allow(now time.Time) bool {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if h.health.OpenUntil.IsZero() {
+		return true
+	}
+	if !now.Before(h.health.OpenUntil) {
+		h.health.OpenUntil = time.Time{}
+		return true
+	}
+
+	h.health.Dropped++
+	return false
+}
+
+func (h *moduleHealth) snapshot(state ModuleState) ModuleHealth {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	health := h.health
+	health.State = state
+	return health
+}
+
+//SetSupervisorPolicy replaces the policy for every module, DefaultSupervisorPolicy is used until it's called
+func (bus *Bus) SetSupervisorPolicy(policy SupervisorPolicy) {
+	bus.busMutex.Lock()
+	defer bus.busMutex.Unlock()
+
+	bus.policy = policy
+}
+
+//Health returns the health of every module on the bus, sorted by identifier
+func (bus *Bus) Health() []ModuleHealth {
+	bus.busMutex.RLock()
+	defer bus.busMutex.RUnlock()
+
+	health := make([]ModuleHealth, 0, len(bus.modules))
+	for _, entry := range bus.sortedEntries() {
+		health = append(health, entry.health.snapshot(entry.state))
+	}
+
+	return health
+}
+
+//publishHealth publishes the current health of a module
+func (bus *Bus) publishHealth(entry *moduleEntry) {
+	bus.busMutex.RLock()
+	health := entry.health.snapshot(entry.state)
+	bus.busMutex.RUnlock()
+
+	bus.NewMessage(ModuleHealthMessage{Health: health})
+}
+
+//supervise applies the supervisor policy after a module panicked while handling a message, it's called by the worker of
+//the module and returns false if the module has been disabled and the worker should exit
+func (bus *Bus) supervise(entry *moduleEntry, err error) bool {
+	identifier := entry.module.GetIdentifier()
+	logPanic(identifier, "while handling a message", err)
+
+	bus.busMutex.RLock()
+	policy := bus.policy
+	bus.busMutex.RUnlock()
+
+	now := bus.Now()
+	recent := entry.health.recordPanic(err, now, policy)
+
+	if policy.DisableAfter > 0 && recent >= policy.DisableAfter {
+		log.Printf("Module %s panicked %d times within %s, disabling it", identifier.String(), recent, policy.Window)
+		bus.disable(entry)
+		return false
+	}
+
+	if policy.RestartAfter > 0 && recent%policy.RestartAfter == 0 {
+		log.Printf("Module %s panicked %d times within %s, restarting it", identifier.String(), recent, policy.Window)
+		entry.health.open(now, policy)
+		if !bus.restart(entry) {
+			return false
+		}
+	}
+
+	bus.publishHealth(entry)
+	return true
+}
+
+//transition changes the state of a module from running or starting, it returns false if the module is being stopped
+//It is called from the worker of the module, publishing the transition doesn't wait for the message worker
+func (bus *Bus) transition(entry *moduleEntry, state ModuleState) bool {
+	bus.busMutex.Lock()
+	if entry.state != StateRunning && entry.state != StateStarting {
+		bus.busMutex.Unlock()
+		return false
+	}
+	transition := entry.setState(state)
+	bus.busMutex.Unlock()
+
+	bus.NewMessage(transition)
+	return true
+}
+
+//restart calls OnUnregister and OnRegister of a module from its worker, it returns false if the module was disabled
+func (bus *Bus) restart(entry *moduleEntry) bool {
+	identifier := entry.module.GetIdentifier()
+
+	if !bus.transition(entry, StateStarting) {
+		return true
+	}
+
+	if err := protect(entry.module.OnUnregister); err != nil {
+		logPanic(identifier, "while being unregistered for a restart", err)
+	}
+	bus.setRegistered(entry, false)
+
+	if err := protect(func() { entry.module.OnRegister(bus) }); err != nil {
+		logPanic(identifier, "while being registered for a restart", err)
+		bus.disable(entry)
+		return false
+	}
+	bus.setRegistered(entry, true)
+
+	bus.transition(entry, StateRunning)
+	return true
+}
+
+//disable marks a module as failed from its worker, the module stays on the bus without getting messages until it is
+//registered again
+func (bus *Bus) disable(entry *moduleEntry) {
+	identifier := entry.module.GetIdentifier()
+
+	if bus.isRegistered(entry) {
+		if err := protect(entry.module.OnUnregister); err != nil {
+			logPanic(identifier, "while being disabled", err)
+		}
+		bus.setRegistered(entry, false)
+	}
+
+	if bus.transition(entry, StateFailed) {
+		entry.inbox.close()
+		bus.failRequests(identifier)
+	}
+
+	bus.publishHealth(entry)
+}
@@ -0,0 +1,172 @@
+package mbus_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/xor-shift/Shiba/bot/mbus"
+)
+
+//panickyModule panics on disconnection messages and reports its lifecycle calls and the messages it handled
+type panickyModule struct {
+	events chan string
+}
+
+func (mod *panickyModule) GetIdentifier() mbus.ModuleIdentifier {
+	return mbus.ModuleIdentifier{MainIdent: "Test", SubIdent: "panicky"}
+}
+
+func (mod *panickyModule) Subscriptions() []mbus.Subscription {
+	return []mbus.Subscription{{Types: []int{mbus.MTypPlatformConnected, mbus.MTypPlatformDisconnected}}}
+}
+
+func (mod *panickyModule) OnRegister(bus *mbus.Bus) { mod.events <- "register" }
+func (mod *panickyModule) OnUnregister()            { mod.events <- "unregister" }
+
+func (mod *panickyModule) OnMessage(msg mbus.Message) {
+	if _, ok := msg.(mbus.PlatformDisconnectedMessage); ok {
+		var nilMap map[string]int
+		nilMap["reaction"]++
+	}
+	mod.events <- "message"
+}
+
+func TestBus_Supervise(t *testing.T) {
+	tests := []struct {
+		policy mbus.SupervisorPolicy
+		//input has c for a message that is handled and p for one that panics
+		input    string
+		expected []string
+		state    mbus.ModuleState
+		health   mbus.ModuleHealth
+	}{
+		{mbus.SupervisorPolicy{Window: time.Minute}, "ppc", []string{"message"},
+			mbus.StateRunning, mbus.ModuleHealth{Panics: 2, RecentPanics: 2}},
+		{mbus.SupervisorPolicy{Window: time.Minute, RestartAfter: 2}, "pcpc", []string{"message", "unregister", "register", "message"},
+			mbus.StateRunning, mbus.ModuleHealth{Panics: 2, RecentPanics: 2, Restarts: 1}},
+		{mbus.SupervisorPolicy{Window: time.Minute, RestartAfter: 1, DisableAfter: 2}, "ppc", []string{"unregister", "register", "unregister"},
+			mbus.StateFailed, mbus.ModuleHealth{Panics: 2, RecentPanics: 2, Restarts: 1}},
+		{mbus.SupervisorPolicy{Window: time.Minute, RestartAfter: 1, Backoff: time.Hour}, "pcc", []string{"unregister", "register"},
+			mbus.StateRunning, mbus.ModuleHealth{Panics: 1, RecentPanics: 1, Restarts: 1, Dropped: 2}},
+	}
+
+	for k, v := range tests {
+		bus := mbus.New()
+		bus.SetSupervisorPolicy(v.policy)
+
+		mod := &panickyModule{events: make(chan string, 64)}
+		bus.RegisterModule(mod)
+		bus.RunAsync()
+
+		if event := <-mod.events; event != "register" {
+			t.Fatalf("(test %d) expected the module to be registered first, got %s", k, event)
+		}
+
+		//health messages come after the supervisor is done with a panic
+		done := make(chan struct{}, 64)
+		bus.Use(func(msg mbus.Message, next func(msg mbus.Message)) {
+			if _, ok := msg.(mbus.ModuleHealthMessage); ok {
+				done <- struct{}{}
+			}
+			next(msg)
+		})
+
+		for _, c := range v.input {
+			if c == 'p' {
+				bus.NewMessage(mbus.PlatformDisconnectedMessage{})
+				<-done
+			} else {
+				bus.NewMessage(mbus.PlatformConnectedMessage{})
+			}
+		}
+
+		got := make([]string, 0)
+		for len(got) != len(v.expected) {
+			select {
+			case event := <-mod.events:
+				got = append(got, event)
+			case <-time.After(5 * time.Second):
+				t.Fatalf("(test %d) timed out, got %v", k, got)
+			}
+		}
+
+		for i := range got {
+			if got[i] != v.expected[i] {
+				t.Errorf("(test %d) expected %v, got %v", k, v.expected, got)
+				break
+			}
+		}
+
+		//dropped messages are counted as the worker gets to them
+		var health mbus.ModuleHealth
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+			health = bus.Health()[0]
+			if health.Dropped == v.health.Dropped {
+				break
+			}
+		}
+
+		if health.State != v.state {
+			t.Errorf("(test %d) expected the module to be %s, it is %s", k, v.state, health.State)
+		}
+		if health.Panics != v.health.Panics || health.RecentPanics != v.health.RecentPanics || health.Restarts != v.health.Restarts || health.Dropped != v.health.Dropped {
+			t.Errorf("(test %d) expected the health %+v, got %+v", k, v.health, health)
+		}
+		if health.LastPanic != "panic: assignment to entry in nil map" {
+			t.Errorf("(test %d) unexpected last panic: %s", k, health.LastPanic)
+		}
+
+		bus.Stop()
+		close(mod.events)
+
+		//the module gets unregistered when the bus stops unless it has been disabled
+		event, ok := <-mod.events
+		if v.state != mbus.StateFailed && (!ok || event != "unregister") {
+			t.Errorf("(test %d) expected the module to be unregistered when the bus stopped", k)
+		} else if v.state == mbus.StateFailed && ok {
+			t.Errorf("(test %d) expected the disabled module to be left alone, got %s", k, event)
+		}
+	}
+}
+
+//floodPanicModule panics on every message
+type floodPanicModule struct{}
+
+func (mod floodPanicModule) GetIdentifier() mbus.ModuleIdentifier {
+	return mbus.ModuleIdentifier{MainIdent: "Test", SubIdent: "flood"}
+}
+
+func (mod floodPanicModule) OnRegister(bus *mbus.Bus)   {}
+func (mod floodPanicModule) OnUnregister()              {}
+func (mod floodPanicModule) OnMessage(msg mbus.Message) { panic("flood") }
+
+func TestBus_Supervise_Flood(t *testing.T) {
+	bus := mbus.New()
+	bus.SetSupervisorPolicy(mbus.SupervisorPolicy{Window: time.Minute, RestartAfter: 1})
+	bus.RegisterModule(floodPanicModule{})
+	bus.RunAsync()
+
+	//every restart publishes state and health messages, which the module gets as well
+	for i := 0; i < 4*mbus.DefaultInboxOptions.Size; i++ {
+		bus.NewMessage(mbus.PlatformConnectedMessage{})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	for {
+		//the messages published by restarts keep the module busy, it is enough for the bus not to be stuck
+		health := bus.Health()[0]
+		if health.Restarts >= 4*uint64(mbus.DefaultInboxOptions.Size) {
+			break
+		}
+
+		select {
+		case <-ctx.Done():
+			t.Fatalf("the bus got stuck after %d restarts", health.Restarts)
+		case <-time.After(time.Millisecond):
+		}
+	}
+
+	bus.Stop()
+}
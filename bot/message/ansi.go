@@ -0,0 +1,110 @@
+package message
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+const (
+	ANSIReset = "\x1b[0m"
+)
+
+//ansiAttributes maps properties to SGR parameters, monospace has no equivalent and spoilers are rendered black on black
+var ansiAttributes = []struct {
+	prop      PropertyList
+	parameter string
+}{
+	{EMPropBold, "1"},
+	{EMPropItalic, "3"},
+	{EMPropUnderline, "4"},
+	{EMPropStrikeThrough, "9"},
+}
+
+func ansiColor(parameter int, color Color) string {
+	rgb := color.RGB()
+	return fmt.Sprintf("%d;2;%d;%d;%d", parameter, rgb>>16&0xff, rgb>>8&0xff, rgb&0xff)
+}
+
+//stripControl removes the control characters other than line breaks and tabs, text carrying escape sequences of its
+//own could otherwise take over the terminal
+func stripControl(text string) string {
+	return strings.Map(func(c rune) rune {
+		if c == '\n' || c == '\t' || !unicode.IsControl(c) {
+			return c
+		}
+		return -1
+	}, text)
+}
+
+//ansiSequence returns the SGR sequence that resets the terminal and sets the style, mentions are highlighted in reverse video
+func ansiSequence(style Style, mention bool) string {
+	parameters := []string{"0"}
+
+	for _, v := range ansiAttributes {
+		if style.Props&v.prop != 0 {
+			parameters = append(parameters, v.parameter)
+		}
+	}
+
+	if mention {
+		parameters = append(parameters, "7")
+	}
+
+	if style.Props&EMPropSpoiler != 0 {
+		parameters = append(parameters, "30", "40")
+	} else {
+		if style.Props&EMPropForeground != 0 {
+			parameters = append(parameters, ansiColor(38, style.Foreground))
+		}
+		if style.Props&EMPropBackground != 0 {
+			parameters = append(parameters, ansiColor(48, style.Background))
+		}
+	}
+
+	return "\x1b[" + strings.Join(parameters, ";") + "m"
+}
+
+//MessageToANSI renders the message with ANSI escape sequences (24-bit colours) for terminals
+//Links are rendered as OSC 8 hyperlinks and code blocks are put on their own lines, control characters are stripped
+//The terminal is reset at the end if any formatting was used
+func MessageToANSI(msg Message) string {
+	builder := strings.Builder{}
+	reset := ansiSequence(Style{}, false)
+	current := reset
+	afterBlock := false
+
+	StartLine := func() {
+		if builder.Len() != 0 && !strings.HasSuffix(builder.String(), "\n") {
+			builder.WriteByte('\n')
+		}
+	}
+
+	msg.normalize().walkNodes(func(node MessageNode, style, last Style) {
+		text := stripControl(node.Text)
+
+		if sequence := ansiSequence(style, node.Kind == NodeMention); sequence != current {
+			builder.WriteString(sequence)
+			current = sequence
+		}
+
+		if node.Kind == NodeCodeBlock {
+			StartLine()
+			text = strings.TrimSuffix(text, "\n")
+		} else if afterBlock && !strings.HasPrefix(text, "\n") {
+			StartLine()
+		}
+		afterBlock = node.Kind == NodeCodeBlock
+
+		if node.Kind == NodeLink && IsSafeLink(node.Target) {
+			text = "\x1b]8;;" + stripControl(node.Target) + "\x1b\\" + text + "\x1b]8;;\x1b\\"
+		}
+		builder.WriteString(text)
+	})
+
+	if current != reset {
+		builder.WriteString(ANSIReset)
+	}
+
+	return builder.String()
+}
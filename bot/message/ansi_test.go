@@ -0,0 +1,35 @@
+package message
+
+import (
+	"testing"
+)
+
+func TestMessageToANSI(t *testing.T) {
+	tests := []struct {
+		message  Message
+		expected string
+	}{
+		{PlaintextToMessage("plain"), "plain"},
+		{
+			Message{{Props: props(EMPropBold), Text: "bold"}, {Props: props(EMPropBold | EMPropUnderline), Text: "both"}, {Props: ResetProperties, Text: "plain"}},
+			"\x1b[0;1mbold\x1b[0;1;4mboth\x1b[0mplain",
+		},
+		{
+			Message{{Props: Properties{EnableList: EMPropColors | EMPropItalic, Foreground: PaletteColor(4), Background: RGBColor(0x010203)}, Text: "c"}},
+			"\x1b[0;3;38;2;255;0;0;48;2;1;2;3mc\x1b[0m",
+		},
+		{
+			Message{{Props: Properties{EnableList: EMPropSpoiler | EMPropForeground, Foreground: PaletteColor(4)}, Text: "s"}},
+			"\x1b[0;30;40ms\x1b[0m",
+		},
+		{PlaintextToMessage("a\x1b]0;title\x07b\tc\nd\u009b"), "a]0;titleb\tc\nd"},
+		{Message{{Props: ResetProperties, Text: "x", Kind: NodeLink, Target: "https://example.com/\x1b\\"}}, "x"},
+		{Message{{Props: ResetProperties, Text: "x", Kind: NodeLink, Target: "javascript:alert(1)"}}, "x"},
+	}
+
+	for nTest, test := range tests {
+		if got := MessageToANSI(test.message); got != test.expected {
+			t.Errorf("(test %d) Bad ANSI: expected %q, got %q", nTest, test.expected, got)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package message
+
+//Builder composes messages node by node, every node is created with the style that is current when it's added
+//
+//	msg := message.NewBuilder().
+//		Text("see ").
+//		Link("the docs", "https://example.com").
+//		Push(message.EMPropBold).Text(" now").Pop().
+//		Build()
+type Builder struct {
+	msg   Message
+	style Style
+	stack []Style
+}
+
+func NewBuilder() *Builder {
+	return &Builder{
+		msg:   make(Message, 0),
+		stack: make([]Style, 0),
+	}
+}
+
+func (b *Builder) add(props PropertyList, fg, bg Color, text string, kind NodeKind, target string) *Builder {
+	style := b.style
+	style.Props |= props
+	if fg.IsSet() {
+		style.Foreground = fg
+		style.Props |= EMPropForeground
+	}
+	if bg.IsSet() {
+		style.Background = bg
+		style.Props |= EMPropBackground
+	}
+
+	b.msg = append(b.msg, MessageNode{
+		Props: Properties{
+			EnableList:  style.Props,
+			InheritList: 0,
+			Foreground:  style.Foreground,
+			Background:  style.Background,
+		},
+		Text:   text,
+		Kind:   kind,
+		Target: target,
+	})
+
+	return b
+}
+
+//Push adds properties to the current style until the matching Pop
+func (b *Builder) Push(props PropertyList) *Builder {
+	b.stack = append(b.stack, b.style)
+	b.style.Props |= props &^ EMPropColors
+	return b
+}
+
+//PushColor sets the colours of the current style until the matching Pop, NoColor leaves a colour as it is
+func (b *Builder) PushColor(fg, bg Color) *Builder {
+	b.stack = append(b.stack, b.style)
+	if fg.IsSet() {
+		b.style.Foreground = fg
+		b.style.Props |= EMPropForeground
+	}
+	if bg.IsSet() {
+		b.style.Background = bg
+		b.style.Props |= EMPropBackground
+	}
+	return b
+}
+
+//Pop restores the style from before the last Push or PushColor
+func (b *Builder) Pop() *Builder {
+	if len(b.stack) == 0 {
+		return b
+	}
+
+	b.style = b.stack[len(b.stack)-1]
+	b.stack = b.stack[:len(b.stack)-1]
+	return b
+}
+
+func (b *Builder) Text(text string) *Builder {
+	return b.add(0, NoColor, NoColor, text, NodeText, "")
+}
+
+//Styled adds text with properties on top of the current style
+func (b *Builder) Styled(props PropertyList, text string) *Builder {
+	return b.add(props&^EMPropColors, NoColor, NoColor, text, NodeText, "")
+}
+
+func (b *Builder) Bold(text string) *Builder          { return b.Styled(EMPropBold, text) }
+func (b *Builder) Italic(text string) *Builder        { return b.Styled(EMPropItalic, text) }
+func (b *Builder) Underline(text string) *Builder     { return b.Styled(EMPropUnderline, text) }
+func (b *Builder) StrikeThrough(text string) *Builder { return b.Styled(EMPropStrikeThrough, text) }
+func (b *Builder) Monospace(text string) *Builder     { return b.Styled(EMPropMonospace, text) }
+func (b *Builder) Spoiler(text string) *Builder       { return b.Styled(EMPropSpoiler, text) }
+
+//Colored adds text with colours on top of the current style, NoColor keeps the current colour
+func (b *Builder) Colored(fg, bg Color, text string) *Builder {
+	return b.add(0, fg, bg, text, NodeText, "")
+}
+
+//Link adds a link to url displayed as text, an empty text displays the url
+//URLs that aren't safe according to IsSafeLink are added as plain text
+func (b *Builder) Link(text, url string) *Builder {
+	if len(text) == 0 {
+		text = url
+	}
+	if !IsSafeLink(url) {
+		return b.Text(text)
+	}
+	return b.add(0, NoColor, NoColor, text, NodeLink, url)
+}
+
+//Mention adds a mention of the user with the platform identity, displayed as text
+func (b *Builder) Mention(text, identity string) *Builder {
+	return b.add(0, NoColor, NoColor, text, NodeMention, identity)
+}
+
+//CodeBlock adds preformatted text that is displayed on its own lines, language may be empty
+func (b *Builder) CodeBlock(code, language string) *Builder {
+	b.msg = append(b.msg, MessageNode{
+		Props:  ResetProperties,
+		Text:   code,
+		Kind:   NodeCodeBlock,
+		Target: language,
+	})
+	return b
+}
+
+//Append adds the nodes of another message on top of the current style
+func (b *Builder) Append(msg Message) *Builder {
+	for _, node := range msg.Flatten() {
+		b.add(node.Props.EnableList&^EMPropColors, node.Props.Foreground, node.Props.Background, node.Text, node.Kind, node.Target)
+	}
+	return b
+}
+
+//Build returns the message built so far, the builder can still be used afterwards
+func (b *Builder) Build() Message {
+	msg := make(Message, len(b.msg))
+	copy(msg, b.msg)
+	return msg
+}
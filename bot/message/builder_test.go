@@ -0,0 +1,110 @@
+package message
+
+import (
+	"testing"
+)
+
+func TestBuilder(t *testing.T) {
+	got := NewBuilder().
+		Text("a").
+		Push(EMPropBold).
+		Italic("b").
+		PushColor(PaletteColor(4), NoColor).
+		Text("c").
+		Pop().
+		Pop().
+		Link("", "https://example.com").
+		Link("", "javascript:alert(1)").
+		Mention("nick", "IRC:net:nick!user@host").
+		CodeBlock("code", "go").
+		Append(Message{{Props: Properties{EnableList: EMPropUnderline}, Text: "d"}}).
+		Build()
+
+	expected := Message{
+		{Props: ResetProperties, Text: "a"},
+		{Props: props(EMPropBold | EMPropItalic), Text: "b"},
+		{Props: Properties{EnableList: EMPropBold | EMPropForeground, Foreground: PaletteColor(4)}, Text: "c"},
+		{Props: ResetProperties, Text: "https://example.com", Kind: NodeLink, Target: "https://example.com"},
+		{Props: ResetProperties, Text: "javascript:alert(1)"},
+		{Props: ResetProperties, Text: "nick", Kind: NodeMention, Target: "IRC:net:nick!user@host"},
+		{Props: ResetProperties, Text: "code", Kind: NodeCodeBlock, Target: "go"},
+		{Props: props(EMPropUnderline), Text: "d"},
+	}
+
+	if !got.StrictlyEquals(expected) {
+		t.Errorf("Bad message: expected %#v, got %#v", expected, got)
+	}
+}
+
+func TestIsSafeLink(t *testing.T) {
+	tests := []struct {
+		target   string
+		expected bool
+	}{
+		{"https://example.com/a b", true},
+		{"HTTP://example.com", true},
+		{"mailto:someone@example.com", true},
+		{"irc://irc.libera.chat/#chan", true},
+		{"javascript:alert(1)", false},
+		{"JaVaScRiPt:alert(1)", false},
+		{" javascript:alert(1)", false},
+		{"data:text/html,<script>", false},
+		{"https://example.com/\x1b]8;;", false},
+		{"//example.com", false},
+		{"", false},
+	}
+
+	for nTest, test := range tests {
+		if got := IsSafeLink(test.target); got != test.expected {
+			t.Errorf("(test %d) Bad result for %q: expected %v, got %v", nTest, test.target, test.expected, got)
+		}
+	}
+}
+
+var annotatedMessage = NewBuilder().
+	Text("see ").
+	Push(EMPropBold).Link("docs", "https://example.com/a b").Pop().
+	Text(", ").
+	Link("", "https://example.com").
+	Text(" ").
+	Mention("nick", "IRC:net:nick!user@host").
+	CodeBlock("x := `a`\n", "go").
+	Text("done").
+	Build()
+
+func TestAnnotatedNodes_Render(t *testing.T) {
+	tests := []struct {
+		name     string
+		got      string
+		expected string
+	}{
+		{"IRC", MessageToIRC(annotatedMessage), "see \x02docs (https://example.com/a b)\x02, https://example.com nick\n\x11x := `a`\n\x11done"},
+		{"markdown", annotatedMessage.ToMarkdown(), "see **[docs](https://example.com/a%20b)**, <https://example.com> nick\n```go\nx := `a`\n```\ndone"},
+		{"HTML", annotatedMessage.ToHTML(), `see <strong><a href="https://example.com/a b">docs</a></strong>, <a href="https://example.com">https://example.com</a> <span class="mention" data-identity="IRC:net:nick!user@host">nick</span>` + "\n<pre><code class=\"language-go\">x := `a`</code></pre>\ndone"},
+		{"ANSI", MessageToANSI(annotatedMessage), "see \x1b[0;1m\x1b]8;;https://example.com/a b\x1b\\docs\x1b]8;;\x1b\\\x1b[0m, \x1b]8;;https://example.com\x1b\\https://example.com\x1b]8;;\x1b\\ \x1b[0;7mnick\x1b[0m\nx := `a`\ndone"},
+	}
+
+	for _, test := range tests {
+		if test.got != test.expected {
+			t.Errorf("(%s) Bad render: expected %q, got %q", test.name, test.expected, test.got)
+		}
+	}
+}
+
+func TestAnnotatedNodes_RoundTrip(t *testing.T) {
+	rendered := annotatedMessage.ToMarkdown()
+	parsed := FromMarkdown(rendered)
+
+	if got := parsed.ToMarkdown(); got != rendered {
+		t.Errorf("Bad markdown round trip: expected %q, got %q", rendered, got)
+	}
+
+	if links := parsed.Links(); len(links) != 2 || links[0] != "https://example.com/a%20b" || links[1] != "https://example.com" {
+		t.Errorf("Bad links after markdown round trip: %v", links)
+	}
+
+	encoded := annotatedMessage.Encode()
+	if got, err := FromIntermediate(encoded); err != nil || !got.StrictlyEquals(annotatedMessage) {
+		t.Errorf("Bad encoding round trip of %s: %#v, %v", encoded, got, err)
+	}
+}
@@ -0,0 +1,94 @@
+package message
+
+import "fmt"
+
+type ColorKind uint8
+
+const (
+	ColorNone    ColorKind = iota
+	ColorPalette ColorKind = iota
+	ColorRGB     ColorKind = iota
+)
+
+//Color is either an index to IRCPalette or a 24-bit RGB colour
+type Color struct {
+	Kind ColorKind
+	//Value is the palette index for ColorPalette and 0xRRGGBB for ColorRGB
+	Value uint32
+}
+
+var (
+	NoColor = Color{Kind: ColorNone, Value: 0}
+
+	//IRCPalette holds the RGB values of the 99 IRC colours
+	IRCPalette = [99]uint32{
+		0xffffff, 0x000000, 0x00007f, 0x009300, 0xff0000, 0x7f0000, 0x9c009c, 0xfc7f00,
+		0xffff00, 0x00fc00, 0x009393, 0x00ffff, 0x0000fc, 0xff00ff, 0x7f7f7f, 0xd2d2d2,
+		0x470000, 0x472100, 0x474700, 0x324700, 0x004700, 0x00472c, 0x004747, 0x002747, 0x000047, 0x2e0047, 0x470047, 0x47002a,
+		0x740000, 0x743a00, 0x747400, 0x517400, 0x007400, 0x007449, 0x007474, 0x004074, 0x000074, 0x4b0074, 0x740074, 0x740045,
+		0xb50000, 0xb56300, 0xb5b500, 0x7db500, 0x00b500, 0x00b571, 0x00b5b5, 0x0063b5, 0x0000b5, 0x7500b5, 0xb500b5, 0xb5006b,
+		0xff0000, 0xff8c00, 0xffff00, 0xb2ff00, 0x00ff00, 0x00ffa0, 0x00ffff, 0x008cff, 0x0000ff, 0xa500ff, 0xff00ff, 0xff0098,
+		0xff5959, 0xffb459, 0xffff71, 0xcfff60, 0x6fff6f, 0x65ffc9, 0x6dffff, 0x59b4ff, 0x5959ff, 0xc459ff, 0xff66ff, 0xff59bc,
+		0xff9c9c, 0xffd39c, 0xffff9c, 0xe2ff9c, 0x9cff9c, 0x9cffdb, 0x9cffff, 0x9cd3ff, 0x9c9cff, 0xdc9cff, 0xff9cff, 0xff94d3,
+		0x000000, 0x131313, 0x282828, 0x363636, 0x4d4d4d, 0x656565, 0x818181, 0x9f9f9f, 0xbcbcbc, 0xe2e2e2, 0xffffff,
+	}
+)
+
+func PaletteColor(index uint8) Color {
+	return Color{Kind: ColorPalette, Value: uint32(index)}
+}
+
+func RGBColor(rgb uint32) Color {
+	return Color{Kind: ColorRGB, Value: rgb & 0xffffff}
+}
+
+func (color Color) IsSet() bool {
+	return color.Kind != ColorNone
+}
+
+//NearestPaletteColor returns the index of the colour of IRCPalette closest to the 0xRRGGBB value
+func NearestPaletteColor(rgb uint32) uint8 {
+	Distance := func(a, b uint32) int {
+		distance := 0
+		for shift := 0; shift < 24; shift += 8 {
+			d := int(a>>shift&0xff) - int(b>>shift&0xff)
+			distance += d * d
+		}
+		return distance
+	}
+
+	nearest := 0
+	for i, color := range IRCPalette {
+		if Distance(color, rgb) < Distance(IRCPalette[nearest], rgb) {
+			nearest = i
+		}
+	}
+	return uint8(nearest)
+}
+
+//RGB returns the 0xRRGGBB value of the colour, palette colours outside of IRCPalette (i.e. 99, the default colour) are returned as black
+func (color Color) RGB() uint32 {
+	switch color.Kind {
+	case ColorPalette:
+		if int(color.Value) < len(IRCPalette) {
+			return IRCPalette[color.Value]
+		}
+		return 0
+	case ColorRGB:
+		return color.Value
+	default:
+		return 0
+	}
+}
+
+func (color Color) String() string {
+	switch color.Kind {
+	case ColorPalette:
+		return fmt.Sprintf("%02d", color.Value)
+	case ColorRGB:
+		return fmt.Sprintf("#%06x", color.Value)
+	default:
+		return "none"
+	}
+}
+
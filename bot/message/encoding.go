@@ -0,0 +1,220 @@
+package message
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	//EncodingVersion is the version written by Encode, Decode accepts every version up to this one
+	//Version 2 added the kind and target of annotated nodes, version 1 messages only have plain text nodes
+	EncodingVersion = 2
+)
+
+var (
+	propertyNames = map[PropertyList]string{
+		EMPropBold:          "bold",
+		EMPropItalic:        "italic",
+		EMPropUnderline:     "underline",
+		EMPropStrikeThrough: "strikethrough",
+		EMPropMonospace:     "monospace",
+		EMPropSpoiler:       "spoiler",
+		EMPropForeground:    "foreground",
+		EMPropBackground:    "background",
+	}
+
+	//allPropertiesName is a shorthand for every property, used for the common case of inheriting everything
+	allPropertiesName = "all"
+	allProperties     = PropertyList(EMPropAll | EMPropColors)
+)
+
+//encodedMessage is the versioned form of a message, see Encode
+type encodedMessage struct {
+	Version int           `json:"version"`
+	Nodes   []encodedNode `json:"nodes"`
+}
+
+type encodedNode struct {
+	//Kind is the name of the NodeKind of annotated nodes, empty for plain text
+	Kind    string   `json:"kind,omitempty"`
+	Target  string   `json:"target,omitempty"`
+	Text    string   `json:"text"`
+	Enable  []string `json:"enable,omitempty"`
+	Inherit []string `json:"inherit,omitempty"`
+	Fg      string   `json:"fg,omitempty"`
+	Bg      string   `json:"bg,omitempty"`
+}
+
+func encodePropertyList(list PropertyList) []string {
+	if list == allProperties {
+		return []string{allPropertiesName}
+	}
+
+	names := make([]string, 0)
+	for prop, name := range propertyNames {
+		if list&prop != 0 {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+func decodePropertyList(names []string) (PropertyList, error) {
+	list := PropertyList(0)
+
+	for _, name := range names {
+		if name == allPropertiesName {
+			list |= allProperties
+			continue
+		}
+
+		found := false
+		for prop, propName := range propertyNames {
+			if name == propName {
+				list |= prop
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return 0, fmt.Errorf("unknown property %q", name)
+		}
+	}
+
+	return list, nil
+}
+
+func encodeColor(color Color) string {
+	if !color.IsSet() {
+		return ""
+	}
+	return color.String()
+}
+
+//decodeColor parses colours as written by Color.String, "04" for palette colours and "#ff0000" for RGB colours
+func decodeColor(str string) (Color, error) {
+	if len(str) == 0 {
+		return NoColor, nil
+	}
+
+	if strings.HasPrefix(str, "#") {
+		rgb, err := strconv.ParseUint(str[1:], 16, 32)
+		if err != nil || len(str) != 7 {
+			return NoColor, fmt.Errorf("bad RGB colour %q", str)
+		}
+		return RGBColor(uint32(rgb)), nil
+	}
+
+	index, err := strconv.ParseUint(str, 10, 8)
+	if err != nil {
+		return NoColor, fmt.Errorf("bad palette colour %q", str)
+	}
+	return PaletteColor(uint8(index)), nil
+}
+
+//Encode translates a message to a versioned, self-describing JSON form to later store as a string
+func (msg Message) Encode() string {
+	encoded := encodedMessage{
+		Version: EncodingVersion,
+		Nodes:   make([]encodedNode, 0, len(msg)),
+	}
+
+	for _, node := range msg {
+		encodedNode := encodedNode{
+			Kind:    nodeKindNames[node.Kind],
+			Target:  node.Target,
+			Text:    node.Text,
+			Enable:  encodePropertyList(node.Props.EnableList),
+			Inherit: encodePropertyList(node.Props.InheritList),
+		}
+
+		if node.Props.EnableList&EMPropForeground != 0 {
+			encodedNode.Fg = encodeColor(node.Props.Foreground)
+		}
+		if node.Props.EnableList&EMPropBackground != 0 {
+			encodedNode.Bg = encodeColor(node.Props.Background)
+		}
+
+		encoded.Nodes = append(encoded.Nodes, encodedNode)
+	}
+
+	//marshalling these types can't fail
+	b, _ := json.Marshal(encoded)
+	return string(b)
+}
+
+//MarshalJSON embeds the versioned form of the message, so that structs holding messages can be serialised
+func (msg Message) MarshalJSON() ([]byte, error) {
+	return []byte(msg.Encode()), nil
+}
+
+func (msg *Message) UnmarshalJSON(data []byte) error {
+	if string(data) == "null" {
+		*msg = nil
+		return nil
+	}
+
+	decoded, err := decode(string(data))
+	if err != nil {
+		return err
+	}
+
+	*msg = decoded
+	return nil
+}
+
+//IsEncoded returns whether the string is in the versioned form written by Encode rather than the legacy intermediate form
+func IsEncoded(str string) bool {
+	return strings.HasPrefix(strings.TrimSpace(str), "{")
+}
+
+func decode(str string) (Message, error) {
+	encoded := encodedMessage{}
+	if err := json.Unmarshal([]byte(str), &encoded); err != nil {
+		return nil, err
+	}
+
+	if encoded.Version < 1 {
+		return nil, errors.New("encoded message has no version")
+	}
+
+	if encoded.Version > EncodingVersion {
+		return nil, fmt.Errorf("encoded message has version %d, newer than the supported version %d", encoded.Version, EncodingVersion)
+	}
+
+	msg := make(Message, 0, len(encoded.Nodes))
+
+	for _, encodedNode := range encoded.Nodes {
+		kind, ok := nodeKindFromName(encodedNode.Kind)
+		if !ok {
+			return nil, fmt.Errorf("unknown node kind %q", encodedNode.Kind)
+		}
+
+		node := MessageNode{Text: encodedNode.Text, Kind: kind, Target: encodedNode.Target}
+
+		var err error
+		if node.Props.EnableList, err = decodePropertyList(encodedNode.Enable); err != nil {
+			return nil, err
+		}
+		if node.Props.InheritList, err = decodePropertyList(encodedNode.Inherit); err != nil {
+			return nil, err
+		}
+		if node.Props.Foreground, err = decodeColor(encodedNode.Fg); err != nil {
+			return nil, err
+		}
+		if node.Props.Background, err = decodeColor(encodedNode.Bg); err != nil {
+			return nil, err
+		}
+
+		msg = append(msg, node)
+	}
+
+	return msg, nil
+}
@@ -0,0 +1,92 @@
+package message
+
+import (
+	"fmt"
+	"html"
+	"strings"
+)
+
+var htmlTags = []struct {
+	prop PropertyList
+	open string
+	tag  string
+}{
+	{EMPropSpoiler, `<span class="spoiler">`, "span"},
+	{EMPropBold, "<strong>", "strong"},
+	{EMPropUnderline, "<u>", "u"},
+	{EMPropItalic, "<em>", "em"},
+	{EMPropStrikeThrough, "<s>", "s"},
+	{EMPropMonospace, "<code>", "code"},
+}
+
+var htmlWriter = spanWriter{
+	mask: EMPropAll | EMPropColors,
+
+	spans: func(style Style) []span {
+		spans := make([]span, 0)
+		if style.Props&EMPropForeground != 0 {
+			spans = append(spans, span{prop: EMPropForeground, color: style.Foreground})
+		}
+		if style.Props&EMPropBackground != 0 {
+			spans = append(spans, span{prop: EMPropBackground, color: style.Background})
+		}
+		for _, v := range htmlTags {
+			if style.Props&v.prop != 0 {
+				spans = append(spans, span{prop: v.prop})
+			}
+		}
+		return spans
+	},
+
+	innermost: func(s span) bool {
+		return false
+	},
+
+	open: func(s span, text string) (string, string) {
+		switch s.prop {
+		case EMPropForeground:
+			return fmt.Sprintf(`<span style="color: #%06x">`, s.color.RGB()), "</span>"
+		case EMPropBackground:
+			return fmt.Sprintf(`<span style="background-color: #%06x">`, s.color.RGB()), "</span>"
+		}
+
+		for _, v := range htmlTags {
+			if v.prop == s.prop {
+				return v.open, "</" + v.tag + ">"
+			}
+		}
+
+		return "", ""
+	},
+
+	text: func(text string, spans []span) string {
+		return strings.ReplaceAll(html.EscapeString(text), "\n", "<br>")
+	},
+
+	annotate: func(node MessageNode, rendered string) string {
+		switch node.Kind {
+		case NodeLink:
+			if !IsSafeLink(node.Target) {
+				return rendered
+			}
+			return fmt.Sprintf(`<a href="%s">%s</a>`, html.EscapeString(node.Target), rendered)
+		case NodeMention:
+			return fmt.Sprintf(`<span class="mention" data-identity="%s">%s</span>`, html.EscapeString(node.Target), rendered)
+		}
+		return rendered
+	},
+
+	block: func(node MessageNode) string {
+		class := ""
+		if len(node.Target) != 0 {
+			class = fmt.Sprintf(` class="language-%s"`, html.EscapeString(node.Target))
+		}
+		return fmt.Sprintf("<pre><code%s>%s</code></pre>", class, html.EscapeString(strings.TrimSuffix(node.Text, "\n")))
+	},
+}
+
+//ToHTML renders the message as an HTML fragment, spoilers are rendered as spans with the "spoiler" class and mentions
+//as spans with the "mention" class and the identity in the data-identity attribute
+func (msg Message) ToHTML() string {
+	return htmlWriter.render(msg)
+}
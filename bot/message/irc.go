@@ -0,0 +1,342 @@
+package message
+
+import (
+	"fmt"
+	"math/bits"
+	"strconv"
+	"strings"
+)
+
+const (
+	ircBold          = '\x02'
+	ircColor         = '\x03'
+	ircHexColor      = '\x04'
+	ircReset         = '\x0F'
+	ircMonospace     = '\x11'
+	ircReverse       = '\x16'
+	ircItalic        = '\x1D'
+	ircStrikeThrough = '\x1E'
+	ircUnderline     = '\x1F'
+
+	//IRCSpoilerColor is the colour used for both the foreground and the background of spoilers since IRC has no spoilers
+	IRCSpoilerColor = "01"
+
+	//ircDefaultColor is the palette index that stands for the default colour of the client
+	ircDefaultColor = 99
+)
+
+type ircToggle struct {
+	code byte
+	prop PropertyList
+}
+
+//ircToggles lists the IRC formatting codes that map to a property, in the order they are emitted in
+var ircToggles = []ircToggle{
+	{ircBold, EMPropBold},
+	{ircItalic, EMPropItalic},
+	{ircUnderline, EMPropUnderline},
+	{ircStrikeThrough, EMPropStrikeThrough},
+	{ircMonospace, EMPropMonospace},
+}
+
+//ircToggleProps are the properties that have a toggle code on IRC
+const ircToggleProps = EMPropBold | EMPropItalic | EMPropUnderline | EMPropStrikeThrough | EMPropMonospace
+
+func isASCIIDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isASCIIHexDigit(c byte) bool {
+	return isASCIIDigit(c) || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
+
+//parseIRCColor returns the foreground and the background of a colour code (0x03 or 0x04) at the start of str along with the length of the code
+func parseIRCColor(str string) (string, string, int) {
+	maxDigits, pred := 2, isASCIIDigit
+	if str[0] == ircHexColor {
+		maxDigits, pred = 6, isASCIIHexDigit
+	}
+
+	CountDigits := func(start int) int {
+		n := 0
+		for start+n < len(str) && n < maxDigits && pred(str[start+n]) {
+			n++
+		}
+		return n
+	}
+
+	n := 1
+	fgLen := CountDigits(n)
+	fg := str[n : n+fgLen]
+	n += fgLen
+
+	bg := ""
+	if fgLen != 0 && n < len(str) && str[n] == ',' {
+		if bgLen := CountDigits(n + 1); bgLen != 0 {
+			bg = str[n+1 : n+1+bgLen]
+			n += 1 + bgLen
+		}
+	}
+
+	return fg, bg, n
+}
+
+//ircColorFromCode converts the digits of a colour code to a colour, the default colour (99) and malformed hex colours become NoColor
+func ircColorFromCode(code byte, digits string) Color {
+	if code == ircHexColor {
+		if len(digits) != 6 {
+			return NoColor
+		}
+		rgb, _ := strconv.ParseUint(digits, 16, 32)
+		return RGBColor(uint32(rgb))
+	}
+
+	index, _ := strconv.Atoi(digits)
+	if index >= ircDefaultColor {
+		return NoColor
+	}
+	return PaletteColor(uint8(index))
+}
+
+//IRCToMessage parses text with IRC formatting codes into a message.
+//A palette colour code with the same foreground and background starts a spoiler which lasts until the colours are reset.
+func IRCToMessage(str string) Message {
+	msg := make(Message, 0)
+
+	current := Style{}
+	currentText := strings.Builder{}
+
+	TryAppend := func() {
+		if currentText.Len() > 0 {
+			msg = append(msg, MessageNode{
+				Props: Properties{
+					EnableList:  current.Props,
+					InheritList: 0,
+					Foreground:  current.Foreground,
+					Background:  current.Background,
+				},
+				Text: currentText.String(),
+			})
+			currentText.Reset()
+		}
+	}
+
+	SetStyle := func(style Style) {
+		style.Props &^= EMPropColors
+		if style.Foreground.IsSet() {
+			style.Props |= EMPropForeground
+		}
+		if style.Background.IsSet() {
+			style.Props |= EMPropBackground
+		}
+
+		if style != current {
+			TryAppend()
+			current = style
+		}
+	}
+
+	for i := 0; i < len(str); {
+		c := str[i]
+		style := current
+
+		switch c {
+		case ircBold, ircItalic, ircUnderline, ircStrikeThrough, ircMonospace:
+			for _, v := range ircToggles {
+				if v.code == c {
+					style.Props ^= v.prop
+				}
+			}
+			SetStyle(style)
+			i++
+
+		case ircReset:
+			SetStyle(Style{})
+			i++
+
+		case ircColor, ircHexColor:
+			fg, bg, n := parseIRCColor(str[i:])
+			i += n
+
+			if len(fg) == 0 {
+				style.Props &^= EMPropSpoiler
+				style.Foreground, style.Background = NoColor, NoColor
+			} else if c == ircColor && len(bg) != 0 && strings.TrimLeft(fg, "0") == strings.TrimLeft(bg, "0") {
+				style.Props |= EMPropSpoiler
+			} else {
+				style.Foreground = ircColorFromCode(c, fg)
+				if len(bg) != 0 {
+					style.Background = ircColorFromCode(c, bg)
+				}
+			}
+
+			SetStyle(style)
+
+		case ircReverse:
+			i++
+
+		default:
+			currentText.WriteByte(c)
+			i++
+		}
+	}
+
+	TryAppend()
+
+	return msg
+}
+
+//ircColors returns the colours to display a style with, spoilers hide the text with the same foreground and background colours
+func ircColors(style Style) (Color, Color) {
+	if style.Props&EMPropSpoiler != 0 {
+		spoiler, _ := strconv.Atoi(IRCSpoilerColor)
+		return PaletteColor(uint8(spoiler)), PaletteColor(uint8(spoiler))
+	}
+
+	return style.Foreground, style.Background
+}
+
+//ircColorCode renders a colour code, palette colours are used if possible and RGB colours otherwise
+//RGB codes always set the foreground, so an RGB background behind the default foreground is approximated by the palette
+func ircColorCode(fg, bg Color) string {
+	if bg.Kind == ColorRGB && fg.Kind != ColorRGB && (!fg.IsSet() || int(fg.Value) >= len(IRCPalette)) {
+		bg = PaletteColor(NearestPaletteColor(bg.Value))
+	}
+
+	if fg.Kind != ColorRGB && bg.Kind != ColorRGB {
+		fgIndex := uint32(ircDefaultColor)
+		if fg.IsSet() {
+			fgIndex = fg.Value
+		}
+
+		if bg.IsSet() {
+			return fmt.Sprintf("%c%02d,%02d", ircColor, fgIndex, bg.Value)
+		}
+		return fmt.Sprintf("%c%02d", ircColor, fgIndex)
+	}
+
+	if bg.IsSet() {
+		return fmt.Sprintf("%c%06X,%06X", ircHexColor, fg.RGB(), bg.RGB())
+	}
+	return fmt.Sprintf("%c%06X", ircHexColor, fg.RGB())
+}
+
+//ircColorTransition returns the codes that change the colours from one pair to another
+func ircColorTransition(fromFg, fromBg, toFg, toBg Color) string {
+	if fromFg == toFg && fromBg == toBg {
+		return ""
+	}
+
+	if !toFg.IsSet() && !toBg.IsSet() {
+		return string(rune(ircColor))
+	}
+
+	//there is no way to unset only the background
+	prefix := ""
+	if fromBg.IsSet() && !toBg.IsSet() {
+		prefix = string(rune(ircColor))
+	}
+
+	return prefix + ircColorCode(toFg, toBg)
+}
+
+//ircTransition returns the shortest sequence of formatting codes that changes the formatting from one style to another
+func ircTransition(from, to Style) string {
+	Transition := func(from, to Style) string {
+		builder := strings.Builder{}
+
+		diff := (from.Props ^ to.Props) & ircToggleProps
+		for _, v := range ircToggles {
+			if diff&v.prop != 0 {
+				builder.WriteByte(v.code)
+			}
+		}
+
+		fromFg, fromBg := ircColors(from)
+		toFg, toBg := ircColors(to)
+		builder.WriteString(ircColorTransition(fromFg, fromBg, toFg, toBg))
+
+		return builder.String()
+	}
+
+	transition := Transition(from, to)
+
+	//turning off a lot of properties is cheaper with a reset
+	turnedOff := from.Props &^ to.Props & (ircToggleProps | EMPropSpoiler | EMPropColors)
+	if bits.OnesCount32(uint32(turnedOff)) > 1 {
+		if withReset := string(rune(ircReset)) + Transition(Style{}, to); len(withReset) < len(transition) {
+			return withReset
+		}
+	}
+
+	return transition
+}
+
+//endsWithColorCode returns whether a transition ends with a colour code that text starting with a digit or a comma would extend
+func endsWithColorCode(transition string) bool {
+	idx := strings.LastIndexAny(transition, string([]rune{ircColor, ircHexColor}))
+	if idx == -1 {
+		return false
+	}
+
+	for _, c := range []byte(transition[idx+1:]) {
+		if !isASCIIHexDigit(c) && c != ',' {
+			return false
+		}
+	}
+
+	return true
+}
+
+//MessageToIRC renders a message as text with IRC formatting codes, emitting the fewest codes needed to switch between nodes
+//Links are rendered as their text followed by the URL if they differ, code blocks are put on their own lines in monospace
+func MessageToIRC(msg Message) string {
+	builder := strings.Builder{}
+	emitted := Style{}
+	afterBlock := false
+
+	StartLine := func() {
+		if builder.Len() != 0 && !strings.HasSuffix(builder.String(), "\n") {
+			builder.WriteByte('\n')
+		}
+	}
+
+	msg.walkNodes(func(node MessageNode, current, last Style) {
+		text := node.Text
+		if len(text) == 0 {
+			return
+		}
+
+		switch node.Kind {
+		case NodeLink:
+			if node.Target != text && len(node.Target) != 0 {
+				text += " (" + node.Target + ")"
+			}
+		case NodeCodeBlock:
+			current.Props |= EMPropMonospace
+			StartLine()
+			text = strings.TrimSuffix(text, "\n")
+			if len(text) == 0 {
+				return
+			}
+		}
+
+		if afterBlock && text[0] != '\n' {
+			StartLine()
+		}
+		afterBlock = node.Kind == NodeCodeBlock
+
+		transition := ircTransition(emitted, current)
+		emitted = current
+		builder.WriteString(transition)
+
+		//a digit or a comma following a colour code would be read as a part of it, an empty bold toggle separates them
+		if endsWithColorCode(transition) && (isASCIIDigit(text[0]) || text[0] == ',') {
+			builder.WriteString(string(rune(ircBold)) + string(rune(ircBold)))
+		}
+
+		builder.WriteString(text)
+	})
+
+	return builder.String()
+}
@@ -0,0 +1,149 @@
+package message
+
+import (
+	"testing"
+)
+
+type ircRenderTest struct {
+	message  Message
+	expected string
+}
+
+var ircRenderTests = []ircRenderTest{
+	{
+		message:  PlaintextToMessage("plain"),
+		expected: "plain",
+	},
+	{
+		message:  testMessages[0],
+		expected: "\x02testing\x1D123",
+	},
+	{
+		message: Message{
+			MessageNode{Props: Properties{EnableList: EMPropBold | EMPropItalic | EMPropUnderline, InheritList: 0}, Text: "a"},
+			MessageNode{Props: Properties{EnableList: EMPropUnderline, InheritList: 0}, Text: "b"},
+			MessageNode{Props: ResetProperties, Text: "c"},
+		},
+		expected: "\x02\x1D\x1Fa\x02\x1Db\x1Fc",
+	},
+	{
+		message: Message{
+			MessageNode{Props: Properties{EnableList: EMPropBold | EMPropItalic | EMPropUnderline, InheritList: 0}, Text: "a"},
+			MessageNode{Props: Properties{EnableList: EMPropMonospace, InheritList: 0}, Text: "b"},
+		},
+		expected: "\x02\x1D\x1Fa\x0F\x11b",
+	},
+	{
+		message: Message{
+			MessageNode{Props: Properties{EnableList: EMPropBold, InheritList: 0}, Text: "x"},
+			MessageNode{Props: Properties{EnableList: 0, InheritList: EMPropAll}, Text: ""},
+			MessageNode{Props: Properties{EnableList: 0, InheritList: EMPropAll}, Text: "y"},
+		},
+		expected: "\x02xy",
+	},
+	{
+		message: Message{
+			MessageNode{Props: ResetProperties, Text: "the answer is "},
+			MessageNode{Props: Properties{EnableList: EMPropSpoiler, InheritList: 0}, Text: "42"},
+			MessageNode{Props: ResetProperties, Text: "1 more"},
+		},
+		expected: "the answer is \x0301,01\x02\x0242\x03\x02\x021 more",
+	},
+	{
+		message: Message{
+			MessageNode{Props: Properties{EnableList: EMPropColors, Foreground: PaletteColor(4), Background: PaletteColor(1)}, Text: "red on black"},
+			MessageNode{Props: Properties{EnableList: EMPropBold, InheritList: EMPropForeground}, Text: " bold red"},
+			MessageNode{Props: Properties{EnableList: EMPropForeground, Foreground: RGBColor(0x00ff00)}, Text: " green"},
+			MessageNode{Props: Properties{EnableList: EMPropBackground, Background: PaletteColor(2)}, Text: " on blue"},
+		},
+		expected: "\x0304,01red on black\x02\x03\x0304 bold red\x02\x0400FF00 green\x0399,02 on blue",
+	},
+}
+
+type ircParseTest struct {
+	from     string
+	expected Message
+}
+
+var ircParseTests = []ircParseTest{
+	{
+		from:     "plain",
+		expected: PlaintextToMessage("plain"),
+	},
+	{
+		from: "\x02bold\x02 \x1Ditalic\x0F reset",
+		expected: Message{
+			MessageNode{Props: Properties{EnableList: EMPropBold}, Text: "bold"},
+			MessageNode{Props: ResetProperties, Text: " "},
+			MessageNode{Props: Properties{EnableList: EMPropItalic}, Text: "italic"},
+			MessageNode{Props: ResetProperties, Text: " reset"},
+		},
+	},
+	{
+		from: "\x0304red\x03 \x031,1spoiler\x03 \x04ff0000hex",
+		expected: Message{
+			MessageNode{Props: Properties{EnableList: EMPropForeground, Foreground: PaletteColor(4)}, Text: "red"},
+			MessageNode{Props: ResetProperties, Text: " "},
+			MessageNode{Props: Properties{EnableList: EMPropSpoiler}, Text: "spoiler"},
+			MessageNode{Props: ResetProperties, Text: " "},
+			MessageNode{Props: Properties{EnableList: EMPropForeground, Foreground: RGBColor(0xff0000)}, Text: "hex"},
+		},
+	},
+	{
+		from: "12,08blue on yellow4 red on yellow99 bold",
+		expected: Message{
+			MessageNode{Props: Properties{EnableList: EMPropColors, Foreground: PaletteColor(12), Background: PaletteColor(8)}, Text: "blue on yellow"},
+			MessageNode{Props: Properties{EnableList: EMPropColors, Foreground: PaletteColor(4), Background: PaletteColor(8)}, Text: " red on yellow"},
+			MessageNode{Props: Properties{EnableList: EMPropBold}, Text: "99 bold"},
+		},
+	},
+	{
+		from:     "ünïcödé \x11mono",
+		expected: Message{PlaintextToMessage("ünïcödé ")[0], MessageNode{Props: Properties{EnableList: EMPropMonospace}, Text: "mono"}},
+	},
+}
+
+func TestMessageToIRC(t *testing.T) {
+	for nTest, test := range ircRenderTests {
+		if str := MessageToIRC(test.message); str != test.expected {
+			t.Errorf("(test %d) Bad render: expected %q, got %q", nTest, test.expected, str)
+		}
+	}
+}
+
+//RGB codes can't leave the foreground as it is, so RGB backgrounds behind the default foreground are approximated
+func TestMessageToIRC_RGBBackground(t *testing.T) {
+	msg := Message{
+		MessageNode{Props: Properties{EnableList: EMPropBackground, Background: RGBColor(0x0000f0)}, Text: "on blue"},
+		MessageNode{Props: Properties{EnableList: EMPropColors, Foreground: PaletteColor(4), Background: RGBColor(0x0000f0)}, Text: " red"},
+		MessageNode{Props: Properties{EnableList: EMPropColors, Foreground: PaletteColor(99), Background: RGBColor(0xfefefe)}, Text: " on white"},
+	}
+
+	expected := "\x0399,12on blue\x04FF0000,0000F0 red\x0399,00 on white"
+	if str := MessageToIRC(msg); str != expected {
+		t.Errorf("Bad render: expected %q, got %q", expected, str)
+	}
+}
+
+func TestIRCToMessage(t *testing.T) {
+	for nTest, test := range ircParseTests {
+		if got := IRCToMessage(test.from); !got.VisiblyEquals(test.expected) {
+			t.Errorf("(test %d) Bad parse of %q: expected %#v, got %#v", nTest, test.from, test.expected, got)
+		}
+	}
+}
+
+func TestIRC_RoundTrip(t *testing.T) {
+	for nTest, test := range ircRenderTests {
+		if got := IRCToMessage(MessageToIRC(test.message)); !got.VisiblyEquals(test.message) {
+			t.Errorf("(test %d) Message did not survive a render and a parse: got %#v", nTest, got)
+		}
+	}
+
+	for nTest, test := range ircParseTests {
+		str := MessageToIRC(test.expected)
+		if got := MessageToIRC(IRCToMessage(str)); got != str {
+			t.Errorf("(test %d) Rendered text did not survive a parse and a render: expected %q, got %q", nTest, str, got)
+		}
+	}
+}
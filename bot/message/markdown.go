@@ -0,0 +1,502 @@
+package message
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+//markdownDelimiters maps properties to their markdown delimiters, underlines use the __ extension of chat platforms
+//and spoilers use the ||spoiler|| extension. Monospace text is rendered as code spans
+var markdownDelimiters = []struct {
+	prop      PropertyList
+	delimiter string
+}{
+	{EMPropSpoiler, "||"},
+	{EMPropBold, "**"},
+	{EMPropUnderline, "__"},
+	{EMPropItalic, "*"},
+	{EMPropStrikeThrough, "~~"},
+}
+
+//markdownEscaped are the characters escaped outside code spans
+const markdownEscaped = "\\`*_~|[]<>#"
+
+func markdownDelimiter(prop PropertyList) string {
+	for _, v := range markdownDelimiters {
+		if v.prop == prop {
+			return v.delimiter
+		}
+	}
+	return ""
+}
+
+func escapeMarkdown(text string) string {
+	builder := strings.Builder{}
+
+	for _, c := range text {
+		if strings.ContainsRune(markdownEscaped, c) {
+			builder.WriteByte('\\')
+		}
+		builder.WriteRune(c)
+	}
+
+	return builder.String()
+}
+
+//markdownFence returns a run of backticks longer than any in the text
+func markdownFence(text string) string {
+	longest, current := 0, 0
+	for _, c := range text {
+		if c == '`' {
+			current++
+			if current > longest {
+				longest = current
+			}
+		} else {
+			current = 0
+		}
+	}
+
+	return strings.Repeat("`", longest+1)
+}
+
+//markdownCodeFence returns the delimiters of a code span containing text
+func markdownCodeFence(text string) (string, string) {
+	fence := markdownFence(text)
+	if strings.HasPrefix(text, "`") || strings.HasSuffix(text, "`") {
+		return fence + " ", " " + fence
+	}
+
+	return fence, fence
+}
+
+var markdownWriter = spanWriter{
+	mask: EMPropAll,
+
+	spans: func(style Style) []span {
+		spans := make([]span, 0)
+		for _, v := range markdownDelimiters {
+			if style.Props&v.prop != 0 {
+				spans = append(spans, span{prop: v.prop})
+			}
+		}
+		if style.Props&EMPropMonospace != 0 {
+			spans = append(spans, span{prop: EMPropMonospace})
+		}
+		return spans
+	},
+
+	innermost: func(s span) bool {
+		return s.prop == EMPropMonospace
+	},
+
+	open: func(s span, text string) (string, string) {
+		if s.prop == EMPropMonospace {
+			return markdownCodeFence(text)
+		}
+		delimiter := markdownDelimiter(s.prop)
+		return delimiter, delimiter
+	},
+
+	text: func(text string, spans []span) string {
+		if containsSpan(spans, span{prop: EMPropMonospace}) {
+			return text
+		}
+		return escapeMarkdown(text)
+	},
+
+	annotate: func(node MessageNode, rendered string) string {
+		if node.Kind != NodeLink || !IsSafeLink(node.Target) {
+			return rendered
+		}
+		if node.Text == node.Target {
+			return "<" + markdownLinkTarget(node.Target) + ">"
+		}
+		return "[" + rendered + "](" + markdownLinkTarget(node.Target) + ")"
+	},
+
+	block: func(node MessageNode) string {
+		text := strings.TrimSuffix(node.Text, "\n")
+		fence := markdownFence(text)
+		if len(fence) < 3 {
+			fence = "```"
+		}
+		return fence + node.Target + "\n" + text + "\n" + fence
+	},
+
+	hoistSpaces: true,
+}
+
+//markdownLinkTarget escapes the characters that would end a link destination
+func markdownLinkTarget(target string) string {
+	return strings.NewReplacer(" ", "%20", "(", "%28", ")", "%29", "<", "%3C", ">", "%3E").Replace(target)
+}
+
+//ToMarkdown renders the message as markdown, colours are dropped and mentions are rendered as their text
+func (msg Message) ToMarkdown() string {
+	return markdownWriter.render(msg)
+}
+
+type markdownTokenKind int
+
+const (
+	markdownTokenText markdownTokenKind = iota
+	markdownTokenDelimiter
+	markdownTokenCode
+	markdownTokenLink
+	markdownTokenCodeBlock
+)
+
+//markdownToken is a piece of text, a code span or a run of delimiter characters like "***"
+type markdownToken struct {
+	kind markdownTokenKind
+	text string
+	//target is the URL of links and the language of code blocks
+	target string
+
+	//canOpen and canClose follow (a simplification of) the flanking rules of CommonMark
+	canOpen  bool
+	canClose bool
+}
+
+//markdownRunDelimiters lists the delimiters that runs of a character can contain, longest first
+var markdownRunDelimiters = map[byte][]struct {
+	length int
+	prop   PropertyList
+}{
+	'*': {{2, EMPropBold}, {1, EMPropItalic}},
+	'_': {{2, EMPropUnderline}, {1, EMPropItalic}},
+	'~': {{2, EMPropStrikeThrough}},
+	'|': {{2, EMPropSpoiler}},
+}
+
+func isMarkdownPunctuation(c rune) bool {
+	return c < utf8.RuneSelf && (unicode.IsPunct(c) || unicode.IsSymbol(c))
+}
+
+//tokenizeMarkdown splits markdown to text, delimiter run and code span tokens
+func tokenizeMarkdown(str string) []markdownToken {
+	tokens := make([]markdownToken, 0)
+
+	AppendText := func(text string) {
+		if last := len(tokens) - 1; last >= 0 && tokens[last].kind == markdownTokenText {
+			tokens[last].text += text
+			return
+		}
+		tokens = append(tokens, markdownToken{kind: markdownTokenText, text: text})
+	}
+
+	RuneBefore := func(i int) rune {
+		if i == 0 {
+			return ' '
+		}
+		r, _ := utf8.DecodeLastRuneInString(str[:i])
+		return r
+	}
+
+	RuneAfter := func(i int) rune {
+		if i >= len(str) {
+			return ' '
+		}
+		r, _ := utf8.DecodeRuneInString(str[i:])
+		return r
+	}
+
+	RunLength := func(i int) int {
+		n := 0
+		for i+n < len(str) && str[i+n] == str[i] {
+			n++
+		}
+		return n
+	}
+
+	for i := 0; i < len(str); {
+		c := str[i]
+
+		if c == '\\' && i+1 < len(str) && isMarkdownPunctuation(rune(str[i+1])) {
+			AppendText(str[i+1 : i+2])
+			i += 2
+			continue
+		}
+
+		if c == '`' && (i == 0 || str[i-1] == '\n') && RunLength(i) >= 3 {
+			if token, length, ok := parseMarkdownCodeBlock(str[i:]); ok {
+				tokens = append(tokens, token)
+				i += length
+				continue
+			}
+		}
+
+		if c == '[' || c == '<' {
+			if token, length, ok := parseMarkdownLink(str[i:]); ok {
+				tokens = append(tokens, token)
+				i += length
+				continue
+			}
+		}
+
+		if c == '`' {
+			n := RunLength(i)
+			fence := str[i : i+n]
+
+			//the closing run has to be exactly as long as the opening one
+			end := -1
+			for j := i + n; j < len(str); {
+				if str[j] != '`' {
+					j++
+					continue
+				}
+				if m := RunLength(j); m != n {
+					j += m
+					continue
+				}
+				end = j
+				break
+			}
+
+			if end == -1 {
+				AppendText(fence)
+				i += n
+				continue
+			}
+
+			code := str[i+n : end]
+			if len(code) >= 2 && code[0] == ' ' && code[len(code)-1] == ' ' && len(strings.Trim(code, " ")) != 0 {
+				code = code[1 : len(code)-1]
+			}
+			tokens = append(tokens, markdownToken{kind: markdownTokenCode, text: code})
+			i = end + n
+			continue
+		}
+
+		if _, ok := markdownRunDelimiters[c]; ok {
+			n := RunLength(i)
+			before, after := RuneBefore(i), RuneAfter(i+n)
+
+			token := markdownToken{
+				kind:     markdownTokenDelimiter,
+				text:     str[i : i+n],
+				canOpen:  !unicode.IsSpace(after),
+				canClose: !unicode.IsSpace(before),
+			}
+
+			//underscores don't work inside words
+			if c == '_' {
+				token.canOpen = token.canOpen && !unicode.IsLetter(before) && !unicode.IsDigit(before)
+				token.canClose = token.canClose && !unicode.IsLetter(after) && !unicode.IsDigit(after)
+			}
+
+			tokens = append(tokens, token)
+			i += n
+			continue
+		}
+
+		_, size := utf8.DecodeRuneInString(str[i:])
+		AppendText(str[i : i+size])
+		i += size
+	}
+
+	return tokens
+}
+
+//unescapeMarkdown removes backslash escapes
+func unescapeMarkdown(str string) string {
+	builder := strings.Builder{}
+	for i := 0; i < len(str); i++ {
+		if str[i] == '\\' && i+1 < len(str) && isMarkdownPunctuation(rune(str[i+1])) {
+			i++
+		}
+		builder.WriteByte(str[i])
+	}
+	return builder.String()
+}
+
+//parseMarkdownLink parses an inline link like [text](url) or an autolink like <https://url> at the start of the string
+//Links to URLs that aren't safe according to IsSafeLink are left to be parsed as text
+func parseMarkdownLink(str string) (markdownToken, int, bool) {
+	if str[0] == '<' {
+		end := strings.IndexAny(str, "> \n")
+		if end == -1 || str[end] != '>' || !strings.Contains(str[:end], "://") || !IsSafeLink(str[1:end]) {
+			return markdownToken{}, 0, false
+		}
+		url := str[1:end]
+		return markdownToken{kind: markdownTokenLink, text: url, target: url}, end + 1, true
+	}
+
+	textEnd := -1
+	for i := 1; i < len(str); i++ {
+		if str[i] == '\\' {
+			i++
+		} else if str[i] == '[' || str[i] == '\n' {
+			return markdownToken{}, 0, false
+		} else if str[i] == ']' {
+			textEnd = i
+			break
+		}
+	}
+
+	if textEnd == -1 || !strings.HasPrefix(str[textEnd+1:], "(") {
+		return markdownToken{}, 0, false
+	}
+
+	targetEnd := strings.IndexAny(str[textEnd+2:], ") \n")
+	if targetEnd == -1 || str[textEnd+2+targetEnd] != ')' || !IsSafeLink(str[textEnd+2:textEnd+2+targetEnd]) {
+		return markdownToken{}, 0, false
+	}
+
+	return markdownToken{
+		kind:   markdownTokenLink,
+		text:   unescapeMarkdown(str[1:textEnd]),
+		target: str[textEnd+2 : textEnd+2+targetEnd],
+	}, textEnd + 3 + targetEnd, true
+}
+
+//parseMarkdownCodeBlock parses a fenced code block at the start of the string, the closing fence has to be at least as long as the opening one
+func parseMarkdownCodeBlock(str string) (markdownToken, int, bool) {
+	n := 0
+	for n < len(str) && str[n] == '`' {
+		n++
+	}
+
+	lineEnd := strings.IndexByte(str, '\n')
+	if lineEnd == -1 || strings.Contains(str[n:lineEnd], "`") {
+		return markdownToken{}, 0, false
+	}
+	language := strings.TrimSpace(str[n:lineEnd])
+
+	fence := strings.Repeat("`", n)
+	for pos := lineEnd; pos < len(str); {
+		next := strings.Index(str[pos:], "\n"+fence)
+		if next == -1 {
+			break
+		}
+		pos += next + 1
+
+		//the rest of the closing line may only contain more backticks
+		end := pos
+		for end < len(str) && str[end] == '`' {
+			end++
+		}
+		if end < len(str) && str[end] != '\n' {
+			continue
+		}
+
+		//the line break after the block is a part of it
+		length := end
+		if end < len(str) {
+			length++
+		}
+
+		text := ""
+		if pos-1 > lineEnd {
+			text = str[lineEnd+1 : pos-1]
+		}
+
+		return markdownToken{
+			kind:   markdownTokenCodeBlock,
+			text:   text,
+			target: language,
+		}, length, true
+	}
+
+	return markdownToken{}, 0, false
+}
+
+//FromMarkdown parses a subset of markdown: emphasis, strong emphasis, strikethrough, code spans, fenced code blocks,
+//links and backslash escapes, with __underline__ and ||spoiler|| extensions. Other constructs are kept as text
+func FromMarkdown(str string) Message {
+	type opener struct {
+		prop   PropertyList
+		char   byte
+		length int
+		both   bool
+	}
+
+	tokens := tokenizeMarkdown(str)
+	msg := make(Message, 0)
+	current := PropertyList(0)
+	stack := make([]opener, 0)
+
+	AppendText := func(text string, props PropertyList) {
+		if len(text) == 0 {
+			return
+		}
+		if last := len(msg) - 1; last >= 0 && msg[last].Props.EnableList == props && msg[last].Kind == NodeText {
+			msg[last].Text += text
+			return
+		}
+		msg = append(msg, MessageNode{Props: Properties{EnableList: props}, Text: text})
+	}
+
+	HasCloser := func(i int, length int) bool {
+		for _, token := range tokens[i+1:] {
+			if token.kind == markdownTokenDelimiter && token.text[0] == tokens[i].text[0] && token.canClose && len(token.text) >= length {
+				return true
+			}
+		}
+		return false
+	}
+
+	for i, token := range tokens {
+		switch token.kind {
+		case markdownTokenText:
+			AppendText(token.text, current)
+			continue
+		case markdownTokenCode:
+			AppendText(token.text, current|EMPropMonospace)
+			continue
+		case markdownTokenLink:
+			msg = append(msg, MessageNode{Props: Properties{EnableList: current}, Text: token.text, Kind: NodeLink, Target: token.target})
+			continue
+		case markdownTokenCodeBlock:
+			//so is the line break before it
+			if last := len(msg) - 1; last >= 0 && msg[last].Kind == NodeText {
+				msg[last].Text = strings.TrimSuffix(msg[last].Text, "\n")
+			}
+			msg = append(msg, MessageNode{Text: token.text, Kind: NodeCodeBlock, Target: token.target})
+			continue
+		}
+
+		char, n := token.text[0], len(token.text)
+		both := token.canOpen && token.canClose
+
+		//close the innermost openers of the same character first, runs that can both open and close don't close
+		//openers when the lengths add up to a multiple of three (the "rule of 3" of CommonMark)
+		for j := len(stack) - 1; j >= 0 && token.canClose && n > 0; j-- {
+			if stack[j].char != char {
+				continue
+			}
+
+			length := 0
+			for _, delimiter := range markdownRunDelimiters[char] {
+				if delimiter.prop == stack[j].prop {
+					length = delimiter.length
+				}
+			}
+
+			if length > n || (both || stack[j].both) && (stack[j].length+n)%3 == 0 && (stack[j].length%3 != 0 || n%3 != 0) {
+				break
+			}
+
+			current &^= stack[j].prop
+			stack = append(stack[:j], stack[j+1:]...)
+			n -= length
+		}
+
+		if token.canOpen {
+			runLength := n
+			for _, delimiter := range markdownRunDelimiters[char] {
+				if delimiter.length <= n && current&delimiter.prop == 0 && HasCloser(i, delimiter.length) {
+					current |= delimiter.prop
+					stack = append(stack, opener{delimiter.prop, char, runLength, both})
+					n -= delimiter.length
+				}
+			}
+		}
+
+		AppendText(token.text[:n], current)
+	}
+
+	return msg
+}
@@ -0,0 +1,93 @@
+package message
+
+import (
+	"testing"
+)
+
+func props(list PropertyList) Properties {
+	return Properties{EnableList: list}
+}
+
+type markupTest struct {
+	message  Message
+	expected string
+}
+
+var toMarkdownTests = []markupTest{
+	{PlaintextToMessage("plain *text* with_markup #1"), `plain \*text\* with\_markup \#1`},
+	{Message{{Props: props(EMPropBold), Text: "bold"}, {Props: ResetProperties, Text: " plain"}}, "**bold** plain"},
+	{Message{{Props: props(EMPropBold), Text: "bold "}, {Props: props(EMPropBold | EMPropItalic), Text: "both"}, {Props: props(EMPropBold), Text: " bold"}}, "**bold *both* bold**"},
+	{Message{{Props: props(EMPropItalic), Text: " spaced "}}, " *spaced* "},
+	{Message{{Props: props(EMPropBold), Text: "a"}, {Props: props(EMPropBold | EMPropItalic), Text: "b"}, {Props: props(EMPropItalic), Text: "c"}}, "**a*b****c*"},
+	{Message{{Props: props(EMPropItalic), Text: "a"}, {Props: props(EMPropBold | EMPropItalic), Text: "b"}, {Props: props(EMPropBold), Text: "c"}}, "*a**b*****c**"},
+	{Message{{Props: props(EMPropUnderline | EMPropStrikeThrough), Text: "u"}, {Props: props(EMPropSpoiler), Text: "secret"}}, "__~~u~~__||secret||"},
+	{Message{{Props: props(EMPropMonospace), Text: "a*b`c"}}, "``a*b`c``"},
+	{Message{{Props: props(EMPropMonospace | EMPropBold), Text: "`x"}}, "**`` `x ``**"},
+	{Message{{Props: Properties{EnableList: EMPropForeground, Foreground: PaletteColor(4)}, Text: "red"}}, "red"},
+	{Message{{Props: ResetProperties, Text: "x", Kind: NodeLink, Target: "javascript:alert(1)"}}, "x"},
+}
+
+func TestMessage_ToMarkdown(t *testing.T) {
+	for nTest, test := range toMarkdownTests {
+		if got := test.message.ToMarkdown(); got != test.expected {
+			t.Errorf("(test %d) Bad markdown: expected \"%s\", got \"%s\"", nTest, test.expected, got)
+		}
+	}
+}
+
+var fromMarkdownTests = []markupTest{
+	{PlaintextToMessage("plain text"), "plain text"},
+	{Message{{Props: props(EMPropBold), Text: "bold"}, {Props: ResetProperties, Text: " "}, {Props: props(EMPropItalic), Text: "it"}, {Props: ResetProperties, Text: " "}, {Props: props(EMPropItalic), Text: "alic"}}, "**bold** *it* _alic_"},
+	{Message{{Props: props(EMPropBold | EMPropItalic), Text: "both"}}, "***both***"},
+	{Message{{Props: props(EMPropUnderline), Text: "u"}, {Props: props(EMPropStrikeThrough), Text: "s"}, {Props: props(EMPropSpoiler), Text: "secret"}}, "__u__~~s~~||secret||"},
+	{Message{{Props: ResetProperties, Text: "a "}, {Props: props(EMPropMonospace), Text: "**not bold**"}}, "a `**not bold**`"},
+	{Message{{Props: props(EMPropMonospace), Text: "a`b"}, {Props: ResetProperties, Text: " `unclosed"}}, "`` a`b `` `unclosed"},
+	{PlaintextToMessage("2 * 3 * 4 and snake_case_name, ~ | ||"), "2 * 3 * 4 and snake_case_name, ~ | ||"},
+	{PlaintextToMessage("*not* _emphasis_"), `\*not\* \_emphasis\_`},
+	{Message{{Props: props(EMPropItalic), Text: "unclosed **bold"}}, "*unclosed **bold*"},
+	{PlaintextToMessage("[not a link] (x) <not://a link> <b>"), "[not a link] (x) <not://a link> <b>"},
+	{PlaintextToMessage("[x](javascript:void) <javascript://x>"), "[x](javascript:void) <javascript://x>"},
+	{Message{{Props: ResetProperties, Text: "a"}, {Text: "", Kind: NodeCodeBlock}, {Props: ResetProperties, Text: "b"}}, "a\n```\n```\nb"},
+	{Message{{Props: props(EMPropBold), Text: "a"}, {Props: props(EMPropBold | EMPropItalic), Text: "b"}, {Props: props(EMPropItalic), Text: "c"}}, "**a*b****c*"},
+}
+
+func TestFromMarkdown(t *testing.T) {
+	for nTest, test := range fromMarkdownTests {
+		if got := FromMarkdown(test.expected); !got.VisiblyEquals(test.message) {
+			t.Errorf("(test %d) Bad message from \"%s\": expected %#v, got %#v", nTest, test.expected, test.message, got)
+		}
+	}
+}
+
+//whitespace is moved out of formatting when rendering, so the round trip is checked on the rendered markdown
+func TestMarkdown_RoundTrip(t *testing.T) {
+	for nTest, test := range toMarkdownTests {
+		rendered := test.message.ToMarkdown()
+		parsed := FromMarkdown(rendered)
+
+		if parsed.String() != test.message.String() {
+			t.Errorf("(test %d) Round trip changed the text: expected \"%s\", got \"%s\"", nTest, test.message.String(), parsed.String())
+		}
+
+		if got := parsed.ToMarkdown(); got != rendered {
+			t.Errorf("(test %d) Round trip changed the formatting: expected \"%s\", got \"%s\"", nTest, rendered, got)
+		}
+	}
+}
+
+var toHTMLTests = []markupTest{
+	{PlaintextToMessage("<a href=\"x\">&</a>\nline"), "&lt;a href=&#34;x&#34;&gt;&amp;&lt;/a&gt;<br>line"},
+	{Message{{Props: props(EMPropBold), Text: "bold "}, {Props: props(EMPropBold | EMPropItalic), Text: "both"}, {Props: props(EMPropItalic), Text: " it"}}, "<strong>bold <em>both</em></strong><em> it</em>"},
+	{Message{{Props: props(EMPropSpoiler | EMPropMonospace | EMPropUnderline | EMPropStrikeThrough), Text: "x"}}, `<span class="spoiler"><u><s><code>x</code></s></u></span>`},
+	{Message{{Props: Properties{EnableList: EMPropColors | EMPropBold, Foreground: PaletteColor(4), Background: RGBColor(0x123456)}, Text: "c"}}, `<span style="color: #ff0000"><span style="background-color: #123456"><strong>c</strong></span></span>`},
+	{Message{{Props: ResetProperties, Text: "x", Kind: NodeLink, Target: "javascript:alert(1)"}}, "x"},
+	{Message{{Props: ResetProperties, Text: "x", Kind: NodeLink, Target: "JavaScript:alert(1)"}}, "x"},
+}
+
+func TestMessage_ToHTML(t *testing.T) {
+	for nTest, test := range toHTMLTests {
+		if got := test.message.ToHTML(); got != test.expected {
+			t.Errorf("(test %d) Bad HTML: expected \"%s\", got \"%s\"", nTest, test.expected, got)
+		}
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"strconv"
 	"strings"
+	"unicode/utf8"
 )
 
 const (
@@ -15,12 +16,17 @@ const (
 	EMPropMonospace     = 0x10
 	EMPropSpoiler       = 0x20
 	EMPropAll           = EMPropBold | EMPropItalic | EMPropUnderline | EMPropStrikeThrough | EMPropMonospace | EMPropSpoiler
+
+	//EMPropForeground and EMPropBackground set (when enabled) or inherit the colours of a node
+	EMPropForeground = 0x40
+	EMPropBackground = 0x80
+	EMPropColors     = EMPropForeground | EMPropBackground
 )
 
 var (
 	DefaultProperties = Properties{
 		EnableList:  0,
-		InheritList: EMPropAll,
+		InheritList: EMPropAll | EMPropColors,
 	}
 
 	ResetProperties = Properties{
@@ -31,31 +37,79 @@ var (
 
 type PropertyList uint32
 
+//Properties of a node: the effective properties are those in EnableList and those in InheritList that the previous node
+//had, the rest are turned off
 type Properties struct {
 	EnableList  PropertyList
 	InheritList PropertyList
+	//Foreground and Background are only used if the respective bit is in EnableList
+	Foreground Color
+	Background Color
+}
+
+//Style is the effective formatting of a node after inheritance
+type Style struct {
+	Props      PropertyList
+	Foreground Color
+	Background Color
 }
 
 type MessageNode struct {
 	Props Properties
 	Text  string
+	//Kind and Target annotate the text, see NodeKind
+	Kind   NodeKind
+	Target string
 }
 
 type Message []MessageNode
 
-func (msg Message) Walk(callback func(text string, currentProps, lastProps PropertyList)) {
-	currentProperties := PropertyList(0)
+//WalkStyled invokes the callback for every node with the effective style of the node and that of the previous node
+func (msg Message) WalkStyled(callback func(text string, current, last Style)) {
+	msg.walkNodes(func(node MessageNode, current, last Style) {
+		callback(node.Text, current, last)
+	})
+}
+
+//walkNodes computes the effective style of every node, see Properties for how EnableList and InheritList combine
+func (msg Message) walkNodes(callback func(node MessageNode, current, last Style)) {
+	current := Style{}
+
+	PickColor := func(node MessageNode, bit PropertyList, nodeColor, lastColor Color) Color {
+		if node.Props.EnableList&bit != 0 {
+			return nodeColor
+		} else if node.Props.InheritList&bit != 0 {
+			return lastColor
+		}
+		return NoColor
+	}
 
 	for _, node := range msg {
-		oldProperties := currentProperties
+		last := current
 
-		currentProperties &= ^node.Props.InheritList
-		currentProperties |= (node.Props.InheritList & oldProperties) | node.Props.EnableList
+		//properties that are neither inherited nor enabled are turned off
+		current.Props = (node.Props.InheritList & last.Props) | node.Props.EnableList
+		current.Foreground = PickColor(node, EMPropForeground, node.Props.Foreground, last.Foreground)
+		current.Background = PickColor(node, EMPropBackground, node.Props.Background, last.Background)
 
-		callback(node.Text, currentProperties, oldProperties)
+		current.Props &^= EMPropColors
+		if current.Foreground.IsSet() {
+			current.Props |= EMPropForeground
+		}
+		if current.Background.IsSet() {
+			current.Props |= EMPropBackground
+		}
+
+		callback(node, current, last)
 	}
 }
 
+func (msg Message) Walk(callback func(text string, currentProps, lastProps PropertyList)) {
+	msg.WalkStyled(func(text string, current, last Style) {
+		callback(text, current.Props, last.Props)
+	})
+}
+
 func PlaintextToMessage(text string) Message {
 	return Message{MessageNode{
 		Props: ResetProperties,
@@ -91,13 +145,17 @@ func (msg Message) Flatten() Message { //TODO: pick a better name
 
 	newMsg := make(Message, len(msg))
 
-	msg.Walk(func(text string, currentProps, lastProps PropertyList) {
+	msg.walkNodes(func(node MessageNode, current, last Style) {
 		newMsg[i] = MessageNode{
 			Props: Properties{
-				EnableList:  currentProps,
+				EnableList:  current.Props,
 				InheritList: 0,
+				Foreground:  current.Foreground,
+				Background:  current.Background,
 			},
-			Text: text,
+			Text:   node.Text,
+			Kind:   node.Kind,
+			Target: node.Target,
 		}
 		i++
 	})
@@ -114,9 +172,7 @@ func (msg Message) StrictlyEquals(other Message) bool {
 		n0 := v
 		n1 := other[k]
 
-		if (n0.Text != n1.Text) ||
-			(n0.Props.EnableList != n1.Props.EnableList) ||
-			(n0.Props.InheritList != n1.Props.InheritList) {
+		if n0.Text != n1.Text || n0.Props != n1.Props || n0.Kind != n1.Kind || n0.Target != n1.Target {
 			return false
 		}
 	}
@@ -124,48 +180,66 @@ func (msg Message) StrictlyEquals(other Message) bool {
 	return true
 }
 
-func (msg Message) VisiblyEquals(other Message) bool { //TODO: fix lazy implementation
-	return msg.Flatten().ToIntermediate() == other.Flatten().ToIntermediate()
-}
+//normalize flattens the message, drops empty nodes and merges adjacent nodes with the same properties and annotations
+//Code blocks are neither dropped nor merged
+func (msg Message) normalize() Message {
+	newMsg := make(Message, 0, len(msg))
 
-func (msg Message) TrimLeft(amount int) Message {
-	if amount >= msg.Len() {
-		return make(Message, 0)
+	for _, node := range msg.Flatten() {
+		if len(node.Text) == 0 && node.Kind != NodeCodeBlock {
+			continue
+		}
+
+		if last := len(newMsg) - 1; last >= 0 && newMsg[last].Props == node.Props && newMsg[last].Kind == node.Kind && newMsg[last].Target == node.Target && node.Kind != NodeCodeBlock {
+			newMsg[last].Text += node.Text
+			continue
+		}
+
+		newMsg = append(newMsg, node)
 	}
 
-	msg = msg.Flatten()
+	return newMsg
+}
 
-	stripUpTo := 0
+func (msg Message) VisiblyEquals(other Message) bool {
+	return msg.normalize().StrictlyEquals(other.normalize())
+}
 
-	for k, v := range msg {
-		if amount > len(v.Text) {
-			amount -= len(v.Text)
-		} else {
-			stripUpTo = k
-			break
-		}
+//TrimLeft removes amount bytes of plaintext from the start of the message
+//An offset inside a multi-byte rune is moved forward to the next rune, see Slice for rune offsets
+func (msg Message) TrimLeft(amount int) Message {
+	text := msg.String()
+	if amount >= len(text) {
+		return make(Message, 0)
+	}
+	if amount < 0 {
+		amount = 0
 	}
 
-	msg = msg[stripUpTo:]
-	msg[0].Text = msg[0].Text[amount:]
+	for amount < len(text) && !utf8.RuneStart(text[amount]) {
+		amount++
+	}
 
-	return msg
+	return msg.sliceBytes(amount, len(text))
 }
 
-func (msg Message) Index(substring string) int { //TODO: holy fuck is this lazy
+//Index returns the byte offset of the first occurrence of substring in the plaintext, see RuneIndex for rune offsets
+func (msg Message) Index(substring string) int {
 	return strings.Index(msg.String(), substring)
 }
 
 func (msg Message) TrimPrefix(prefix string) Message {
-	idx := msg.Index(prefix)
-	if idx != 0 {
+	if !strings.HasPrefix(msg.String(), prefix) {
 		return msg
 	}
 
-	return msg.TrimLeft(idx + len(prefix))
+	return msg.TrimLeft(len(prefix))
 }
 
-//ToIntermediate translates a message to an intermediate form to later store as a string
+//ToIntermediate translates a message to the legacy intermediate form to later store as a string, node annotations and
+//colours are dropped
+//
+//Deprecated: use Encode, FromIntermediate reads both forms
 func (msg Message) ToIntermediate() string {
 	//the format is: enable:inherit:strLen:theMessage, repeated
 
@@ -173,8 +247,8 @@ func (msg Message) ToIntermediate() string {
 
 	for _, node := range msg {
 		builder.WriteString(fmt.Sprintf("%d:%d:%d:%s",
-			node.Props.EnableList,
-			node.Props.InheritList,
+			node.Props.EnableList&^EMPropColors,
+			node.Props.InheritList&^EMPropColors,
 			len(node.Text),
 			node.Text,
 		))
@@ -183,8 +257,17 @@ func (msg Message) ToIntermediate() string {
 	return builder.String()
 }
 
+//FromIntermediate reads a message stored either with Encode or with the legacy ToIntermediate
+//In the legacy form a property in neither list kept the value it had in the previous node, such properties are added to
+//EnableList so that the message renders as it was stored
 func FromIntermediate(str string) (Message, error) {
+	if IsEncoded(str) {
+		return decode(str)
+	}
+
 	msg := make(Message, 0)
+	//seen holds every property enabled so far, which is what the previous node had in the legacy form
+	seen := PropertyList(0)
 
 	ExtractOne := func() (int64, error) {
 		if idx := strings.Index(str, ":"); idx == -1 {
@@ -212,13 +295,19 @@ func FromIntermediate(str string) (Message, error) {
 			vals[2] = int64(len(str))
 		}
 
+		if vals[2] < 0 || vals[2] > int64(len(str)) {
+			return nil, errors.New("text length exceeds the rest of the string")
+		}
+
+		enableList, inheritList := PropertyList(vals[0]), PropertyList(vals[1])
 		msg = append(msg, MessageNode{
 			Props: Properties{
-				EnableList:  PropertyList(vals[0]),
-				InheritList: PropertyList(vals[1]),
+				EnableList:  enableList | (seen &^ inheritList),
+				InheritList: inheritList,
 			},
 			Text: str[:int(vals[2])],
 		})
+		seen |= enableList
 
 		str = str[int(vals[2]):]
 	}
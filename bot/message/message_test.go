@@ -75,6 +75,49 @@ var fromIntermediateTests = []fromIntermediateTest{
 		from:      "1:63:7:testing2:1:-1:123",
 		expected:  testMessages[0],
 	},
+	//in the legacy form properties in neither list stay as they were, bold stays on and italic is inherited
+	{
+		flattened: false,
+		from:      "1:0:1:a2:0:1:b0:2:1:c",
+		expected: Message{
+			MessageNode{Props: Properties{EnableList: EMPropBold}, Text: "a"},
+			MessageNode{Props: Properties{EnableList: EMPropBold | EMPropItalic}, Text: "b"},
+			MessageNode{Props: Properties{EnableList: EMPropBold, InheritList: EMPropItalic}, Text: "c"},
+		},
+	},
+	{
+		flattened: false,
+		from:      `{"version":1,"nodes":[{"text":"testing","enable":["bold"],"inherit":["bold","italic","monospace","spoiler","strikethrough","underline"]},{"text":"123","enable":["italic"],"inherit":["bold"]}]}`,
+		expected:  testMessages[0],
+	},
+	{
+		flattened: false,
+		from:      `{"version":1,"nodes":[{"text":"red","enable":["bold","foreground"],"fg":"04"},{"text":"blue","enable":["background","foreground"],"inherit":["foreground"],"fg":"01","bg":"#0000ff"}]}`,
+		expected: Message{
+			MessageNode{
+				Props: Properties{EnableList: EMPropBold | EMPropForeground, InheritList: 0, Foreground: PaletteColor(4)},
+				Text:  "red",
+			},
+			MessageNode{
+				Props: Properties{EnableList: EMPropColors, InheritList: EMPropForeground, Foreground: PaletteColor(1), Background: RGBColor(0xff)},
+				Text:  "blue",
+			},
+		},
+	},
+	{
+		flattened: false,
+		from:      `{"version":2,"nodes":[{"text":"see "},{"kind":"link","target":"https://example.com","text":"docs"}]}`,
+		expected:  NewBuilder().Text("see ").Link("docs", "https://example.com").Build(),
+	},
+}
+
+var badIntermediateTests = []string{
+	"1:63:99:short",
+	`{"nodes":[{"text":"no version"}]}`,
+	`{"version":99,"nodes":[]}`,
+	`{"version":1,"nodes":[{"text":"a","enable":["blink"]}]}`,
+	`{"version":1,"nodes":[{"text":"a","enable":["foreground"],"fg":"#zz"}]}`,
+	`{"version":1,"nodes":[{"kind":"video","text":"a"}]}`,
 }
 
 func TestMessage_Flatten(t *testing.T) {
@@ -131,3 +174,30 @@ func TestFromIntermediate(t *testing.T) {
 		}
 	}
 }
+
+func TestFromIntermediate_Bad(t *testing.T) {
+	for nTest, str := range badIntermediateTests {
+		if _, err := FromIntermediate(str); err == nil {
+			t.Errorf("(test %d) Expected an error for \"%s\"", nTest, str)
+		}
+	}
+}
+
+func TestMessage_Encode(t *testing.T) {
+	for nTest, test := range fromIntermediateTests {
+		str := test.expected.Encode()
+		if !IsEncoded(str) {
+			t.Errorf("(test %d) Encoded string isn't detected as versioned: \"%s\"", nTest, str)
+		}
+
+		got, err := FromIntermediate(str)
+		if err != nil {
+			t.Errorf("(test %d) Failed with error: %s", nTest, err)
+			continue
+		}
+
+		if !got.StrictlyEquals(test.expected) {
+			t.Errorf("(test %d) Round trip failed, encoded as \"%s\"", nTest, str)
+		}
+	}
+}
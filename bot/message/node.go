@@ -0,0 +1,88 @@
+package message
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+//NodeKind tells what the text of a node stands for, platforms can render annotated nodes natively
+type NodeKind uint8
+
+const (
+	//NodeText is plain (possibly formatted) text
+	NodeText NodeKind = iota
+	//NodeLink is a link to the URL in Target, the text is what is displayed and may be the URL itself
+	//Only links with a scheme in LinkSchemes are rendered as links, see IsSafeLink
+	NodeLink
+	//NodeMention mentions the user with the platform identity in Target (e.g. IRC:net:nick!user@host), the text is a display name
+	NodeMention
+	//NodeCodeBlock is preformatted, possibly multi-line text that is displayed on its own lines, Target may name its language
+	NodeCodeBlock
+)
+
+//LinkSchemes are the URL schemes links may have, links with other schemes (e.g. javascript:) are rendered as text
+var LinkSchemes = []string{"http", "https", "mailto", "irc"}
+
+//IsSafeLink tells if the target is a well-formed URL with one of LinkSchemes
+func IsSafeLink(target string) bool {
+	parsed, err := url.Parse(target)
+	if err != nil {
+		return false
+	}
+
+	for _, scheme := range LinkSchemes {
+		if strings.EqualFold(parsed.Scheme, scheme) {
+			return true
+		}
+	}
+	return false
+}
+
+var nodeKindNames = map[NodeKind]string{
+	NodeText:      "",
+	NodeLink:      "link",
+	NodeMention:   "mention",
+	NodeCodeBlock: "code_block",
+}
+
+func (kind NodeKind) String() string {
+	if name, ok := nodeKindNames[kind]; ok && len(name) != 0 {
+		return name
+	}
+	if kind == NodeText {
+		return "text"
+	}
+	return fmt.Sprintf("NodeKind(%d)", kind)
+}
+
+func nodeKindFromName(name string) (NodeKind, bool) {
+	for kind, kindName := range nodeKindNames {
+		if kindName == name {
+			return kind, true
+		}
+	}
+	return NodeText, false
+}
+
+//Links returns the targets of the link nodes in the message
+func (msg Message) Links() []string {
+	links := make([]string, 0)
+	for _, node := range msg {
+		if node.Kind == NodeLink {
+			links = append(links, node.Target)
+		}
+	}
+	return links
+}
+
+//Mentions returns the identities mentioned in the message
+func (msg Message) Mentions() []string {
+	mentions := make([]string, 0)
+	for _, node := range msg {
+		if node.Kind == NodeMention {
+			mentions = append(mentions, node.Target)
+		}
+	}
+	return mentions
+}
@@ -0,0 +1,270 @@
+package message
+
+import (
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+//runeToByteOffset converts a rune offset in str to a byte offset, clamping to the bounds of str
+func runeToByteOffset(str string, runeOffset int) int {
+	if runeOffset <= 0 {
+		return 0
+	}
+
+	n := 0
+	for i := range str {
+		if n == runeOffset {
+			return i
+		}
+		n++
+	}
+
+	return len(str)
+}
+
+func byteToRuneOffset(str string, byteOffset int) int {
+	return utf8.RuneCountInString(str[:byteOffset])
+}
+
+//sliceBytes is Slice with byte offsets into the plaintext, the offsets must be on rune boundaries
+func (msg Message) sliceBytes(start, end int) Message {
+	newMsg := make(Message, 0)
+
+	pos := 0
+	for _, node := range msg.Flatten() {
+		nodeStart, nodeEnd := pos, pos+len(node.Text)
+		pos = nodeEnd
+
+		lo, hi := start, end
+		if lo < nodeStart {
+			lo = nodeStart
+		}
+		if hi > nodeEnd {
+			hi = nodeEnd
+		}
+		if lo >= hi {
+			continue
+		}
+
+		newMsg = append(newMsg, MessageNode{
+			Props:  node.Props,
+			Text:   node.Text[lo-nodeStart : hi-nodeStart],
+			Kind:   node.Kind,
+			Target: node.Target,
+		})
+	}
+
+	return newMsg
+}
+
+//styleAt returns the flattened properties of the node containing the byte offset, or those of the last node at the end of the message
+func (msg Message) styleAt(offset int) Properties {
+	props := ResetProperties
+
+	pos := 0
+	for _, node := range msg.Flatten() {
+		if len(node.Text) == 0 {
+			continue
+		}
+
+		props = node.Props
+		pos += len(node.Text)
+		if offset < pos {
+			break
+		}
+	}
+
+	return props
+}
+
+//RuneLen returns the length of the plaintext in runes
+func (msg Message) RuneLen() int {
+	return utf8.RuneCountInString(msg.String())
+}
+
+//RuneIndex is like Index but returns an offset in runes
+func (msg Message) RuneIndex(substring string) int {
+	text := msg.String()
+	idx := strings.Index(text, substring)
+	if idx == -1 {
+		return -1
+	}
+
+	return byteToRuneOffset(text, idx)
+}
+
+//RuneLastIndex returns the rune offset of the last occurrence of substring in the plaintext, or -1
+func (msg Message) RuneLastIndex(substring string) int {
+	text := msg.String()
+	idx := strings.LastIndex(text, substring)
+	if idx == -1 {
+		return -1
+	}
+
+	return byteToRuneOffset(text, idx)
+}
+
+//Slice returns the part of the message between the rune offsets start and end, keeping formatting
+//Offsets are clamped to the message, the returned message is flattened
+func (msg Message) Slice(start, end int) Message {
+	text := msg.String()
+	return msg.sliceBytes(runeToByteOffset(text, start), runeToByteOffset(text, end))
+}
+
+//SplitN splits the message around occurrences of sep in the plaintext like strings.SplitN, keeping formatting
+func (msg Message) SplitN(sep string, n int) []Message {
+	if n == 0 {
+		return nil
+	}
+
+	text := msg.String()
+	parts := make([]Message, 0)
+
+	if len(sep) == 0 {
+		for i, r := range text {
+			if n > 0 && len(parts) == n-1 {
+				return append(parts, msg.sliceBytes(i, len(text)))
+			}
+			parts = append(parts, msg.sliceBytes(i, i+utf8.RuneLen(r)))
+		}
+		return parts
+	}
+
+	pos := 0
+	for n < 0 || len(parts) < n-1 {
+		idx := strings.Index(text[pos:], sep)
+		if idx == -1 {
+			break
+		}
+
+		parts = append(parts, msg.sliceBytes(pos, pos+idx))
+		pos += idx + len(sep)
+	}
+
+	return append(parts, msg.sliceBytes(pos, len(text)))
+}
+
+//Split splits the message around every occurrence of sep in the plaintext, keeping formatting
+func (msg Message) Split(sep string) []Message {
+	return msg.SplitN(sep, -1)
+}
+
+//Fields splits the message around runs of whitespace like strings.Fields, keeping formatting
+func (msg Message) Fields() []Message {
+	text := msg.String()
+	fields := make([]Message, 0)
+
+	start := -1
+	for i, r := range text {
+		if unicode.IsSpace(r) {
+			if start != -1 {
+				fields = append(fields, msg.sliceBytes(start, i))
+				start = -1
+			}
+		} else if start == -1 {
+			start = i
+		}
+	}
+
+	if start != -1 {
+		fields = append(fields, msg.sliceBytes(start, len(text)))
+	}
+
+	return fields
+}
+
+//replaceRanges replaces the byte ranges of the plaintext, the replacements take the formatting of the text they replace
+func (msg Message) replaceRanges(ranges [][]int, replacement func(match []int) string) Message {
+	newMsg := make(Message, 0)
+
+	pos := 0
+	for _, match := range ranges {
+		newMsg = append(newMsg, msg.sliceBytes(pos, match[0])...)
+		newMsg = append(newMsg, MessageNode{
+			Props: msg.styleAt(match[0]),
+			Text:  replacement(match),
+		})
+		pos = match[1]
+	}
+
+	return append(newMsg, msg.sliceBytes(pos, len(msg.String()))...)
+}
+
+//ReplaceAll replaces every occurrence of old in the plaintext with new, the replacement takes the formatting of the text it replaces
+func (msg Message) ReplaceAll(old, new string) Message {
+	text := msg.String()
+	ranges := make([][]int, 0)
+
+	if len(old) == 0 {
+		for i := range text {
+			ranges = append(ranges, []int{i, i})
+		}
+		ranges = append(ranges, []int{len(text), len(text)})
+	} else {
+		for pos := 0; ; {
+			idx := strings.Index(text[pos:], old)
+			if idx == -1 {
+				break
+			}
+			ranges = append(ranges, []int{pos + idx, pos + idx + len(old)})
+			pos += idx + len(old)
+		}
+	}
+
+	return msg.replaceRanges(ranges, func([]int) string { return new })
+}
+
+//ReplaceAllRegexp is like regexp.ReplaceAllString on the plaintext, $ expansions are supported in repl
+//The replacements take the formatting of the text they replace
+func (msg Message) ReplaceAllRegexp(re *regexp.Regexp, repl string) Message {
+	text := msg.String()
+
+	return msg.replaceRanges(re.FindAllStringSubmatchIndex(text, -1), func(match []int) string {
+		return string(re.ExpandString(nil, repl, text, match))
+	})
+}
+
+//FindAllRegexpIndex returns the rune offsets of at most n (all if n < 0) matches of the expression in the plaintext
+func (msg Message) FindAllRegexpIndex(re *regexp.Regexp, n int) [][]int {
+	text := msg.String()
+	matches := re.FindAllStringIndex(text, n)
+
+	for _, match := range matches {
+		match[0] = byteToRuneOffset(text, match[0])
+		match[1] = byteToRuneOffset(text, match[1])
+	}
+
+	return matches
+}
+
+//FindAllRegexp returns at most n (all if n < 0) matches of the expression in the plaintext as formatted messages
+func (msg Message) FindAllRegexp(re *regexp.Regexp, n int) []Message {
+	text := msg.String()
+	found := make([]Message, 0)
+
+	for _, match := range re.FindAllStringIndex(text, n) {
+		found = append(found, msg.sliceBytes(match[0], match[1]))
+	}
+
+	return found
+}
+
+//FindRegexpSubmatch returns the leftmost match of the expression and its groups as formatted messages, groups that didn't participate are nil
+func (msg Message) FindRegexpSubmatch(re *regexp.Regexp) []Message {
+	text := msg.String()
+	match := re.FindStringSubmatchIndex(text)
+	if match == nil {
+		return nil
+	}
+
+	groups := make([]Message, len(match)/2)
+	for i := range groups {
+		if match[2*i] >= 0 {
+			groups[i] = msg.sliceBytes(match[2*i], match[2*i+1])
+		}
+	}
+
+	return groups
+}
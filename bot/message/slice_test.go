@@ -0,0 +1,154 @@
+package message
+
+import (
+	"regexp"
+	"testing"
+)
+
+var (
+	//"héllo " in testBold followed by "wörld" in italics
+	sliceTestMessage = Message{
+		MessageNode{Props: Properties{EnableList: EMPropBold}, Text: "héllo "},
+		MessageNode{Props: Properties{EnableList: EMPropItalic}, Text: "wörld"},
+	}
+
+	testBold   = Properties{EnableList: EMPropBold}
+	testItalic = Properties{EnableList: EMPropItalic}
+)
+
+func TestMessage_Slice(t *testing.T) {
+	tests := []struct {
+		start, end int
+		expected   Message
+	}{
+		{0, 2, Message{{Props: testBold, Text: "hé"}}},
+		{1, 8, Message{{Props: testBold, Text: "éllo "}, {Props: testItalic, Text: "wö"}}},
+		{7, 100, Message{{Props: testItalic, Text: "örld"}}},
+		{-5, 1, Message{{Props: testBold, Text: "h"}}},
+		{5, 5, Message{}},
+	}
+
+	for nTest, test := range tests {
+		got := sliceTestMessage.Slice(test.start, test.end)
+		if !got.VisiblyEquals(test.expected) {
+			t.Errorf("(test %d) Bad slice: expected %#v, got %#v", nTest, test.expected, got)
+		}
+	}
+}
+
+func TestMessage_TrimLeft(t *testing.T) {
+	//byte 2 is inside "é", the trim is moved to the next rune
+	got := sliceTestMessage.TrimLeft(2)
+	expected := Message{{Props: testBold, Text: "llo "}, {Props: testItalic, Text: "wörld"}}
+	if !got.VisiblyEquals(expected) {
+		t.Errorf("Bad trim: expected %#v, got %#v", expected, got)
+	}
+}
+
+func TestMessage_Split(t *testing.T) {
+	tests := []struct {
+		sep      string
+		n        int
+		expected []Message
+	}{
+		{"l", -1, []Message{
+			{{Props: testBold, Text: "hé"}},
+			{},
+			{{Props: testBold, Text: "o "}, {Props: testItalic, Text: "wör"}},
+			{{Props: testItalic, Text: "d"}},
+		}},
+		{"o ", 2, []Message{
+			{{Props: testBold, Text: "héll"}},
+			{{Props: testItalic, Text: "wörld"}},
+		}},
+		{"", 3, []Message{
+			{{Props: testBold, Text: "h"}},
+			{{Props: testBold, Text: "é"}},
+			{{Props: testBold, Text: "llo "}, {Props: testItalic, Text: "wörld"}},
+		}},
+	}
+
+	for nTest, test := range tests {
+		got := sliceTestMessage.SplitN(test.sep, test.n)
+		if len(got) != len(test.expected) {
+			t.Errorf("(test %d) Bad part count: expected %d, got %d", nTest, len(test.expected), len(got))
+			continue
+		}
+
+		for k, part := range got {
+			if !part.VisiblyEquals(test.expected[k]) {
+				t.Errorf("(test %d) Bad part %d: expected %#v, got %#v", nTest, k, test.expected[k], part)
+			}
+		}
+	}
+}
+
+func TestMessage_Fields(t *testing.T) {
+	msg := Message{
+		MessageNode{Props: testBold, Text: "  ça va"},
+		MessageNode{Props: testItalic, Text: "\tbien　"},
+	}
+	expected := []string{"ça", "va", "bien"}
+
+	got := msg.Fields()
+	if len(got) != len(expected) {
+		t.Fatalf("Bad field count: expected %d, got %d", len(expected), len(got))
+	}
+
+	for k, field := range got {
+		if field.String() != expected[k] {
+			t.Errorf("Bad field %d: expected \"%s\", got \"%s\"", k, expected[k], field.String())
+		}
+	}
+
+	if !got[2].VisiblyEquals(Message{{Props: testItalic, Text: "bien"}}) {
+		t.Errorf("Field lost its formatting: %#v", got[2])
+	}
+}
+
+func TestMessage_ReplaceAll(t *testing.T) {
+	tests := []struct {
+		got      Message
+		expected Message
+	}{
+		{
+			sliceTestMessage.ReplaceAll("ö", "oe"),
+			Message{{Props: testBold, Text: "héllo "}, {Props: testItalic, Text: "woerld"}},
+		},
+		{
+			sliceTestMessage.ReplaceAll("o w", "_"),
+			Message{{Props: testBold, Text: "héll_"}, {Props: testItalic, Text: "örld"}},
+		},
+		{
+			sliceTestMessage.ReplaceAllRegexp(regexp.MustCompile(`(\pL)(\pL)(\pL)$`), "$3$2$1"),
+			Message{{Props: testBold, Text: "héllo "}, {Props: testItalic, Text: "wödlr"}},
+		},
+	}
+
+	for nTest, test := range tests {
+		if !test.got.VisiblyEquals(test.expected) {
+			t.Errorf("(test %d) Bad replacement: expected %#v, got %#v", nTest, test.expected, test.got)
+		}
+	}
+}
+
+func TestMessage_FindRegexp(t *testing.T) {
+	re := regexp.MustCompile(`[éö]\pL`)
+
+	indices := sliceTestMessage.FindAllRegexpIndex(re, -1)
+	if len(indices) != 2 || indices[0][0] != 1 || indices[0][1] != 3 || indices[1][0] != 7 || indices[1][1] != 9 {
+		t.Errorf("Bad match indices: %v", indices)
+	}
+
+	found := sliceTestMessage.FindAllRegexp(re, -1)
+	if len(found) != 2 || !found[1].VisiblyEquals(Message{{Props: testItalic, Text: "ör"}}) {
+		t.Errorf("Bad matches: %#v", found)
+	}
+
+	groups := sliceTestMessage.FindRegexpSubmatch(regexp.MustCompile(`(o) (x)?(w)`))
+	if len(groups) != 4 || groups[2] != nil ||
+		!groups[0].VisiblyEquals(Message{{Props: testBold, Text: "o "}, {Props: testItalic, Text: "w"}}) ||
+		!groups[3].VisiblyEquals(Message{{Props: testItalic, Text: "w"}}) {
+		t.Errorf("Bad submatches: %#v", groups)
+	}
+}
@@ -0,0 +1,199 @@
+package message
+
+import (
+	"strings"
+	"unicode"
+)
+
+//span is a formatting construct of a markup language that has to be opened and closed around text, like <b>...</b>
+type span struct {
+	prop  PropertyList
+	color Color
+}
+
+//spanWriter renders messages to markup languages in which formatting has to be properly nested
+type spanWriter struct {
+	//mask removes the properties that the language can't represent before rendering
+	mask PropertyList
+
+	//spans returns the spans for a style, ordered from the outermost to the innermost
+	spans func(style Style) []span
+
+	//innermost returns whether nothing can be opened inside the span, such spans are closed after every node
+	innermost func(s span) bool
+
+	//open returns the strings that open and close the span around the given text
+	open func(s span, text string) (string, string)
+
+	//text escapes text, spans contains the spans the text is rendered in
+	text func(text string, spans []span) string
+
+	//annotate wraps the rendered text of links and mentions
+	annotate func(node MessageNode, rendered string) string
+
+	//block renders a code block, spans are closed around it and it is put on its own lines
+	block func(node MessageNode) string
+
+	//hoistSpaces moves whitespace at the edges of nodes out of spans since some languages don't allow spans to start or end with whitespace
+	hoistSpaces bool
+}
+
+func containsSpan(spans []span, s span) bool {
+	for _, v := range spans {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func (writer spanWriter) render(msg Message) string {
+	type renderNode struct {
+		MessageNode
+		style Style
+		spans []span
+	}
+
+	masked := msg.Flatten()
+	for k := range masked {
+		masked[k].Props.EnableList &= writer.mask
+		if writer.mask&EMPropForeground == 0 {
+			masked[k].Props.Foreground = NoColor
+		}
+		if writer.mask&EMPropBackground == 0 {
+			masked[k].Props.Background = NoColor
+		}
+	}
+
+	nodes := make([]renderNode, 0, len(masked))
+	masked.normalize().walkNodes(func(node MessageNode, current, last Style) {
+		nodes = append(nodes, renderNode{node, current, writer.spans(current)})
+	})
+
+	IsBlank := func(node renderNode) bool {
+		return writer.hoistSpaces && node.Kind == NodeText && len(strings.TrimFunc(node.Text, unicode.IsSpace)) == 0
+	}
+
+	//RunLength returns for how many nodes starting at i the span stays, spans that stay longer are opened first
+	RunLength := func(i int, s span) int {
+		n := 0
+		for ; i < len(nodes); i++ {
+			if IsBlank(nodes[i]) {
+				continue
+			}
+			if nodes[i].Kind == NodeCodeBlock || !containsSpan(nodes[i].spans, s) {
+				break
+			}
+			n++
+		}
+		return n
+	}
+
+	type openSpan struct {
+		span  span
+		close string
+	}
+
+	builder := strings.Builder{}
+	stack := make([]openSpan, 0)
+	pending := ""
+	afterBlock := false
+
+	StartLine := func() {
+		if builder.Len() != 0 && !strings.HasSuffix(builder.String(), "\n") {
+			builder.WriteByte('\n')
+		}
+	}
+
+	CloseDownTo := func(n int) {
+		for i := len(stack) - 1; i >= n; i-- {
+			builder.WriteString(stack[i].close)
+		}
+		stack = stack[:n]
+	}
+
+	for i, node := range nodes {
+		if node.Kind == NodeCodeBlock {
+			CloseDownTo(0)
+			builder.WriteString(pending)
+			pending = ""
+
+			StartLine()
+			builder.WriteString(writer.block(node.MessageNode))
+			afterBlock = true
+			continue
+		}
+
+		lead, core, trail := "", node.Text, ""
+
+		if writer.hoistSpaces {
+			if IsBlank(node) {
+				pending += core
+				continue
+			}
+
+			trimmed := strings.TrimLeftFunc(core, unicode.IsSpace)
+			lead, core = core[:len(core)-len(trimmed)], trimmed
+			trimmed = strings.TrimRightFunc(core, unicode.IsSpace)
+			core, trail = trimmed, core[len(trimmed):]
+		}
+
+		keep := 0
+		for keep < len(stack) && containsSpan(node.spans, stack[keep].span) && !writer.innermost(stack[keep].span) {
+			keep++
+		}
+		CloseDownTo(keep)
+
+		if afterBlock && !strings.HasPrefix(pending+lead+core, "\n") {
+			StartLine()
+		}
+		afterBlock = false
+
+		builder.WriteString(pending)
+		builder.WriteString(lead)
+		pending = trail
+
+		missing := make([]span, 0)
+		for _, s := range node.spans {
+			found := false
+			for _, opened := range stack {
+				if opened.span == s {
+					found = true
+					break
+				}
+			}
+			if !found {
+				missing = append(missing, s)
+			}
+		}
+
+		//stable insertion sort, longer runs first and innermost spans last
+		for j := 1; j < len(missing); j++ {
+			for k := j; k > 0; k-- {
+				a, b := missing[k-1], missing[k]
+				aInner, bInner := writer.innermost(a), writer.innermost(b)
+				if aInner == bInner && RunLength(i, a) >= RunLength(i, b) || !aInner && bInner {
+					break
+				}
+				missing[k-1], missing[k] = b, a
+			}
+		}
+
+		for _, s := range missing {
+			open, close := writer.open(s, core)
+			builder.WriteString(open)
+			stack = append(stack, openSpan{s, close})
+		}
+
+		text := writer.text(core, node.spans)
+		if node.Kind != NodeText {
+			text = writer.annotate(node.MessageNode, text)
+		}
+		builder.WriteString(text)
+	}
+
+	CloseDownTo(0)
+	builder.WriteString(pending)
+
+	return builder.String()
+}
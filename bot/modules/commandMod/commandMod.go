@@ -144,6 +144,11 @@ func (mod *CommandModule) OnRegister(bus *mbus.Bus) {
 	log.Println("Command module registered")
 }
 
+//Subscriptions makes the module receive chat messages besides the requests and control messages targeted at it
+func (mod *CommandModule) Subscriptions() []mbus.Subscription {
+	return []mbus.Subscription{{Types: []int{mbus.MTypIncomingChat}}}
+}
+
 func (mod *CommandModule) OnUnregister() {
 	log.Println("Command module unregistered")
 }
@@ -176,36 +181,19 @@ func (mod *CommandModule) OnMessage(msg mbus.Message) {
 
 			command.Callback(tokens, inChatMessage, mod.bus)
 		}
+	} else if request, ok := msg.(mbus.RequestMessage); ok {
+		mod.handleRequest(request)
 	} else if controlMessage, ok := msg.(mbus.ModuleControlMessage); ok {
 		if controlMessage.StrArgv[0] == "setperm" {
 			mod.SetUserPerm(controlMessage.StrArgv[1], controlMessage.OtherData["level"].(int))
 			return
 		}
 		if controlMessage.StrArgv[0] == "gen_token" {
-			randToken := randomString(12)
-			mod.tokenStore[controlMessage.OtherData["sender_identity"].(string)] = randToken
-			log.Printf("Admin token for user: %s is: %s", controlMessage.OtherData["sender_identity"], randToken)
-
-			// log.Println(mod.tokenStore)
-
+			mod.genToken(controlMessage.OtherData["sender_identity"].(string))
 			return
 		}
 		if controlMessage.StrArgv[0] == "auth_token" {
-			log.Printf("Authenticating token for user: %s", controlMessage.OtherData["sender_identity"])
-			// Check we have a token in memory
-			if len(mod.tokenStore[controlMessage.OtherData["sender_identity"].(string)]) > 0 {
-				if mod.tokenStore[controlMessage.OtherData["sender_identity"].(string)] == controlMessage.StrArgv[1] {
-					log.Println("Success! User authed with token!")
-					// Give max permissions?
-					mod.SetUserPerm(controlMessage.OtherData["sender_identity"].(string), 9000)
-					return
-				} else {
-					log.Println("Failed! Auth token mismatch")
-				}
-			} else {
-				log.Println("No token found for sender ...")
-			}
-
+			_ = mod.authToken(controlMessage.OtherData["sender_identity"].(string), controlMessage.StrArgv[1])
 			return
 		}
 	}
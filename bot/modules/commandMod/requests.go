@@ -0,0 +1,88 @@
+package commandMod
+
+import (
+	"errors"
+	"log"
+
+	"github.com/xor-shift/Shiba/bot/mbus"
+)
+
+const (
+	//AdminPermLevel is granted to users that authenticate with a token
+	AdminPermLevel = 9000
+)
+
+var (
+	ErrNoToken       = errors.New("no token was generated for the user")
+	ErrTokenMismatch = errors.New("token mismatch")
+	ErrUnknownAction = errors.New("unknown request")
+)
+
+//SetPermRequest sets the permission level of a user, it's answered with a nil reply
+type SetPermRequest struct {
+	UserIdent string
+	Level     int
+}
+
+func (req SetPermRequest) GetType() int { return mbus.MTypGeneric }
+
+//GenTokenRequest generates a token that the user can authenticate with, the token is only logged on the bot's side
+type GenTokenRequest struct {
+	UserIdent string
+}
+
+func (req GenTokenRequest) GetType() int { return mbus.MTypGeneric }
+
+//AuthTokenRequest grants AdminPermLevel to the user if the token matches the generated one
+type AuthTokenRequest struct {
+	UserIdent string
+	Token     string
+}
+
+func (req AuthTokenRequest) GetType() int { return mbus.MTypGeneric }
+
+func init() {
+	mbus.RegisterMessageType("command.set_perm", SetPermRequest{})
+	mbus.RegisterMessageType("command.gen_token", GenTokenRequest{})
+	mbus.RegisterMessageType("command.auth_token", AuthTokenRequest{})
+}
+
+func (mod *CommandModule) genToken(userIdent string) {
+	randToken := randomString(12)
+	mod.tokenStore[userIdent] = randToken
+	log.Printf("Admin token for user: %s is: %s", userIdent, randToken)
+}
+
+func (mod *CommandModule) authToken(userIdent, token string) error {
+	log.Printf("Authenticating token for user: %s", userIdent)
+
+	// Check we have a token in memory
+	if len(mod.tokenStore[userIdent]) == 0 {
+		log.Println("No token found for sender ...")
+		return ErrNoToken
+	}
+
+	if mod.tokenStore[userIdent] != token {
+		log.Println("Failed! Auth token mismatch")
+		return ErrTokenMismatch
+	}
+
+	log.Println("Success! User authed with token!")
+	mod.SetUserPerm(userIdent, AdminPermLevel)
+	return nil
+}
+
+func (mod *CommandModule) handleRequest(request mbus.RequestMessage) {
+	switch payload := request.Payload.(type) {
+	case SetPermRequest:
+		mod.SetUserPerm(payload.UserIdent, payload.Level)
+		mod.bus.Reply(request, nil, nil)
+	case GenTokenRequest:
+		mod.genToken(payload.UserIdent)
+		mod.bus.Reply(request, nil, nil)
+	case AuthTokenRequest:
+		mod.bus.Reply(request, nil, mod.authToken(payload.UserIdent, payload.Token))
+	default:
+		mod.bus.Reply(request, nil, ErrUnknownAction)
+	}
+}
@@ -19,6 +19,9 @@ func (mod *PingModule) GetIdentifier() mbus.ModuleIdentifier {
 
 func (plat *PingModule) OnRegister(bus *mbus.Bus) {
 	plat.bus = bus
+	if err := mbus.Subscribe(bus, plat, plat.onChatMessage); err != nil {
+		log.Printf("Ping module failed to subscribe to chat messages: %s", err)
+	}
 	log.Println("Ping module registered")
 }
 
@@ -26,15 +29,16 @@ func (plat *PingModule) OnUnregister() {
 	log.Println("Ping module unregistered")
 }
 
-func (plat *PingModule) OnMessage(msg mbus.Message) {
-	if msg, ok := msg.(mbus.IncomingChatMessage); ok {
-		text := message.MessageToPlaintext(msg.Message)
-		if text == "Ping" || text == "ping" {
-			plat.bus.NewMessage(mbus.OutgoingChatMessage{
-				TargetModule: msg.SourceModule,
-				To:           msg.ReplyTo,
-				Message:      message.PlaintextToMessage("Pong"),
-			})
-		}
+//OnMessage only gets the messages targeted at the module, chat messages go to onChatMessage
+func (plat *PingModule) OnMessage(msg mbus.Message) {}
+
+func (plat *PingModule) onChatMessage(msg mbus.IncomingChatMessage) {
+	text := message.MessageToPlaintext(msg.Message)
+	if text == "Ping" || text == "ping" {
+		plat.bus.NewMessage(mbus.OutgoingChatMessage{
+			TargetModule: msg.SourceModule,
+			To:           msg.ReplyTo,
+			Message:      message.PlaintextToMessage("Pong"),
+		})
 	}
 }
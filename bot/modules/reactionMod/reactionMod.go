@@ -7,11 +7,13 @@ import (
 	"math/rand"
 	"regexp"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/jmoiron/sqlx"
 	"github.com/xor-shift/Shiba/bot/mbus"
 	"github.com/xor-shift/Shiba/bot/message"
+	"github.com/xor-shift/Shiba/common/irc"
 )
 
 type DBReaction struct {
@@ -61,9 +63,11 @@ func New(db *sqlx.DB) *ReactionModule {
 			log.Fatalln(err)
 		}
 
+		replyIdent := foldScope(reac.ReplyTarget)
+
 		// Create reaction store entry if not exists
-		if _, targetExists := mod.reactionStore[reac.ReplyTarget]; !targetExists {
-			mod.reactionStore[reac.ReplyTarget] = make(map[string][]DBReaction)
+		if _, targetExists := mod.reactionStore[replyIdent]; !targetExists {
+			mod.reactionStore[replyIdent] = make(map[string][]DBReaction)
 		}
 
 		regex, err := regexp.Compile(reac.RegexStr)
@@ -72,10 +76,10 @@ func New(db *sqlx.DB) *ReactionModule {
 			continue
 		}
 		// Append reaction to reaction store entry
-		if arr, ok := mod.reactionStore[reac.ReplyTarget][reac.RegexStr]; ok {
-			mod.reactionStore[reac.ReplyTarget][reac.RegexStr] = append(arr, reac)
+		if arr, ok := mod.reactionStore[replyIdent][reac.RegexStr]; ok {
+			mod.reactionStore[replyIdent][reac.RegexStr] = append(arr, reac)
 		} else {
-			mod.reactionStore[reac.ReplyTarget][reac.RegexStr] = []DBReaction{reac}
+			mod.reactionStore[replyIdent][reac.RegexStr] = []DBReaction{reac}
 		}
 		mod.regexCache[reac.RegexStr] = regex
 	}
@@ -95,6 +99,11 @@ func (mod *ReactionModule) OnRegister(bus *mbus.Bus) {
 	log.Println("Reaction module registered")
 }
 
+//Subscriptions makes the module receive chat messages besides the control messages targeted at it
+func (mod *ReactionModule) Subscriptions() []mbus.Subscription {
+	return []mbus.Subscription{{Types: []int{mbus.MTypIncomingChat}}}
+}
+
 func (mod *ReactionModule) OnUnregister() {
 	log.Println("Reaction module unregistered")
 }
@@ -114,6 +123,29 @@ func (mod *ReactionModule) getReactionById(id int64) DBReaction {
 	return reac
 }
 
+//scopeKey is the key of the reactions for a reply target, the targets of IRC networks are casefolded so that "#Chan"
+//and "#chan" share their reactions
+//The casemapping of the network isn't known here, ASCII folding is the part every casemapping agrees on so it never
+//merges two different targets, db/001_casefold_reply_targets.sql folds the stored keys the same way
+func scopeKey(source mbus.ModuleIdentifier, replyTo string) string {
+	if source.MainIdent == "IRC" {
+		replyTo = irc.Casefold(irc.CaseMappingASCII, replyTo)
+	}
+
+	return source.String() + ":" + replyTo
+}
+
+//foldScope folds a key that was built without scopeKey, such as the ones in the database
+func foldScope(key string) string {
+	mainIdent, rest, _ := strings.Cut(key, ":")
+	subIdent, replyTo, ok := strings.Cut(rest, ":")
+	if !ok {
+		return key
+	}
+
+	return scopeKey(mbus.ModuleIdentifier{MainIdent: mainIdent, SubIdent: subIdent}, replyTo)
+}
+
 func (mod *ReactionModule) getAllReactions(replyIdent string) []DBReaction {
 	var result []DBReaction
 
@@ -162,7 +194,7 @@ func (mod *ReactionModule) getRegexEntries(replyIdent string, regexStr string) [
 func (mod *ReactionModule) OnMessage(msg mbus.Message) {
 	if incomingChatMessage, ok := msg.(mbus.IncomingChatMessage); ok {
 		text := message.MessageToPlaintext(incomingChatMessage.Message)
-		replyIdent := incomingChatMessage.SourceModule.String() + ":" + incomingChatMessage.ReplyTo
+		replyIdent := scopeKey(incomingChatMessage.SourceModule, incomingChatMessage.ReplyTo)
 		matches := mod.getMatchesFromText(replyIdent, text)
 
 		if len(matches) > 0 {
@@ -187,7 +219,7 @@ func (mod *ReactionModule) OnMessage(msg mbus.Message) {
 		if controlMessage.StrArgv[0] == "add" {
 			// log.Println("add reaction args:")
 			// log.Println(controlMessage.StrArgv)
-			whenReplyingTo := controlMessage.StrArgv[1]
+			whenReplyingTo := foldScope(controlMessage.StrArgv[1])
 			regexStr := controlMessage.StrArgv[2]
 			replyStr := controlMessage.StrArgv[3]
 			addedBy := controlMessage.StrArgv[4]
@@ -205,7 +237,7 @@ func (mod *ReactionModule) OnMessage(msg mbus.Message) {
 			// 4 - regexStr | or -id flag
 			// 5 - reaction id // prev flag can be ignored
 
-			replyIdent := controlMessage.StrArgv[1] + ":" + controlMessage.StrArgv[2]
+			replyIdent := scopeKey(mbus.ModuleIdentifierFromString(controlMessage.StrArgv[1]), controlMessage.StrArgv[2])
 
 			targetModule := mbus.ModuleIdentifierFromString(controlMessage.StrArgv[1])
 
@@ -253,7 +285,7 @@ func (mod *ReactionModule) OnMessage(msg mbus.Message) {
 			// 2 - reply to channel
 			// 3 - triggerStr
 
-			replyIdent := controlMessage.StrArgv[1] + ":" + controlMessage.StrArgv[2]
+			replyIdent := scopeKey(mbus.ModuleIdentifierFromString(controlMessage.StrArgv[1]), controlMessage.StrArgv[2])
 
 			targetModule := mbus.ModuleIdentifierFromString(controlMessage.StrArgv[1])
 
@@ -298,7 +330,7 @@ func (mod *ReactionModule) OnMessage(msg mbus.Message) {
 			// 1 - source module (network)
 			// 2 - reply to channel
 			// 3 - regexStr (optional)
-			replyIdent := controlMessage.StrArgv[1] + ":" + controlMessage.StrArgv[2]
+			replyIdent := scopeKey(mbus.ModuleIdentifierFromString(controlMessage.StrArgv[1]), controlMessage.StrArgv[2])
 
 			targetModule := mbus.ModuleIdentifierFromString(controlMessage.StrArgv[1])
 
@@ -5,11 +5,20 @@ import (
 	"github.com/xor-shift/Shiba/bot/message"
 	"github.com/xor-shift/Shiba/common/irc"
 	"log"
+	"strings"
+	"time"
+)
+
+const (
+	//QuitTimeout is how long the server gets to close the connection after QUIT when the platform is unregistered
+	QuitTimeout = 5 * time.Second
 )
 
 type Platform struct {
 	SubIdent string
 	Client   *irc.Client
+	//QuitMessage is sent with QUIT when the platform is unregistered
+	QuitMessage string
 }
 
 func New(subIdent string, conf irc.ClientConfig) (*Platform, error) {
@@ -31,55 +40,16 @@ func (plat *Platform) GetIdentifier() mbus.ModuleIdentifier {
 	}
 }
 
-func parseIRCMessage(str string) message.Message {
-	msg := make(message.Message, 0)
-
-	currentFormat := message.PropertyList(0)
-	currentText := make([]rune, 0)
-
-	formats := map[rune]message.PropertyList{
-		0x02: message.EMPropBold,
-		0x1D: message.EMPropItalic,
-		0x1F: message.EMPropUnderline,
-		0x1E: message.EMPropStrikeThrough,
-		0x11: message.EMPropMonospace,
-	}
-
-	TryAppend := func() bool {
-		if len(currentText) > 0 {
-			msg = append(msg, message.MessageNode{
-				Props: message.Properties{
-					EnableList:  currentFormat,
-					InheritList: 0,
-				},
-				Text: string(currentText),
-			})
-			return true
-		}
-		return false
-	}
-
-	for _, r := range str {
-		if f, ok := formats[r]; ok {
-			if TryAppend() {
-				currentText = make([]rune, 0)
-			}
-			currentFormat ^= f
-		} else {
-			currentText = append(currentText, r)
-		}
-	}
-
-	TryAppend()
-
-	return msg
-}
-
 func (plat *Platform) OnRegister(bus *mbus.Bus) {
 	plat.Client.SetMessageHandler(func(msg irc.Message) {
 		if msg.Command == "PRIVMSG" {
-			replyTarget := msg.Params[0]
-			if replyTarget == plat.Client.GetNick() {
+			//with echo-message our own messages are sent back to us, those shouldn't be treated as incoming
+			if plat.Client.EqualFold(irc.ParseSource(msg.Source)[0], plat.Client.GetNick()) {
+				return
+			}
+
+			replyTarget := msg.Param(0)
+			if plat.Client.EqualFold(replyTarget, plat.Client.GetNick()) {
 				replyTarget = irc.ParseSource(msg.Source)[0]
 			}
 
@@ -87,35 +57,88 @@ func (plat *Platform) OnRegister(bus *mbus.Bus) {
 				SourceModule: plat.GetIdentifier(),
 				SenderIdent:  plat.GetIdentifier().String() + ":" + msg.Source,
 				ReplyTo:      replyTarget,
-				Message:      parseIRCMessage(msg.Trailing),
+				Message:      message.IRCToMessage(msg.Param(1)),
+				Tags:         msg.Tags,
 			})
 		}
 	})
 
+	plat.Client.SetConnectionStateCallback(func(connected bool, reason error) {
+		if connected {
+			bus.NewMessage(mbus.PlatformConnectedMessage{SourceModule: plat.GetIdentifier()})
+			return
+		}
+
+		reasonStr := ""
+		if reason != nil {
+			reasonStr = reason.Error()
+		}
+
+		bus.NewMessage(mbus.PlatformDisconnectedMessage{
+			SourceModule: plat.GetIdentifier(),
+			Reason:       reasonStr,
+		})
+	})
+
+	//the client connects in the background, it is initialised again when the platform is restarted after OnUnregister quit
+	if err := plat.Client.Init(); err != nil {
+		log.Printf("Failed to initialise the IRC client: %s", err)
+	}
+
 	log.Println("IRC platform registered")
 }
 
 func (plat *Platform) OnUnregister() {
-	_ = plat.Client.Close()
+	if err := plat.Client.Quit(plat.QuitMessage, QuitTimeout); err != nil {
+		log.Printf("Error while closing the IRC connection: %s", err)
+	}
 	plat.Client.Wait()
 	log.Println("IRC platform unregistered")
 }
 
+//Subscriptions is empty, the platform only handles the messages targeted at it
+func (plat *Platform) Subscriptions() []mbus.Subscription {
+	return nil
+}
+
 func (plat *Platform) OnMessage(msg mbus.Message) {
 	if outChatMSG, ok := msg.(mbus.OutgoingChatMessage); ok {
-		plat.Client.SendMessage(irc.Message{
-			Command:  "PRIVMSG",
-			Params:   []string{outChatMSG.To},
-			Trailing: message.MessageToPlaintext(outChatMSG.Message),
-		})
-	} else if controlMSG, ok := msg.(mbus.ModuleControlMessage); ok {
+		text := message.MessageToIRC(plat.resolveMentions(outChatMSG.Message))
+		for _, line := range plat.Client.SplitMessage("PRIVMSG", outChatMSG.To, text) {
+			plat.Client.SendMessage(irc.Message{
+				Command:     "PRIVMSG",
+				Params:      []string{outChatMSG.To},
+				Trailing:    line,
+				HasTrailing: true,
+			})
+		}
+	} else if controlMSG, ok := msg.(mbus.ModuleControlMessage); ok && len(controlMSG.StrArgv) != 0 {
 		switch controlMSG.StrArgv[0] {
 		case "join":
+			if len(controlMSG.StrArgv) < 2 {
+				log.Println("IRC platform got a join without a channel")
+				return
+			}
 			plat.join(controlMSG.StrArgv[1])
 		}
 	}
 }
 
+//resolveMentions displays mentions of users of this network as their nicks so that they get highlighted
+func (plat *Platform) resolveMentions(msg message.Message) message.Message {
+	prefix := plat.GetIdentifier().String() + ":"
+	resolved := make(message.Message, len(msg))
+
+	for k, node := range msg {
+		if node.Kind == message.NodeMention && strings.HasPrefix(node.Target, prefix) {
+			node.Text = irc.ParseSource(strings.TrimPrefix(node.Target, prefix))[0]
+		}
+		resolved[k] = node
+	}
+
+	return resolved
+}
+
 func (plat *Platform) join(ch string) {
 	plat.Client.SendMessage(irc.Message{
 		Command: "JOIN",
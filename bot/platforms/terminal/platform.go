@@ -1,16 +1,49 @@
 package terminal
 
 import (
-	"github.com/xor-shift/Shiba/bot/mbus"
+	"bufio"
+	"errors"
+	"io"
 	"log"
+	"os"
+	"sync"
+
+	"github.com/xor-shift/Shiba/bot/mbus"
+	"github.com/xor-shift/Shiba/bot/message"
+)
+
+const (
+	//ReplyTarget is the reply target of every message read by the platform, reactions added locally are scoped to it
+	ReplyTarget = "local"
 )
 
+//Platform reads lines from Input as incoming chat messages and prints the chat messages sent to it to Output
 type Platform struct {
 	SubIdent string
+
+	Input  io.Reader
+	Output io.Writer
+	//DisableANSI prints messages as plaintext instead of rendering their formatting with ANSI escape sequences
+	DisableANSI bool
+
+	outputMutex *sync.Mutex
+	stopMutex   *sync.Mutex
+	stopped     bool
 }
 
+//New creates a platform that reads from the standard input and writes to the standard output
 func New(subIdent string) *Platform {
-	return &Platform{SubIdent: subIdent}
+	return NewWithIO(subIdent, os.Stdin, os.Stdout)
+}
+
+func NewWithIO(subIdent string, input io.Reader, output io.Writer) *Platform {
+	return &Platform{
+		SubIdent:    subIdent,
+		Input:       input,
+		Output:      output,
+		outputMutex: &sync.Mutex{},
+		stopMutex:   &sync.Mutex{},
+	}
 }
 
 func (plat *Platform) GetIdentifier() mbus.ModuleIdentifier {
@@ -20,14 +53,92 @@ func (plat *Platform) GetIdentifier() mbus.ModuleIdentifier {
 	}
 }
 
+//SenderIdent is the sender identity of every message read by the platform
+func (plat *Platform) SenderIdent() string {
+	return plat.GetIdentifier().String() + ":local"
+}
+
 func (plat *Platform) OnRegister(bus *mbus.Bus) {
+	plat.stopMutex.Lock()
+	plat.stopped = false
+	plat.stopMutex.Unlock()
+
+	go plat.inputWorker(bus)
+
 	log.Println("Terminal platform registered")
 }
 
+//OnUnregister stops publishing input, a read that is already blocking (e.g. on the standard input) can't be interrupted
+//so the worker exits after the next line
 func (plat *Platform) OnUnregister() {
+	plat.stopMutex.Lock()
+	plat.stopped = true
+	plat.stopMutex.Unlock()
+
 	log.Println("Terminal platform unregistered")
 }
 
-func (plat *Platform) OnMessage(message mbus.Message) {
-	log.Println(message)
+func (plat *Platform) isStopped() bool {
+	plat.stopMutex.Lock()
+	defer plat.stopMutex.Unlock()
+
+	return plat.stopped
+}
+
+func (plat *Platform) inputWorker(bus *mbus.Bus) {
+	scanner := bufio.NewScanner(plat.Input)
+
+	for scanner.Scan() {
+		if plat.isStopped() {
+			return
+		}
+
+		line := scanner.Text()
+		if len(line) == 0 {
+			continue
+		}
+
+		err := bus.NewMessage(mbus.IncomingChatMessage{
+			SourceModule: plat.GetIdentifier(),
+			SenderIdent:  plat.SenderIdent(),
+			ReplyTo:      ReplyTarget,
+			Message:      message.PlaintextToMessage(line),
+		})
+
+		if errors.Is(err, mbus.ErrBusStopped) {
+			return
+		} else if err != nil {
+			log.Printf("Terminal platform dropped a line: %s", err)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		log.Printf("Terminal platform stopped reading input: %s", err)
+	} else {
+		log.Println("Terminal platform reached the end of its input")
+	}
+}
+
+//Subscriptions is empty, the platform only handles the messages targeted at it
+func (plat *Platform) Subscriptions() []mbus.Subscription {
+	return nil
+}
+
+func (plat *Platform) OnMessage(msg mbus.Message) {
+	outChatMSG, ok := msg.(mbus.OutgoingChatMessage)
+	if !ok || plat.GetIdentifier().Compare(outChatMSG.TargetModule) != 2 {
+		return
+	}
+
+	text := message.MessageToANSI(outChatMSG.Message)
+	if plat.DisableANSI {
+		text = outChatMSG.Message.String()
+	}
+
+	plat.outputMutex.Lock()
+	defer plat.outputMutex.Unlock()
+
+	if _, err := io.WriteString(plat.Output, text+"\n"); err != nil {
+		log.Printf("Terminal platform failed to write a message: %s", err)
+	}
 }
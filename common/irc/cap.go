@@ -0,0 +1,226 @@
+package irc
+
+import (
+	"log"
+	"sort"
+	"strings"
+)
+
+var (
+	//DefaultCapabilities is the capability wishlist used when ClientConfig.Capabilities is nil
+	DefaultCapabilities = []string{
+		"server-time",
+		"message-tags",
+		"account-tag",
+		"echo-message",
+		"multi-prefix",
+		"away-notify",
+		"chghost",
+		"cap-notify",
+	}
+)
+
+const (
+	//capReqMaxLength is the maximum length of the capability list in a single CAP REQ, leaves room for the rest of the line
+	capReqMaxLength = 400
+)
+
+func parseCapabilityList(str string) map[string]string {
+	caps := make(map[string]string)
+
+	for _, v := range strings.Split(str, " ") {
+		if len(v) == 0 {
+			continue
+		}
+
+		key, val, _ := strings.Cut(v, "=")
+		caps[key] = val
+	}
+
+	return caps
+}
+
+func (client *Client) wantedCapabilities() []string {
+	wanted := client.config.Capabilities
+	if wanted == nil {
+		wanted = DefaultCapabilities
+	}
+
+	if len(client.saslMechanism()) != 0 && !listContains(wanted, "sasl") {
+		wanted = append(append([]string{}, wanted...), "sasl")
+	}
+
+	return wanted
+}
+
+//requestCapabilities sends CAP REQ for every wanted capability that the server offers and that is not already enabled, the state mutex must be held
+func (client *Client) requestCapabilities(offered map[string]string) {
+	toRequest := make([]string, 0)
+
+	for _, v := range client.wantedCapabilities() {
+		if _, ok := offered[v]; !ok {
+			continue
+		}
+
+		if _, ok := client.enabledCaps[v]; ok {
+			continue
+		}
+
+		toRequest = append(toRequest, v)
+	}
+
+	for len(toRequest) > 0 {
+		n, length := 0, 0
+		for ; n < len(toRequest); n++ {
+			if n != 0 && length+len(toRequest[n])+1 > capReqMaxLength {
+				break
+			}
+			length += len(toRequest[n]) + 1
+		}
+
+		client.pendingCapReqs++
+		client.SendMessage(Message{
+			Command:  "CAP",
+			Params:   []string{"REQ"},
+			Trailing: strings.Join(toRequest[:n], " "),
+		})
+
+		toRequest = toRequest[n:]
+	}
+}
+
+//maybeEndCapNegotiation sends CAP END if the registration is still being held and nothing else is pending, the state mutex must be held
+func (client *Client) maybeEndCapNegotiation() {
+	if !client.capNegotiating || client.pendingCapReqs > 0 || client.saslInProgress {
+		return
+	}
+
+	client.capNegotiating = false
+	client.SendMessage(Message{
+		Command: "CAP",
+		Params:  []string{"END"},
+	})
+}
+
+func (client *Client) handleCAP(message Message) {
+	client.stateMutex.Lock()
+	defer client.stateMutex.Unlock()
+
+	params := message.AllParams()
+	if len(params) < 2 {
+		return
+	}
+
+	subCommand := strings.ToUpper(params[1])
+	//multiline replies look like "CAP * LS * :caps", the last one omits the asterisk
+	continued := len(params) > 3 && params[2] == "*"
+	capList := params[len(params)-1]
+	if len(params) < 3 {
+		capList = ""
+	}
+
+	switch subCommand {
+	case "LS":
+		for k, v := range parseCapabilityList(capList) {
+			client.lsBuffer[k] = v
+		}
+
+		if continued {
+			return
+		}
+
+		for k, v := range client.lsBuffer {
+			client.serverInfo.Capabilities[k] = v
+		}
+		client.lsBuffer = make(map[string]string)
+
+		if _, ok := client.serverInfo.Capabilities["sasl"]; !ok && client.capNegotiating && len(client.saslMechanism()) != 0 {
+			client.failSASL(ErrSASLUnsupported)
+			return
+		}
+
+		client.requestCapabilities(client.serverInfo.Capabilities)
+		client.maybeEndCapNegotiation()
+
+	case "ACK":
+		for k := range parseCapabilityList(capList) {
+			if strings.HasPrefix(k, "-") {
+				delete(client.enabledCaps, k[1:])
+			} else {
+				client.enabledCaps[k] = struct{}{}
+
+				if k == "sasl" && client.capNegotiating && len(client.saslMechanism()) != 0 {
+					client.startSASL()
+				}
+			}
+		}
+
+		if !continued && client.pendingCapReqs > 0 {
+			client.pendingCapReqs--
+		}
+		client.maybeEndCapNegotiation()
+
+	case "NAK":
+		log.Println("IRC server rejected capabilities:", capList)
+
+		if _, ok := parseCapabilityList(capList)["sasl"]; ok && client.capNegotiating && len(client.saslMechanism()) != 0 {
+			client.failSASL(ErrSASLUnsupported)
+			return
+		}
+
+		if !continued && client.pendingCapReqs > 0 {
+			client.pendingCapReqs--
+		}
+		client.maybeEndCapNegotiation()
+
+	case "NEW":
+		newCaps := parseCapabilityList(capList)
+		for k, v := range newCaps {
+			client.serverInfo.Capabilities[k] = v
+		}
+
+		client.requestCapabilities(newCaps)
+
+	case "DEL":
+		for k := range parseCapabilityList(capList) {
+			delete(client.serverInfo.Capabilities, k)
+			delete(client.enabledCaps, k)
+		}
+	}
+}
+
+//HasCapability returns whether the given capability was negotiated with the server
+func (client *Client) HasCapability(capability string) bool {
+	client.stateMutex.RLock()
+	defer client.stateMutex.RUnlock()
+
+	_, ok := client.enabledCaps[capability]
+	return ok
+}
+
+//EnabledCapabilities returns a sorted list of the capabilities that were negotiated with the server
+func (client *Client) EnabledCapabilities() []string {
+	client.stateMutex.RLock()
+	defer client.stateMutex.RUnlock()
+
+	caps := make([]string, 0, len(client.enabledCaps))
+	for k := range client.enabledCaps {
+		caps = append(caps, k)
+	}
+	sort.Strings(caps)
+
+	return caps
+}
+
+//AvailableCapabilities returns a copy of the capabilities the server has advertised along with their values
+func (client *Client) AvailableCapabilities() map[string]string {
+	client.stateMutex.RLock()
+	defer client.stateMutex.RUnlock()
+
+	caps := make(map[string]string, len(client.serverInfo.Capabilities))
+	for k, v := range client.serverInfo.Capabilities {
+		caps[k] = v
+	}
+
+	return caps
+}
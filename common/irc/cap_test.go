@@ -0,0 +1,136 @@
+package irc
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+//newRegisteringClient returns a client in the state connect leaves it in before the server answers
+func newRegisteringClient(t *testing.T, conf ClientConfig) *Client {
+	conf.Address = "irc.example.com:6667"
+	if len(conf.Nick) == 0 {
+		conf.Nick = "me"
+	}
+
+	client, err := NewClient(conf)
+	if err != nil {
+		t.Fatalf("Failed to create a client: %s", err)
+	}
+
+	client.clientInfo.Nick = conf.Nick
+	client.capNegotiating = true
+	client.registering = true
+	client.registrationResult = make(chan error, 1)
+
+	return client
+}
+
+//feedLine parses a line and handles it as if the server had sent it
+func feedLine(t *testing.T, client *Client, line string) {
+	message, err := ParseLine([]byte(line))
+	if err != nil {
+		t.Fatalf("Failed to parse %q: %s", line, err)
+	}
+
+	client.parserHandler(message)
+}
+
+//sentLines returns the lines queued since the last call
+func sentLines(client *Client) []string {
+	lines := make([]string, 0)
+	conn := client.getConnection()
+
+	for {
+		select {
+		case message := <-conn.OutgoingChannel:
+			lines = append(lines, strings.TrimRight(string(message.Serialize()), "\r\n"))
+		default:
+			return lines
+		}
+	}
+}
+
+//registrationStep is a line from the server and the lines we are expected to answer with
+type registrationStep struct {
+	line string
+	sent []string
+}
+
+type capTest struct {
+	capabilities []string
+	steps        []registrationStep
+	enabled      []string
+}
+
+var capTests = []capTest{
+	//multiline LS, nothing is requested until the last line
+	{
+		steps: []registrationStep{
+			{":srv CAP * LS * :multi-prefix unknown-cap", []string{}},
+			{":srv CAP * LS :server-time echo-message sasl=PLAIN", []string{"CAP REQ :server-time echo-message multi-prefix"}},
+			{":srv CAP * ACK :server-time echo-message multi-prefix", []string{"CAP END"}},
+		},
+		enabled: []string{"echo-message", "multi-prefix", "server-time"},
+	},
+	//rejected requests end the negotiation as well
+	{
+		capabilities: []string{"away-notify", "chghost"},
+		steps: []registrationStep{
+			{":srv CAP * LS :away-notify chghost", []string{"CAP REQ :away-notify chghost"}},
+			{":srv CAP * NAK :away-notify chghost", []string{"CAP END"}},
+		},
+		enabled: []string{},
+	},
+	//nothing we want is offered
+	{
+		capabilities: []string{"away-notify"},
+		steps: []registrationStep{
+			{":srv CAP * LS :server-time", []string{"CAP END"}},
+		},
+		enabled: []string{},
+	},
+	//long lists are requested in several lines and the negotiation ends once every one of them is answered
+	{
+		capabilities: []string{strings.Repeat("a", 250), strings.Repeat("b", 250), "c"},
+		steps: []registrationStep{
+			{":srv CAP * LS :" + strings.Repeat("a", 250) + " " + strings.Repeat("b", 250) + " c", []string{
+				"CAP REQ :" + strings.Repeat("a", 250),
+				"CAP REQ :" + strings.Repeat("b", 250) + " c",
+			}},
+			{":srv CAP * ACK :" + strings.Repeat("a", 250), []string{}},
+			{":srv CAP * NAK :" + strings.Repeat("b", 250) + " c", []string{"CAP END"}},
+		},
+		enabled: []string{strings.Repeat("a", 250)},
+	},
+	//cap-notify after the registration
+	{
+		capabilities: []string{"away-notify", "chghost", "server-time"},
+		steps: []registrationStep{
+			{":srv CAP * LS :away-notify server-time", []string{"CAP REQ :away-notify server-time"}},
+			{":srv CAP * ACK :away-notify server-time", []string{"CAP END"}},
+			{":srv CAP me NEW :chghost batch", []string{"CAP REQ :chghost"}},
+			{":srv CAP me ACK :chghost -server-time", []string{}},
+			{":srv CAP me DEL :away-notify", []string{}},
+		},
+		enabled: []string{"chghost"},
+	},
+}
+
+func TestClient_HandleCAP(t *testing.T) {
+	for nTest, test := range capTests {
+		client := newRegisteringClient(t, ClientConfig{Capabilities: test.capabilities})
+
+		for nStep, step := range test.steps {
+			feedLine(t, client, step.line)
+
+			if got := sentLines(client); !reflect.DeepEqual(got, step.sent) {
+				t.Errorf("(test %d, step %d) Bad reply to %q: expected %q, got %q", nTest, nStep, step.line, step.sent, got)
+			}
+		}
+
+		if got := client.EnabledCapabilities(); !reflect.DeepEqual(got, test.enabled) {
+			t.Errorf("(test %d) Bad capabilities: expected %q, got %q", nTest, test.enabled, got)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package irc
+
+import "strings"
+
+const (
+	CaseMappingASCII         = "ascii"
+	CaseMappingRFC1459       = "rfc1459"
+	CaseMappingStrictRFC1459 = "strict-rfc1459"
+
+	//DefaultCaseMapping is used until the server announces its CASEMAPPING
+	DefaultCaseMapping = CaseMappingRFC1459
+)
+
+var (
+	rfc1459Folder = strings.NewReplacer(
+		"[", "{",
+		"]", "}",
+		"\\", "|",
+		"~", "^",
+	)
+
+	strictRFC1459Folder = strings.NewReplacer(
+		"[", "{",
+		"]", "}",
+		"\\", "|",
+	)
+)
+
+func asciiLower(str string) string {
+	for i := 0; i < len(str); i++ {
+		if c := str[i]; c >= 'A' && c <= 'Z' {
+			buf := []byte(str)
+			for j := i; j < len(buf); j++ {
+				if buf[j] >= 'A' && buf[j] <= 'Z' {
+					buf[j] += 'a' - 'A'
+				}
+			}
+			return string(buf)
+		}
+	}
+
+	return str
+}
+
+//Casefold folds a nick or a channel name according to a casemapping, unknown casemappings are treated as rfc1459
+func Casefold(caseMapping string, str string) string {
+	str = asciiLower(str)
+
+	switch caseMapping {
+	case CaseMappingASCII:
+		return str
+	case CaseMappingStrictRFC1459:
+		return strictRFC1459Folder.Replace(str)
+	default:
+		return rfc1459Folder.Replace(str)
+	}
+}
+
+//EqualFold returns whether two nicks or channel names are equal under a casemapping
+func EqualFold(caseMapping string, a, b string) bool {
+	return Casefold(caseMapping, a) == Casefold(caseMapping, b)
+}
@@ -0,0 +1,32 @@
+package irc
+
+import "testing"
+
+func TestCasefold(t *testing.T) {
+	tests := []struct {
+		caseMapping string
+		input       string
+		expected    string
+	}{
+		{CaseMappingRFC1459, `Nick[]\~`, `nick{}|^`},
+		{CaseMappingStrictRFC1459, `Nick[]\~`, `nick{}|~`},
+		{CaseMappingASCII, `Nick[]\~`, `nick[]\~`},
+		//unknown casemappings are treated as rfc1459
+		{"rfc7613", `Nick[]\~`, `nick{}|^`},
+		{"", `#Chan[x]`, `#chan{x}`},
+
+		{CaseMappingRFC1459, "#chan", "#chan"},
+		{CaseMappingRFC1459, "#ÇAN", "#Çan"},
+		{CaseMappingASCII, "", ""},
+	}
+
+	for nTest, test := range tests {
+		if got := Casefold(test.caseMapping, test.input); got != test.expected {
+			t.Errorf("(test %d) Casefold(%q, %q): expected %q, got %q", nTest, test.caseMapping, test.input, test.expected, got)
+		}
+
+		if !EqualFold(test.caseMapping, test.input, test.expected) {
+			t.Errorf("(test %d) Expected %q and %q to be equal under %q", nTest, test.input, test.expected, test.caseMapping)
+		}
+	}
+}
@@ -1,14 +1,20 @@
 package irc
 
 import (
-	"github.com/xor-shift/Shiba/common/ratelimit"
+	"crypto/tls"
+	"errors"
+	"fmt"
 	"log"
+	"math/rand"
 	"strconv"
-	"strings"
 	"sync"
 	"time"
 )
 
+var (
+	ErrClientRunning = errors.New("the client is already running")
+)
+
 type ClientConfig struct {
 	Address string
 	TLS     bool
@@ -17,21 +23,68 @@ type ClientConfig struct {
 	User     string
 	RealName string
 
+	//AltNicks are tried in order if Nick is taken during the registration
+	AltNicks []string
+	//NickRegainInterval is the interval in seconds between attempts to switch back to Nick, negative values disable periodic attempts
+	NickRegainInterval int
+
 	Pass string
 
+	//SASLMechanism is either PLAIN or EXTERNAL, if left empty PLAIN is used when an account and a password are set and SASL is disabled otherwise
+	SASLMechanism string
+	SASLAccount   string
+	SASLPassword  string
+
+	//TLSCertFile and TLSKeyFile point to a PEM encoded client certificate, used for SASL EXTERNAL or CertFP
+	TLSCertFile string
+	TLSKeyFile  string
+
+	//Capabilities is the list of capabilities to request if the server offers them, DefaultCapabilities is used if nil
+	Capabilities []string
+
 	PingFrequency int
 	PingTimeout   int
+
+	//ReconnectMinDelay and ReconnectMaxDelay bound the exponential backoff between reconnection attempts, in seconds
+	ReconnectMinDelay int
+	ReconnectMaxDelay int
 }
 
 type ServerInformation struct {
 	Capabilities map[string]string
-	Modes        map[string]*ModeStore
+	//ISupport holds the raw tokens of RPL_ISUPPORT (005), the fields below are derived from it
+	ISupport map[string]string
+
+	//ChannelTypes holds the characters that channel names start with
+	ChannelTypes string
+	//PrefixModes and PrefixSymbols hold the channel membership modes and their symbols, ordered by rank ("ov" and "@+")
+	PrefixModes   string
+	PrefixSymbols string
+	ChannelModes  ChannelModeTypes
+	CaseMapping   string
+	//NickLen is zero if the server did not announce it
+	NickLen int
+	//TargMax maps commands to the maximum number of targets they accept, zero means unlimited
+	TargMax map[string]int
 }
 
 func NewServerInformation() ServerInformation {
 	return ServerInformation{
 		Capabilities: make(map[string]string),
-		Modes:        make(map[string]*ModeStore),
+		ISupport:     make(map[string]string),
+
+		ChannelTypes:  "#&",
+		PrefixModes:   "ov",
+		PrefixSymbols: "@+",
+		ChannelModes: ChannelModeTypes{
+			List:   "beI",
+			Always: "k",
+			OnSet:  "l",
+			Never:  "imnpst",
+		},
+		CaseMapping: DefaultCaseMapping,
+		NickLen:     0,
+		TargMax:     make(map[string]int),
 	}
 }
 
@@ -39,6 +92,8 @@ type ClientInformation struct {
 	Nick          string
 	User          string
 	DisplayedHost string
+	Account       string
+	Modes         ModeStore
 }
 
 func NewClientInformation() ClientInformation {
@@ -46,33 +101,77 @@ func NewClientInformation() ClientInformation {
 		Nick:          "",
 		User:          "",
 		DisplayedHost: "",
+		Account:       "",
+		Modes:         NewModeStore(),
 	}
 }
 
 type Client struct {
-	config ClientConfig
+	config      ClientConfig
+	certificate *tls.Certificate
 
 	workersWG *sync.WaitGroup
 
-	outgoingQueue chan Message
-
-	pingTicker       *time.Ticker
-	pingTimeoutTimer *time.Timer
-
-	rateLimiter ratelimit.Bucket
-	connection  *Connection
-	parser      *Parser
+	//connMutex guards the current connection, it is replaced on every reconnection
+	connMutex  *sync.Mutex
+	connection *Connection
+	//running is set while the supervisor started by Init runs, done is closed to stop it and replaced by the next Init
+	running bool
+	done    chan struct{}
 
+	//stateMutex guards clientInfo, serverInfo and the negotiation state below
+	stateMutex *sync.RWMutex
 	clientInfo ClientInformation
 	serverInfo ServerInformation
+	connected  bool
+	//selfSourceKnown is set once the server tells us our own user and host
+	selfSourceKnown bool
+
+	channels    map[string]*Channel
+	users       map[string]*User
+	namesBuffer map[string]map[string]ChannelMember
+	listBuffer  map[string]map[rune][]string
+
+	enabledCaps    map[string]struct{}
+	lsBuffer       map[string]string
+	pendingCapReqs int
+	capNegotiating bool
+	saslInProgress bool
+
+	//registrationResult receives the outcome of the registration, nil on RPL_WELCOME
+	registrationResult chan error
+	registering        bool
+	nickAttempt        int
+	monitoringNick     bool
+	//regainFailed is set once an attempt to regain the primary nick has failed and been logged
+	regainFailed bool
 
 	callbacksMutex *sync.RWMutex
 	passthroughCB  func(message Message)
 	postInitCB     func()
+	connStateCB    func(connected bool, reason error)
 }
 
 func NewClient(conf ClientConfig) (*Client, error) {
-	conn := NewConnection(conf.TLS, conf.Address)
+	if err := validateSASL(conf); err != nil {
+		return nil, err
+	}
+
+	var certificate *tls.Certificate
+
+	if len(conf.TLSCertFile) != 0 {
+		keyFile := conf.TLSKeyFile
+		if len(keyFile) == 0 {
+			keyFile = conf.TLSCertFile
+		}
+
+		cert, err := tls.LoadX509KeyPair(conf.TLSCertFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+
+		certificate = &cert
+	}
 
 	if conf.PingFrequency == 0 {
 		conf.PingFrequency = 60
@@ -82,42 +181,109 @@ func NewClient(conf ClientConfig) (*Client, error) {
 		conf.PingTimeout = 120
 	}
 
+	if conf.NickRegainInterval == 0 {
+		conf.NickRegainInterval = 60
+	}
+
+	if conf.ReconnectMinDelay == 0 {
+		conf.ReconnectMinDelay = 5
+	}
+
+	if conf.ReconnectMaxDelay == 0 {
+		conf.ReconnectMaxDelay = 300
+	}
+
 	client := &Client{
-		config: conf,
+		config:      conf,
+		certificate: certificate,
 
 		workersWG: &sync.WaitGroup{},
 
-		outgoingQueue:    make(chan Message, 32),
-		pingTicker:       time.NewTicker(time.Second * (time.Duration)(conf.PingFrequency)),
-		pingTimeoutTimer: time.NewTimer(time.Second * (time.Duration)(conf.PingTimeout)),
-
-		rateLimiter: ratelimit.NewBucket(16, 500),
-		connection:  conn,
-		parser:      NewParser(),
+		connMutex:  &sync.Mutex{},
+		connection: NewConnection(conf.TLS, conf.Address),
+		done:       make(chan struct{}),
 
+		stateMutex: &sync.RWMutex{},
 		serverInfo: NewServerInformation(),
 		clientInfo: NewClientInformation(),
 
+		enabledCaps: make(map[string]struct{}),
+		lsBuffer:    make(map[string]string),
+
 		callbacksMutex: &sync.RWMutex{},
 		passthroughCB:  func(message Message) {},
 		postInitCB:     func() {},
+		connStateCB:    func(connected bool, reason error) {},
 	}
 
-	client.clientInfo.Nick = conf.Nick
-	client.clientInfo.User = conf.User
-
-	client.connection.SetIncomingCallback(client.parserHandler)
+	client.resetTracking()
 
 	return client, nil
 }
 
+//Init starts a supervisor that connects and registers to the server in the background and reconnects whenever the
+//connection drops, a server that can't be reached is retried with the same backoff as reconnections
+//A client that was closed can be initialised again once Wait returns
 func (client *Client) Init() error {
-	if err := client.connection.Init(); err != nil {
-		return err
+	client.connMutex.Lock()
+	defer client.connMutex.Unlock()
+
+	if client.running {
+		return ErrClientRunning
 	}
+	client.running = true
+	client.done = make(chan struct{})
+
+	client.workersWG.Add(1)
+	go client.supervisor(client.done)
 
-	time.NewTimer(time.Second * 60)
-	time.NewTicker(time.Second * 60)
+	return nil
+}
+
+//connect establishes a new connection, resets the per-connection state and registers
+func (client *Client) connect(done <-chan struct{}) error {
+	pingTimeout := time.Second * (time.Duration)(client.config.PingTimeout)
+	pingTimeoutTimer := time.NewTimer(pingTimeout)
+
+	conn := NewConnection(client.config.TLS, client.config.Address)
+	if client.certificate != nil {
+		conn.SetClientCertificate(*client.certificate)
+	}
+	//only what this connection receives keeps it alive, a connection being replaced mustn't hold off the timeout of the next one
+	conn.SetIncomingCallback(func(message Message) {
+		pingTimeoutTimer.Reset(pingTimeout)
+		client.parserHandler(message)
+	})
+
+	client.stateMutex.Lock()
+	client.serverInfo = NewServerInformation()
+	client.clientInfo = NewClientInformation()
+	client.clientInfo.Nick = client.config.Nick
+	client.clientInfo.User = client.config.User
+	client.connected = false
+	client.selfSourceKnown = false
+	client.resetTracking()
+	client.enabledCaps = make(map[string]struct{})
+	client.lsBuffer = make(map[string]string)
+	client.pendingCapReqs = 0
+	client.capNegotiating = true
+	client.saslInProgress = false
+	client.registering = true
+	client.registrationResult = make(chan error, 1)
+	client.nickAttempt = 0
+	client.monitoringNick = false
+	client.regainFailed = false
+	client.stateMutex.Unlock()
+
+	client.connMutex.Lock()
+	client.connection = conn
+	client.connMutex.Unlock()
+
+	if err := conn.Init(); err != nil {
+		pingTimeoutTimer.Stop()
+		_ = conn.Close()
+		return err
+	}
 
 	initialMessages := []Message{
 		Message{
@@ -133,116 +299,233 @@ func (client *Client) Init() error {
 			Trailing: "",
 		},
 		Message{
-			Source:   "",
-			Command:  "USER",
-			Params:   []string{client.config.User, "iwxz", "*", client.config.RealName},
-			Trailing: "",
+			Source:      "",
+			Command:     "USER",
+			Params:      []string{client.config.User, "iwxz", "*"},
+			Trailing:    client.config.RealName,
+			HasTrailing: true,
 		},
 	}
 
+	if len(client.config.Pass) != 0 {
+		initialMessages = append([]Message{{Command: "PASS", Params: []string{client.config.Pass}}}, initialMessages...)
+	}
+
 	for _, msg := range initialMessages {
-		client.outgoingQueue <- msg
 		client.SendMessage(msg)
 	}
 
-	client.workersWG.Add(1)
-	go client.pingWorker()
+	if err := client.waitForRegistration(conn, done); err != nil {
+		pingTimeoutTimer.Stop()
+		_ = conn.Close()
+		conn.Wait()
+		return err
+	}
+
+	client.stateMutex.Lock()
+	client.connected = true
+	client.stateMutex.Unlock()
+
+	client.workersWG.Add(2)
+	go client.pingWorker(conn, pingTimeoutTimer)
+	go client.nickRegainWorker(conn)
 
 	return nil
 }
 
-func (client *Client) receiver() {
-	defer client.workersWG.Done()
+//waitForRegistration blocks until the server welcomes us, the registration fails, the connection drops or PingTimeout seconds pass
+func (client *Client) waitForRegistration(conn *Connection, done <-chan struct{}) error {
+	timeout := time.NewTimer(time.Second * (time.Duration)(client.config.PingTimeout))
+	defer timeout.Stop()
 
-	buffer := make([]byte, 256)
+	var err error
 
-	for {
-		n, err := client.connection.Read(buffer)
-		if err != nil {
-			log.Println("IRC message receiver got error:", err)
-			break
-		}
+	select {
+	case err = <-client.registrationResult:
+		return err
+	case <-conn.Closed():
+		err = fmt.Errorf("connection closed during registration: %v", conn.Err())
+	case <-timeout.C:
+		err = errors.New("timed out while waiting for the IRC registration to complete")
+	case <-done:
+		err = errors.New("client was closed during registration")
+	}
 
-		if _, err := client.parser.Write(buffer[:n]); err != nil {
-			log.Println("Faulty message received, error:", err)
-		}
+	client.stateMutex.Lock()
+	client.registering = false
+	client.stateMutex.Unlock()
+
+	return err
+}
+
+//finishRegistration reports the result of the registration to connect, the state mutex must be held
+func (client *Client) finishRegistration(err error) {
+	if !client.registering {
+		return
 	}
+
+	client.registering = false
+	client.registrationResult <- err
 }
 
-func (client *Client) sender() {
+//reconnectDelay returns the delay before the given (zero indexed) reconnection attempt, an exponential backoff with jitter
+func (client *Client) reconnectDelay(attempt int) time.Duration {
+	minDelay := time.Second * (time.Duration)(client.config.ReconnectMinDelay)
+	maxDelay := time.Second * (time.Duration)(client.config.ReconnectMaxDelay)
+
+	delay := minDelay
+	for i := 0; i < attempt && delay < maxDelay; i++ {
+		delay *= 2
+	}
+
+	if delay > maxDelay {
+		delay = maxDelay
+	}
+
+	//"equal jitter", somewhere between half of the delay and the full delay
+	half := delay / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
+
+func (client *Client) supervisor(done <-chan struct{}) {
 	defer client.workersWG.Done()
+	defer func() {
+		client.stateMutex.Lock()
+		client.connected = false
+		client.stateMutex.Unlock()
+
+		client.connMutex.Lock()
+		client.running = false
+		client.connMutex.Unlock()
+	}()
+
+	for first := true; ; first = false {
+		if !client.connectWithBackoff(done, first) {
+			return
+		}
+
+		if first {
+			log.Printf("Connected to %s", client.config.Address)
+		} else {
+			log.Printf("Reconnected to %s", client.config.Address)
+		}
+		client.notifyConnectionState(true, nil)
+
+		conn := client.getConnection()
 
-	running := true
-	for running {
 		select {
-		case msg, ok := <-client.outgoingQueue:
-			if !ok {
-				running = false
-				break
-			}
+		case <-done:
+			return
+		case <-conn.Closed():
+		}
 
-			if !client.rateLimiter.NewDrop() {
-				log.Println("Rate limited an IRC message")
+		conn.Wait()
+
+		client.stateMutex.Lock()
+		client.connected = false
+		client.stateMutex.Unlock()
+
+		reason := conn.Err()
+		log.Printf("Disconnected from %s: %v", client.config.Address, reason)
+		client.notifyConnectionState(false, reason)
+	}
+}
+
+//connectWithBackoff connects until it succeeds or the client is closed, in which case it returns false
+//Only the first connection is attempted right away, reconnections and failed attempts wait for reconnectDelay
+func (client *Client) connectWithBackoff(done <-chan struct{}, immediately bool) bool {
+	for attempt := 0; ; attempt++ {
+		if attempt != 0 || !immediately {
+			backoffAttempt := attempt
+			if immediately {
+				backoffAttempt--
 			}
 
-			if _, err := client.connection.Write(msg.Serialize()); err != nil {
-				log.Println("Error while sending IRC message:", err)
+			delay := client.reconnectDelay(backoffAttempt)
+			log.Printf("Connecting to %s in %s (attempt %d)", client.config.Address, delay.Round(time.Millisecond), attempt+1)
+
+			timer := time.NewTimer(delay)
+			select {
+			case <-done:
+				timer.Stop()
+				return false
+			case <-timer.C:
 			}
 		}
+
+		select {
+		case <-done:
+			return false
+		default:
+		}
+
+		if err := client.connect(done); err != nil {
+			log.Printf("Connection attempt to %s failed: %s", client.config.Address, err)
+			continue
+		}
+
+		return true
 	}
 }
 
+func (client *Client) notifyConnectionState(connected bool, reason error) {
+	client.callbacksMutex.RLock()
+	defer client.callbacksMutex.RUnlock()
+	client.connStateCB(connected, reason)
+}
+
+func (client *Client) getConnection() *Connection {
+	client.connMutex.Lock()
+	defer client.connMutex.Unlock()
+	return client.connection
+}
+
 func (client *Client) parserHandler(message Message) {
+	client.handleStateMessage(message)
+	client.handleNickMessage(message)
+
 	switch message.Command {
 	case "PING":
 		client.SendMessage(Message{
-			Source:   "",
-			Command:  "PONG",
-			Params:   []string{},
-			Trailing: message.Trailing,
+			Source:      "",
+			Command:     "PONG",
+			Params:      []string{},
+			Trailing:    message.Param(0),
+			HasTrailing: true,
 		})
-		client.pingTimeoutTimer.Reset(time.Second * (time.Duration)(client.config.PingTimeout))
 
 	case "CAP":
-		if message.Params[0] == "*" && message.Params[1] == "LS" {
-			capabilities := strings.Split(message.Trailing, " ")
-			for _, v := range capabilities {
-				key := ""
-				val := ""
-				if strings.Contains(v, "=") {
-					parts := strings.Split(v, "=")
-					key = parts[0]
-					val = parts[1]
-				} else {
-					key = v
-				}
-				client.serverInfo.Capabilities[key] = val
-			}
+		client.handleCAP(message)
 
-			client.SendMessage(Message{
-				Source:   "",
-				Command:  "CAP",
-				Params:   []string{"END"},
-				Trailing: "",
-			})
-		}
+	case "AUTHENTICATE", "900", "901", "902", "903", "904", "905", "906", "907", "908":
+		client.handleSASL(message)
 
-	case "396":
-		client.clientInfo.DisplayedHost = message.Params[1]
+	case "001": //RPL_WELCOME
+		client.stateMutex.Lock()
+		client.clientInfo.Nick = message.Param(0)
+		client.finishRegistration(nil)
+		client.stateMutex.Unlock()
 
-	case "MODE":
-		nick := message.Params[0]
-		modeStr := message.Trailing
+	case "ERROR":
+		client.stateMutex.Lock()
+		client.finishRegistration(fmt.Errorf("server closed the connection during registration: %s", message.Param(0)))
+		client.stateMutex.Unlock()
 
-		_, modeStoreExists := client.serverInfo.Modes[nick]
-		if !modeStoreExists {
-			store := NewModeStore()
-			client.serverInfo.Modes[nick] = &store
-		}
+	case "005": //RPL_ISUPPORT
+		client.handleISupport(message)
+
+	case "396":
+		client.stateMutex.Lock()
+		client.clientInfo.DisplayedHost = message.Param(1)
+		client.stateMutex.Unlock()
 
-		client.serverInfo.Modes[nick].ApplyModeString(modeStr)
+	case "376", "422": //end of motd, no motd
+		//our own user and host are needed to know how long our messages can be
+		client.SendMessage(Message{
+			Command: "WHO",
+			Params:  []string{client.GetNick()},
+		})
 
-	case "376": //end of motd
 		client.callbacksMutex.RLock()
 		client.postInitCB()
 		client.callbacksMutex.RUnlock()
@@ -253,27 +536,27 @@ func (client *Client) parserHandler(message Message) {
 	client.callbacksMutex.RUnlock()
 }
 
-func (client *Client) pingWorker() {
+//pingWorker pings the server periodically and closes the connection if nothing is received for PingTimeout seconds
+func (client *Client) pingWorker(conn *Connection, pingTimeoutTimer *time.Timer) {
 	defer client.workersWG.Done()
 
-	for running := true; running; {
+	pingTicker := time.NewTicker(time.Second * (time.Duration)(client.config.PingFrequency))
+	defer pingTicker.Stop()
+	defer pingTimeoutTimer.Stop()
+
+	for {
 		select {
-		case t, ok := <-client.pingTicker.C:
-			if !ok {
-				running = false
-				break
-			}
+		case t := <-pingTicker.C:
 			client.SendMessage(Message{
 				Source:   "",
 				Command:  "PING",
 				Trailing: strconv.FormatInt(t.Unix(), 10),
 			})
-		case _, ok := <-client.pingTimeoutTimer.C:
-			if !ok {
-				running = false
-				client.Close()
-				break
-			}
+		case <-pingTimeoutTimer.C:
+			conn.CloseWithError(ErrPingTimeout)
+			return
+		case <-conn.Closed():
+			return
 		}
 	}
 }
@@ -284,27 +567,91 @@ func (client *Client) SetMessageHandler(cb func(message Message)) {
 	client.passthroughCB = cb
 }
 
+//SetPostInitCallback sets the callback to invoke after the MOTD, it is invoked again after every reconnection
 func (client *Client) SetPostInitCallback(cb func()) {
 	client.callbacksMutex.Lock()
 	defer client.callbacksMutex.Unlock()
 	client.postInitCB = cb
 }
 
+//SetConnectionStateCallback sets the callback to invoke when the supervisor connects, the first connection included,
+//and when it notices a disconnection
+func (client *Client) SetConnectionStateCallback(cb func(connected bool, reason error)) {
+	client.callbacksMutex.Lock()
+	defer client.callbacksMutex.Unlock()
+	client.connStateCB = cb
+}
+
 func (client *Client) Wait() {
 	client.workersWG.Wait()
 }
 
+//stopReconnecting makes the supervisor exit instead of replacing the connection once it's closed
+func (client *Client) stopReconnecting() {
+	client.connMutex.Lock()
+	defer client.connMutex.Unlock()
+
+	select {
+	case <-client.done:
+	default:
+		close(client.done)
+	}
+}
+
+//Close closes the current connection and stops reconnection attempts
 func (client *Client) Close() error {
-	close(client.outgoingQueue)
-	client.pingTicker.Stop()
-	client.pingTimeoutTimer.Stop()
-	return client.connection.Close()
+	client.stopReconnecting()
+	return client.getConnection().Close()
 }
 
+//Quit sends QUIT after the messages that are already queued and stops reconnection attempts, the connection is closed
+//once the server closes it or after the timeout
+func (client *Client) Quit(message string, timeout time.Duration) error {
+	client.stopReconnecting()
+
+	//there is nobody to say goodbye to while connecting
+	conn := client.getConnection()
+	if !client.IsConnected() {
+		return conn.Close()
+	}
+
+	client.SendMessage(Message{
+		Command:  "QUIT",
+		Trailing: message,
+	})
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-conn.Closed():
+	case <-timer.C:
+		log.Printf("%s didn't close the connection within %s of QUIT", client.config.Address, timeout)
+	}
+
+	return conn.Close()
+}
+
+//IsConnected returns whether the client is currently connected and registered
+func (client *Client) IsConnected() bool {
+	client.stateMutex.RLock()
+	defer client.stateMutex.RUnlock()
+	return client.connected
+}
+
+//SendMessage queues a message on the current connection, it is dropped if the connection is closed
 func (client *Client) SendMessage(message Message) {
-	client.connection.OutgoingChannel <- message
+	conn := client.getConnection()
+
+	select {
+	case conn.OutgoingChannel <- message:
+	case <-conn.Closed():
+		log.Printf("Dropped an outgoing %s message, the connection is closed", message.Command)
+	}
 }
 
 func (client *Client) GetNick() string {
+	client.stateMutex.RLock()
+	defer client.stateMutex.RUnlock()
 	return client.clientInfo.Nick
 }
@@ -0,0 +1,214 @@
+package irc
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+//serveWelcome accepts connections and welcomes every client once it sends USER, then stays silent
+func serveWelcome(t *testing.T, address string) net.Listener {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		t.Fatalf("Failed to listen: %s", err)
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+
+				scanner := bufio.NewScanner(conn)
+				for scanner.Scan() {
+					if strings.HasPrefix(scanner.Text(), "USER ") {
+						conn.Write([]byte(":srv 001 me :Welcome\r\n"))
+					}
+				}
+			}()
+		}
+	}()
+
+	return listener
+}
+
+type connectionEvent struct {
+	connected bool
+	reason    error
+}
+
+func TestClient_ConnectionState(t *testing.T) {
+	listener := serveWelcome(t, "127.0.0.1:0")
+	defer listener.Close()
+
+	client, err := NewClient(ClientConfig{
+		Address:            listener.Addr().String(),
+		Nick:               "me",
+		PingFrequency:      100,
+		PingTimeout:        1,
+		NickRegainInterval: -1,
+		ReconnectMinDelay:  1,
+		ReconnectMaxDelay:  1,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create a client: %s", err)
+	}
+
+	events := make(chan connectionEvent, 8)
+	client.SetConnectionStateCallback(func(connected bool, reason error) {
+		events <- connectionEvent{connected, reason}
+	})
+
+	if err := client.Init(); err != nil {
+		t.Fatalf("Failed to connect: %s", err)
+	}
+	defer func() {
+		client.Close()
+		client.Wait()
+	}()
+
+	//the first connection is signalled too, the silent server then times out and the client reconnects
+	expected := []connectionEvent{{true, nil}, {false, ErrPingTimeout}, {true, nil}}
+	for nEvent, want := range expected {
+		select {
+		case got := <-events:
+			if got.connected != want.connected || !errors.Is(got.reason, want.reason) {
+				t.Fatalf("(event %d) Expected %v, got %v", nEvent, want, got)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("(event %d) Timed out waiting for %v", nEvent, want)
+		}
+	}
+}
+
+func TestClient_InitUnreachable(t *testing.T) {
+	//the address is free once the listener is closed, the server only comes up after the first attempt failed
+	listener := serveWelcome(t, "127.0.0.1:0")
+	address := listener.Addr().String()
+	listener.Close()
+
+	client, err := NewClient(ClientConfig{
+		Address:            address,
+		Nick:               "me",
+		NickRegainInterval: -1,
+		ReconnectMinDelay:  1,
+		ReconnectMaxDelay:  1,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create a client: %s", err)
+	}
+
+	events := make(chan connectionEvent, 8)
+	client.SetConnectionStateCallback(func(connected bool, reason error) {
+		events <- connectionEvent{connected, reason}
+	})
+
+	if err := client.Init(); err != nil {
+		t.Fatalf("Failed to initialise the client: %s", err)
+	}
+	defer func() {
+		client.Close()
+		client.Wait()
+	}()
+
+	if err := client.Init(); !errors.Is(err, ErrClientRunning) {
+		t.Errorf("Expected a second Init to fail with %v, got %v", ErrClientRunning, err)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	listener = serveWelcome(t, address)
+	defer listener.Close()
+
+	select {
+	case got := <-events:
+		if !got.connected {
+			t.Errorf("Expected to connect, got %v", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("Timed out waiting for the client to connect")
+	}
+}
+
+//a platform restarted by the bus quits and initialises the client again
+func TestClient_InitAfterQuit(t *testing.T) {
+	listener := serveWelcome(t, "127.0.0.1:0")
+	defer listener.Close()
+
+	client, err := NewClient(ClientConfig{Address: listener.Addr().String(), Nick: "me", NickRegainInterval: -1})
+	if err != nil {
+		t.Fatalf("Failed to create a client: %s", err)
+	}
+
+	events := make(chan connectionEvent, 8)
+	client.SetConnectionStateCallback(func(connected bool, reason error) {
+		events <- connectionEvent{connected, reason}
+	})
+
+	for i := 0; i < 2; i++ {
+		if err := client.Init(); err != nil {
+			t.Fatalf("(run %d) Failed to initialise the client: %s", i, err)
+		}
+
+		select {
+		case got := <-events:
+			if !got.connected {
+				t.Fatalf("(run %d) Expected to connect, got %v", i, got)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("(run %d) Timed out waiting for the client to connect", i)
+		}
+
+		client.Quit("bye", 100*time.Millisecond)
+		client.Wait()
+
+		if client.IsConnected() {
+			t.Errorf("(run %d) Expected the client to be disconnected after quitting", i)
+		}
+	}
+}
+
+func TestClient_ReconnectDelay(t *testing.T) {
+	tests := []struct {
+		minDelay, maxDelay int
+		attempt            int
+		//the delay is between half of the backoff and the backoff itself
+		backoff time.Duration
+	}{
+		{5, 300, 0, 5 * time.Second},
+		{5, 300, 1, 10 * time.Second},
+		{5, 300, 3, 40 * time.Second},
+		{5, 300, 6, 300 * time.Second},
+		{5, 300, 1000, 300 * time.Second},
+		{7, 7, 3, 7 * time.Second},
+		//a minimum above the maximum is capped
+		{10, 4, 0, 4 * time.Second},
+	}
+
+	for nTest, test := range tests {
+		client, err := NewClient(ClientConfig{Address: "irc.example.com:6667", ReconnectMinDelay: test.minDelay, ReconnectMaxDelay: test.maxDelay})
+		if err != nil {
+			t.Fatalf("(test %d) Failed to create a client: %s", nTest, err)
+		}
+
+		seen := make(map[time.Duration]struct{})
+		for i := 0; i < 100; i++ {
+			delay := client.reconnectDelay(test.attempt)
+			if delay < test.backoff/2 || delay > test.backoff {
+				t.Errorf("(test %d) Delay of attempt %d out of bounds: expected between %s and %s, got %s", nTest, test.attempt, test.backoff/2, test.backoff, delay)
+			}
+			seen[delay] = struct{}{}
+		}
+
+		//clients that lost their connection together shouldn't come back together
+		if len(seen) < 2 {
+			t.Errorf("(test %d) Expected the delay to be jittered, got %d distinct delays", nTest, len(seen))
+		}
+	}
+}
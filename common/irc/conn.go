@@ -2,21 +2,32 @@ package irc
 
 import (
 	"crypto/tls"
+	"errors"
 	"github.com/xor-shift/Shiba/common/ratelimit"
 	"log"
 	"net"
 	"sync"
 )
 
+var (
+	ErrPingTimeout = errors.New("ping timeout")
+)
+
 type Connection struct {
 	address           string
 	isTLS             bool
 	tlsConnection     *tls.Conn
+	tlsCertificates   []tls.Certificate
 	regularConnection net.Conn
 
 	parser        *Parser
 	connWorkersWG *sync.WaitGroup
 
+	closeOnce *sync.Once
+	closed    chan struct{}
+	errMutex  *sync.Mutex
+	err       error
+
 	incomingCallback func(Message)
 	IncomingChannel  chan Message
 	rateLimiter      ratelimit.Bucket
@@ -33,6 +44,11 @@ func NewConnection(tls bool, address string) *Connection {
 		parser:        NewParser(),
 		connWorkersWG: &sync.WaitGroup{},
 
+		closeOnce: &sync.Once{},
+		closed:    make(chan struct{}),
+		errMutex:  &sync.Mutex{},
+		err:       nil,
+
 		incomingCallback: nil,
 		IncomingChannel:  make(chan Message, 128),
 		rateLimiter:      ratelimit.NewBucket(16, 400),
@@ -49,12 +65,18 @@ func (conn *Connection) SetIncomingCallback(fn func(Message)) {
 	conn.incomingCallback = fn
 }
 
+//SetClientCertificate sets the certificate to present to the server during the TLS handshake. Must be called before Init()
+func (conn *Connection) SetClientCertificate(cert tls.Certificate) {
+	conn.tlsCertificates = []tls.Certificate{cert}
+}
+
 //Init establishes a connection and starts necessary workers etc.
 func (conn *Connection) Init() error {
 	if conn.isTLS {
 		tlsConfig := &tls.Config{
 			InsecureSkipVerify: true,
 			MinVersion:         tls.VersionTLS10,
+			Certificates:       conn.tlsCertificates,
 		}
 
 		tlsConn, connErr := tls.Dial("tcp", conn.address, tlsConfig)
@@ -79,14 +101,54 @@ func (conn *Connection) Init() error {
 	return nil
 }
 
+//Close closes the underlying connection, it is safe to call multiple times and from multiple goroutines
 func (conn *Connection) Close() error {
-	if conn.isTLS {
-		return conn.tlsConnection.Close()
-	} else {
-		return conn.regularConnection.Close()
+	var err error
+
+	conn.closeOnce.Do(func() {
+		close(conn.closed)
+
+		if conn.isTLS && conn.tlsConnection != nil {
+			err = conn.tlsConnection.Close()
+		} else if !conn.isTLS && conn.regularConnection != nil {
+			err = conn.regularConnection.Close()
+		}
+	})
+
+	return err
+}
+
+//CloseWithError closes the connection and records the reason unless another one was recorded before
+func (conn *Connection) CloseWithError(reason error) {
+	conn.setErr(reason)
+	_ = conn.Close()
+}
+
+//Closed returns a channel that is closed once the connection is closed
+func (conn *Connection) Closed() <-chan struct{} {
+	return conn.closed
+}
+
+//Err returns the reason the connection was closed for, if any
+func (conn *Connection) Err() error {
+	conn.errMutex.Lock()
+	defer conn.errMutex.Unlock()
+	return conn.err
+}
+
+func (conn *Connection) setErr(err error) {
+	conn.errMutex.Lock()
+	defer conn.errMutex.Unlock()
+	if conn.err == nil {
+		conn.err = err
 	}
 }
 
+//Wait blocks until the workers of the connection exit
+func (conn *Connection) Wait() {
+	conn.connWorkersWG.Wait()
+}
+
 func (conn *Connection) Write(b []byte) (int, error) {
 	if conn.isTLS {
 		return conn.tlsConnection.Write(b)
@@ -120,6 +182,7 @@ func (conn *Connection) incomingWorker() {
 		n, err := conn.Read(buffer)
 		if err != nil {
 			running = false
+			conn.setErr(err)
 			log.Println("IRC message receiver got error:", err)
 			break
 		}
@@ -153,6 +216,8 @@ func (conn *Connection) outgoingWorker() {
 			if _, err := conn.Write(msg.Serialize()); err != nil {
 				log.Println("Error while sending IRC message:", err)
 			}
+		case <-conn.closed:
+			running = false
 		}
 	}
 }
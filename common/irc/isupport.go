@@ -0,0 +1,152 @@
+package irc
+
+import (
+	"strconv"
+	"strings"
+)
+
+//unescapeISupportValue decodes the \xHH escapes that RPL_ISUPPORT values may contain
+func unescapeISupportValue(value string) string {
+	if !strings.Contains(value, `\x`) {
+		return value
+	}
+
+	builder := strings.Builder{}
+	for i := 0; i < len(value); i++ {
+		if value[i] == '\\' && i+3 < len(value) && value[i+1] == 'x' {
+			if b, err := strconv.ParseUint(value[i+2:i+4], 16, 8); err == nil {
+				builder.WriteByte(byte(b))
+				i += 3
+				continue
+			}
+		}
+		builder.WriteByte(value[i])
+	}
+
+	return builder.String()
+}
+
+//handleISupport records the tokens of an RPL_ISUPPORT (005) reply and recomputes the parsed fields
+func (client *Client) handleISupport(message Message) {
+	params := message.AllParams()
+	//the first parameter is our nick and the last is the human readable "are supported by this server"
+	if len(params) < 3 {
+		return
+	}
+
+	client.stateMutex.Lock()
+	defer client.stateMutex.Unlock()
+
+	for _, token := range params[1 : len(params)-1] {
+		if strings.HasPrefix(token, "-") {
+			delete(client.serverInfo.ISupport, strings.ToUpper(token[1:]))
+			continue
+		}
+
+		key, value, _ := strings.Cut(token, "=")
+		client.serverInfo.ISupport[strings.ToUpper(key)] = unescapeISupportValue(value)
+	}
+
+	client.serverInfo.applyISupport()
+}
+
+//applyISupport resets the fields derived from RPL_ISUPPORT to their defaults and then applies the recorded tokens
+func (info *ServerInformation) applyISupport() {
+	defaults := NewServerInformation()
+
+	info.ChannelTypes = defaults.ChannelTypes
+	info.PrefixModes = defaults.PrefixModes
+	info.PrefixSymbols = defaults.PrefixSymbols
+	info.ChannelModes = defaults.ChannelModes
+	info.CaseMapping = defaults.CaseMapping
+	info.NickLen = defaults.NickLen
+	info.TargMax = make(map[string]int)
+
+	if v, ok := info.ISupport["CHANTYPES"]; ok {
+		info.ChannelTypes = v
+	}
+
+	if v, ok := info.ISupport["PREFIX"]; ok {
+		//the format is (modes)symbols, e.g. (qaohv)~&@%+, an empty value means that there are no prefixes
+		info.PrefixModes, info.PrefixSymbols = "", ""
+		if strings.HasPrefix(v, "(") {
+			if idx := strings.IndexByte(v, ')'); idx != -1 && len(v)-idx-1 == idx-1 {
+				info.PrefixModes, info.PrefixSymbols = v[1:idx], v[idx+1:]
+			}
+		}
+	}
+
+	if v, ok := info.ISupport["CHANMODES"]; ok {
+		parts := strings.Split(v, ",")
+		for len(parts) < 4 {
+			parts = append(parts, "")
+		}
+
+		info.ChannelModes = ChannelModeTypes{
+			List:   parts[0],
+			Always: parts[1],
+			OnSet:  parts[2],
+			Never:  parts[3],
+		}
+	}
+
+	if v, ok := info.ISupport["CASEMAPPING"]; ok && len(v) != 0 {
+		info.CaseMapping = strings.ToLower(v)
+	}
+
+	if v, ok := info.ISupport["NICKLEN"]; ok {
+		if i, err := strconv.Atoi(v); err == nil {
+			info.NickLen = i
+		}
+	}
+
+	if v, ok := info.ISupport["TARGMAX"]; ok {
+		for _, entry := range strings.Split(v, ",") {
+			command, limit, _ := strings.Cut(entry, ":")
+			if len(command) == 0 {
+				continue
+			}
+
+			//an empty limit means that there is no limit
+			i, err := strconv.Atoi(limit)
+			if err != nil {
+				i = 0
+			}
+
+			info.TargMax[strings.ToUpper(command)] = i
+		}
+	}
+}
+
+//ISupport returns the value of an RPL_ISUPPORT token and whether the server has sent it
+func (client *Client) ISupport(key string) (string, bool) {
+	client.stateMutex.RLock()
+	defer client.stateMutex.RUnlock()
+
+	v, ok := client.serverInfo.ISupport[strings.ToUpper(key)]
+	return v, ok
+}
+
+//CaseMapping returns the casemapping of the server
+func (client *Client) CaseMapping() string {
+	client.stateMutex.RLock()
+	defer client.stateMutex.RUnlock()
+	return client.serverInfo.CaseMapping
+}
+
+//Casefold folds a nick or a channel name according to the casemapping of the server
+func (client *Client) Casefold(str string) string {
+	return Casefold(client.CaseMapping(), str)
+}
+
+//EqualFold returns whether two nicks or channel names are equal according to the casemapping of the server
+func (client *Client) EqualFold(a, b string) bool {
+	return EqualFold(client.CaseMapping(), a, b)
+}
+
+//IsChannel returns whether the target is a channel according to the CHANTYPES of the server
+func (client *Client) IsChannel(target string) bool {
+	client.stateMutex.RLock()
+	defer client.stateMutex.RUnlock()
+	return client.isChannelName(target)
+}
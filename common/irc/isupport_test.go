@@ -0,0 +1,142 @@
+package irc
+
+import (
+	"reflect"
+	"testing"
+)
+
+type isupportTest struct {
+	//replies are the tokens of consecutive RPL_ISUPPORT replies
+	replies [][]string
+
+	channelTypes  string
+	prefixModes   string
+	prefixSymbols string
+	channelModes  ChannelModeTypes
+	caseMapping   string
+	nickLen       int
+	targMax       map[string]int
+
+	tokens map[string]string
+	absent []string
+}
+
+var defaultChannelModes = NewServerInformation().ChannelModes
+
+var isupportTests = []isupportTest{
+	//nothing announced
+	{
+		channelTypes:  "#&",
+		prefixModes:   "ov",
+		prefixSymbols: "@+",
+		channelModes:  defaultChannelModes,
+		caseMapping:   CaseMappingRFC1459,
+		targMax:       map[string]int{},
+	},
+	{
+		replies: [][]string{{
+			"CHANTYPES=#", "PREFIX=(qaohv)~&@%+", "CHANMODES=beI,k,l,imnpst", "CASEMAPPING=ascii", "NICKLEN=16",
+			"TARGMAX=PRIVMSG:4,NOTICE:4,JOIN:,whois:1", "EXCEPTS", "NETWORK=Example\\x20Net",
+		}},
+		channelTypes:  "#",
+		prefixModes:   "qaohv",
+		prefixSymbols: "~&@%+",
+		channelModes:  defaultChannelModes,
+		caseMapping:   CaseMappingASCII,
+		nickLen:       16,
+		targMax:       map[string]int{"PRIVMSG": 4, "NOTICE": 4, "JOIN": 0, "WHOIS": 1},
+		tokens:        map[string]string{"EXCEPTS": "", "NETWORK": "Example Net", "network": "Example Net"},
+	},
+	//later replies add to and remove from the earlier ones
+	{
+		replies: [][]string{
+			{"PREFIX=(ohv)@%+", "CASEMAPPING=strict-rfc1459", "NICKLEN=30", "MODES=4"},
+			{"-NICKLEN", "-casemapping", "CHANMODES=b,k,lj", "-UNKNOWN"},
+		},
+		channelTypes:  "#&",
+		prefixModes:   "ohv",
+		prefixSymbols: "@%+",
+		channelModes:  ChannelModeTypes{List: "b", Always: "k", OnSet: "lj"},
+		caseMapping:   CaseMappingRFC1459,
+		targMax:       map[string]int{},
+		tokens:        map[string]string{"MODES": "4", "PREFIX": "(ohv)@%+"},
+		absent:        []string{"NICKLEN", "CASEMAPPING", "UNKNOWN"},
+	},
+	//an empty PREFIX means no prefixes, a malformed one is treated the same way
+	{
+		replies:      [][]string{{"PREFIX=", "CASEMAPPING=RFC1459", "NICKLEN=abc"}},
+		channelTypes: "#&",
+		channelModes: defaultChannelModes,
+		caseMapping:  CaseMappingRFC1459,
+		targMax:      map[string]int{},
+	},
+	{
+		replies:      [][]string{{"PREFIX=(ov)@"}},
+		channelTypes: "#&",
+		channelModes: defaultChannelModes,
+		caseMapping:  CaseMappingRFC1459,
+		targMax:      map[string]int{},
+	},
+	//invalid escapes are kept as they are
+	{
+		replies:       [][]string{{"NETWORK=a\\x2", "STATUSMSG=\\xZZ@+", "CHANTYPES=\\x23"}},
+		channelTypes:  "#",
+		prefixModes:   "ov",
+		prefixSymbols: "@+",
+		channelModes:  defaultChannelModes,
+		caseMapping:   CaseMappingRFC1459,
+		targMax:       map[string]int{},
+		tokens:        map[string]string{"NETWORK": "a\\x2", "STATUSMSG": "\\xZZ@+"},
+	},
+}
+
+func TestClient_HandleISupport(t *testing.T) {
+	for nTest, test := range isupportTests {
+		client := newStateClient(t, nil)
+		for _, tokens := range test.replies {
+			params := append(append([]string{"me"}, tokens...), "are supported by this server")
+			client.handleISupport(Message{Command: "005", Params: params})
+		}
+
+		info := client.serverInfo
+		if info.ChannelTypes != test.channelTypes {
+			t.Errorf("(test %d) Bad channel types: expected %q, got %q", nTest, test.channelTypes, info.ChannelTypes)
+		}
+		if info.PrefixModes != test.prefixModes || info.PrefixSymbols != test.prefixSymbols {
+			t.Errorf("(test %d) Bad prefixes: expected %q %q, got %q %q", nTest, test.prefixModes, test.prefixSymbols, info.PrefixModes, info.PrefixSymbols)
+		}
+		if info.ChannelModes != test.channelModes {
+			t.Errorf("(test %d) Bad channel modes: expected %#v, got %#v", nTest, test.channelModes, info.ChannelModes)
+		}
+		if got := client.CaseMapping(); got != test.caseMapping {
+			t.Errorf("(test %d) Bad casemapping: expected %q, got %q", nTest, test.caseMapping, got)
+		}
+		if info.NickLen != test.nickLen {
+			t.Errorf("(test %d) Bad nick length: expected %d, got %d", nTest, test.nickLen, info.NickLen)
+		}
+		if !reflect.DeepEqual(info.TargMax, test.targMax) {
+			t.Errorf("(test %d) Bad TARGMAX: expected %v, got %v", nTest, test.targMax, info.TargMax)
+		}
+
+		for key, expected := range test.tokens {
+			if value, ok := client.ISupport(key); !ok || value != expected {
+				t.Errorf("(test %d) Bad value of %s: expected %q, got %q (%v)", nTest, key, expected, value, ok)
+			}
+		}
+		for _, key := range test.absent {
+			if value, ok := client.ISupport(key); ok {
+				t.Errorf("(test %d) Expected %s to be removed, got %q", nTest, key, value)
+			}
+		}
+	}
+}
+
+func TestClient_HandleISupport_Short(t *testing.T) {
+	client := newStateClient(t, nil)
+	//without any tokens between our nick and the trailing text there is nothing to apply
+	client.handleISupport(Message{Command: "005", Params: []string{"me", "CHANTYPES=#"}})
+
+	if _, ok := client.ISupport("CHANTYPES"); ok || client.serverInfo.ChannelTypes != "#&" {
+		t.Errorf("Expected a short reply to be ignored, got %q", client.serverInfo.ChannelTypes)
+	}
+}
@@ -8,28 +8,17 @@ type Message struct {
 	Command  string
 	Params   []string
 	Trailing string
+	//HasTrailing makes Serialize write the trailing parameter even if it is empty, ParseLine sets it for every line that has one
+	HasTrailing bool
 }
 
 func (msg Message) Serialize() []byte {
 	buf := make([]byte, 0)
 
-	if msg.Tags != nil {
-		if tagLen := len(msg.Tags); tagLen != 0 {
-			buf = append(buf, '@')
-			i := 0
-			for k, v := range msg.Tags {
-				i++
-				buf = append(buf, []byte(k)...)
-				if len(v) != 0 {
-					buf = append(buf, '=')
-					buf = append(buf, []byte(v)...)
-				}
-				if i != tagLen {
-					buf = append(buf, ';')
-				}
-			}
-			buf = append(buf, ' ')
-		}
+	if len(msg.Tags) != 0 {
+		buf = append(buf, '@')
+		buf = append(buf, []byte(SerializeTags(msg.Tags))...)
+		buf = append(buf, ' ')
 	}
 
 	if len(msg.Source) != 0 {
@@ -39,19 +28,14 @@ func (msg Message) Serialize() []byte {
 	}
 
 	buf = append(buf, []byte(msg.Command)...)
-	buf = append(buf, ' ')
-
-	if msg.Params != nil {
-		if len(msg.Params) > 0 {
-			for _, v := range msg.Params {
-				buf = append(buf, []byte(v)...)
-				buf = append(buf, ' ')
-			}
-		}
+
+	for _, v := range msg.Params {
+		buf = append(buf, ' ')
+		buf = append(buf, []byte(v)...)
 	}
 
-	if len(msg.Trailing) > 0 {
-		buf = append(buf, ':')
+	if msg.HasTrailing || len(msg.Trailing) > 0 {
+		buf = append(buf, ' ', ':')
 		buf = append(buf, []byte(msg.Trailing)...)
 	}
 
@@ -60,6 +44,28 @@ func (msg Message) Serialize() []byte {
 	return buf
 }
 
+//AllParams returns every parameter of the message, including the trailing one if it is set or not empty
+func (msg Message) AllParams() []string {
+	params := make([]string, 0, len(msg.Params)+1)
+	params = append(params, msg.Params...)
+
+	if msg.HasTrailing || len(msg.Trailing) != 0 {
+		params = append(params, msg.Trailing)
+	}
+
+	return params
+}
+
+//Param returns the parameter at the given index as returned by AllParams or an empty string if there is no such parameter
+func (msg Message) Param(idx int) string {
+	params := msg.AllParams()
+	if idx < 0 || idx >= len(params) {
+		return ""
+	}
+
+	return params[idx]
+}
+
 func ParseSource(source string) []string {
 	nickSepIdx := strings.Index(source, "!")
 	hostSepIdx := strings.Index(source, "@")
@@ -1,11 +1,17 @@
 package irc
 
+import (
+	"sort"
+	"strings"
+)
+
+//ModeStore holds a set of modes along with their arguments, modes without an argument map to an empty string
 type ModeStore struct {
-	store map[rune]struct{}
+	store map[rune]string
 }
 
 func NewModeStore() ModeStore {
-	return ModeStore{store: make(map[rune]struct{})}
+	return ModeStore{store: make(map[rune]string)}
 }
 
 func (store ModeStore) HasMode(mode rune) bool {
@@ -13,8 +19,17 @@ func (store ModeStore) HasMode(mode rune) bool {
 	return ok
 }
 
+//GetArgument returns the argument of a mode such as the key for +k or the limit for +l
+func (store ModeStore) GetArgument(mode rune) string {
+	return store.store[mode]
+}
+
 func (store *ModeStore) AddMode(mode rune) {
-	store.store[mode] = struct{}{}
+	store.AddModeWithArgument(mode, "")
+}
+
+func (store *ModeStore) AddModeWithArgument(mode rune, argument string) {
+	store.store[mode] = argument
 }
 
 func (store *ModeStore) RemoveMode(mode rune) {
@@ -42,3 +57,73 @@ func (store *ModeStore) ApplyModeString(modes string) {
 		}
 	}
 }
+
+//String returns the modes as a mode string without arguments, i.e. "+knt"
+func (store ModeStore) String() string {
+	modes := make([]rune, 0, len(store.store))
+	for k := range store.store {
+		modes = append(modes, k)
+	}
+	sort.Slice(modes, func(i, j int) bool { return modes[i] < modes[j] })
+
+	return "+" + string(modes)
+}
+
+func (store ModeStore) clone() ModeStore {
+	newStore := NewModeStore()
+	for k, v := range store.store {
+		newStore.store[k] = v
+	}
+	return newStore
+}
+
+//ChannelModeTypes categorizes channel modes as the CHANMODES token of RPL_ISUPPORT does
+type ChannelModeTypes struct {
+	//List modes always take an argument and hold a list of masks (+b, +e, +I)
+	List string
+	//Always modes always take an argument (+k)
+	Always string
+	//OnSet modes only take an argument when being set (+l)
+	OnSet string
+	//Never modes never take an argument (+n, +t)
+	Never string
+}
+
+//ModeChange is a single change from a mode string
+type ModeChange struct {
+	Adding   bool
+	Mode     rune
+	Argument string
+}
+
+//ParseChannelModeChanges splits a channel mode string and its arguments into individual changes, prefixModes are the modes that give a channel membership prefix ("ov")
+func ParseChannelModeChanges(modes string, args []string, types ChannelModeTypes, prefixModes string) []ModeChange {
+	changes := make([]ModeChange, 0)
+
+	additive := true
+	for _, ch := range modes {
+		switch ch {
+		case '+':
+			additive = true
+			continue
+		case '-':
+			additive = false
+			continue
+		}
+
+		takesArgument := strings.ContainsRune(types.List, ch) ||
+			strings.ContainsRune(types.Always, ch) ||
+			strings.ContainsRune(prefixModes, ch) ||
+			(additive && strings.ContainsRune(types.OnSet, ch))
+
+		change := ModeChange{Adding: additive, Mode: ch}
+		if takesArgument && len(args) > 0 {
+			change.Argument = args[0]
+			args = args[1:]
+		}
+
+		changes = append(changes, change)
+	}
+
+	return changes
+}
@@ -0,0 +1,173 @@
+package irc
+
+import (
+	"log"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	//defaultNickLen bounds the fallback nicks while NICKLEN is unknown, which is always the case during the registration
+	//since RPL_ISUPPORT comes after RPL_WELCOME, it is the limit of RFC 1459
+	defaultNickLen = 9
+)
+
+//nickCandidate returns the nick to try after the given number of failed attempts during the registration, the state mutex must be held
+func (client *Client) nickCandidate(attempt int) string {
+	candidates := append([]string{client.config.Nick}, client.config.AltNicks...)
+	if attempt < len(candidates) {
+		return candidates[attempt]
+	}
+
+	//out of configured nicks, append underscores to the primary nick and resort to random digits if that gets too long
+	nick := client.config.Nick + strings.Repeat("_", attempt-len(candidates)+1)
+	nickLen := client.serverInfo.NickLen
+	if nickLen <= 0 {
+		nickLen = defaultNickLen
+	}
+
+	if len(nick) > nickLen {
+		suffix := strconv.Itoa(1000 + rand.Intn(9000))
+		//nicks can't start with a digit, at least the first character is kept even if NICKLEN is that short
+		keep := nickLen - len(suffix)
+		if keep < 1 {
+			keep = 1
+		}
+
+		base := client.config.Nick
+		if len(base) > keep {
+			base = base[:keep]
+		}
+		nick = base + suffix
+		if len(nick) > nickLen {
+			nick = nick[:nickLen]
+		}
+	}
+
+	return nick
+}
+
+//hasPrimaryNick returns whether we are using the configured nick, the state mutex must be held
+func (client *Client) hasPrimaryNick() bool {
+	return client.fold(client.clientInfo.Nick) == client.fold(client.config.Nick)
+}
+
+//tryRegainNick attempts to switch back to the configured nick, the state mutex must be held
+func (client *Client) tryRegainNick() {
+	if client.registering || client.hasPrimaryNick() {
+		return
+	}
+
+	client.SendMessage(Message{
+		Command: "NICK",
+		Params:  []string{client.config.Nick},
+	})
+}
+
+//setMonitoring adds or removes the primary nick from the MONITOR list if the server supports it, the state mutex must be held
+func (client *Client) setMonitoring(monitor bool) {
+	if _, ok := client.serverInfo.ISupport["MONITOR"]; !ok || client.monitoringNick == monitor {
+		return
+	}
+
+	client.monitoringNick = monitor
+
+	modifier := "-"
+	if monitor {
+		modifier = "+"
+	}
+
+	client.SendMessage(Message{
+		Command: "MONITOR",
+		Params:  []string{modifier, client.config.Nick},
+	})
+}
+
+func (client *Client) handleNickMessage(message Message) {
+	client.stateMutex.Lock()
+	defer client.stateMutex.Unlock()
+
+	switch message.Command {
+	case "432", "433", "436", "437": //ERR_ERRONEUSNICKNAME, ERR_NICKNAMEINUSE, ERR_NICKCOLLISION, ERR_UNAVAILRESOURCE
+		if !client.registering {
+			//the periodic attempts to regain the primary nick keep failing until it's released, only the first failure is logged
+			if client.fold(message.Param(1)) == client.fold(client.config.Nick) {
+				if client.regainFailed {
+					return
+				}
+				client.regainFailed = true
+			}
+
+			log.Printf("Could not change nick to %s: %s", message.Param(1), message.Trailing)
+			return
+		}
+
+		//437 is also sent for channels that are temporarily unavailable
+		if message.Command == "437" && client.isChannelName(message.Param(1)) {
+			return
+		}
+
+		client.nickAttempt++
+		nick := client.nickCandidate(client.nickAttempt)
+		log.Printf("Nick %s is unavailable, trying %s", message.Param(1), nick)
+
+		client.clientInfo.Nick = nick
+		client.SendMessage(Message{
+			Command: "NICK",
+			Params:  []string{nick},
+		})
+
+	case "376", "422": //end of the registration burst, ISUPPORT is known by now
+		if !client.hasPrimaryNick() {
+			client.setMonitoring(true)
+		}
+
+	case "731": //RPL_MONOFFLINE
+		for _, target := range strings.Split(message.Param(1), ",") {
+			if client.fold(ParseSource(target)[0]) == client.fold(client.config.Nick) {
+				client.tryRegainNick()
+			}
+		}
+
+	case "QUIT", "NICK":
+		nick := ParseSource(message.Source)[0]
+
+		if client.isSelf(nick) || message.Command == "NICK" && client.isSelf(message.Param(0)) {
+			if client.hasPrimaryNick() {
+				client.setMonitoring(false)
+				client.regainFailed = false
+			}
+			return
+		}
+
+		//whoever had our nick has let it go
+		if client.fold(nick) == client.fold(client.config.Nick) {
+			client.tryRegainNick()
+		}
+	}
+}
+
+//nickRegainWorker periodically tries to switch back to the configured nick while the connection is alive
+func (client *Client) nickRegainWorker(conn *Connection) {
+	defer client.workersWG.Done()
+
+	if client.config.NickRegainInterval < 0 {
+		return
+	}
+
+	ticker := time.NewTicker(time.Second * (time.Duration)(client.config.NickRegainInterval))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			client.stateMutex.Lock()
+			client.tryRegainNick()
+			client.stateMutex.Unlock()
+		case <-conn.Closed():
+			return
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package irc
+
+import (
+	"bytes"
+	"log"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+type nickFallbackTest struct {
+	nick     string
+	altNicks []string
+	steps    []registrationStep
+	//pattern is matched against the last nick we tried
+	pattern string
+}
+
+var nickFallbackTests = []nickFallbackTest{
+	{
+		altNicks: []string{"other"},
+		steps: []registrationStep{
+			{":srv 433 * me :Nickname is already in use", []string{"NICK other"}},
+			{":srv 433 * other :Nickname is already in use", []string{"NICK me_"}},
+			{":srv 432 * me_ :Erroneous nickname", []string{"NICK me__"}},
+			{":srv 437 * #chan :Channel is temporarily unavailable", []string{}},
+			{":srv 437 * me__ :Nick is temporarily unavailable", []string{"NICK me___"}},
+		},
+		pattern: "^me___$",
+	},
+	//NICKLEN isn't known during the registration, out of underscores random digits are appended instead
+	{
+		steps: []registrationStep{
+			{":srv 433 * me :Nickname is already in use", []string{"NICK me_"}},
+			{":srv 433 * me_ :Nickname is already in use", []string{"NICK me__"}},
+			{":srv 433 * me__ :Nickname is already in use", []string{"NICK me___"}},
+			{":srv 433 * me___ :Nickname is already in use", []string{"NICK me____"}},
+			{":srv 433 * me____ :Nickname is already in use", []string{"NICK me_____"}},
+			{":srv 433 * me_____ :Nickname is already in use", []string{"NICK me______"}},
+			{":srv 433 * me______ :Nickname is already in use", []string{"NICK me_______"}},
+			{":srv 433 * me_______ :Nickname is already in use", nil},
+		},
+		pattern: "^me[0-9]{4}$",
+	},
+	{
+		nick: "averylongnick",
+		steps: []registrationStep{
+			{":srv 433 * averylongnick :Nickname is already in use", nil},
+		},
+		pattern: "^avery[0-9]{4}$",
+	},
+	//NICKLEN comes after the registration, when we no longer fall back
+	{
+		steps: []registrationStep{
+			{":srv 433 * me :Nickname is already in use", []string{"NICK me_"}},
+			{":srv 001 me_ :Welcome", []string{}},
+			{":srv 005 me_ NICKLEN=30 :are supported by this server", []string{}},
+			{":srv 433 me_ me :Nickname is already in use", []string{}},
+		},
+		pattern: "^me_$",
+	},
+}
+
+func TestClient_NickFallback(t *testing.T) {
+	for nTest, test := range nickFallbackTests {
+		client := newRegisteringClient(t, ClientConfig{Nick: test.nick, AltNicks: test.altNicks})
+
+		for nStep, step := range test.steps {
+			feedLine(t, client, step.line)
+
+			//nil leaves the random nicks to the pattern
+			if got := sentLines(client); step.sent != nil && !reflect.DeepEqual(got, step.sent) {
+				t.Errorf("(test %d, step %d) Bad reply to %q: expected %q, got %q", nTest, nStep, step.line, step.sent, got)
+			}
+		}
+
+		if nick := client.GetNick(); !regexp.MustCompile(test.pattern).MatchString(nick) {
+			t.Errorf("(test %d) Expected the nick to match %s, got %q", nTest, test.pattern, nick)
+		}
+	}
+}
+
+func TestClient_NickCandidate(t *testing.T) {
+	tests := []struct {
+		nick    string
+		nickLen int
+		attempt int
+		pattern string
+	}{
+		{"me", 0, 1, "^me_$"},
+		{"me", 30, 12, "^me_{12}$"},
+		{"me", 6, 5, "^me[0-9]{4}$"},
+		//the first character is kept even if the digits don't fit
+		{"me", 3, 2, "^m[0-9]{2}$"},
+		{"me", 1, 2, "^m$"},
+	}
+
+	for nTest, test := range tests {
+		client := newRegisteringClient(t, ClientConfig{Nick: test.nick})
+		client.serverInfo.NickLen = test.nickLen
+
+		if nick := client.nickCandidate(test.attempt); !regexp.MustCompile(test.pattern).MatchString(nick) {
+			t.Errorf("(test %d) Expected the nick to match %s, got %q", nTest, test.pattern, nick)
+		}
+	}
+}
+
+func TestClient_NickRegainLogging(t *testing.T) {
+	buf := &bytes.Buffer{}
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(buf)
+
+	client := newRegisteringClient(t, ClientConfig{})
+	client.registering = false
+	client.clientInfo.Nick = "me_"
+
+	for i := 0; i < 3; i++ {
+		client.stateMutex.Lock()
+		client.tryRegainNick()
+		client.stateMutex.Unlock()
+		feedLine(t, client, ":srv 433 me_ me :Nickname is already in use")
+	}
+
+	if got := sentLines(client); !reflect.DeepEqual(got, []string{"NICK me", "NICK me", "NICK me"}) {
+		t.Errorf("Bad attempts: %q", got)
+	}
+	if n := strings.Count(buf.String(), "Could not change nick"); n != 1 {
+		t.Errorf("Expected the first failure to be logged, got %d line(s): %q", n, buf.String())
+	}
+
+	//failures to change to other nicks are always logged, and regaining the nick starts over
+	feedLine(t, client, ":srv 433 me_ someone :Nickname is already in use")
+	feedLine(t, client, ":me_!u@h NICK me")
+	feedLine(t, client, ":me!u@h NICK me_")
+	feedLine(t, client, ":srv 433 me_ me :Nickname is already in use")
+
+	if n := strings.Count(buf.String(), "Could not change nick"); n != 3 {
+		t.Errorf("Expected 3 failures to be logged, got %d line(s): %q", n, buf.String())
+	}
+}
@@ -2,27 +2,29 @@ package irc
 
 import (
 	"bytes"
-	"regexp"
+	"errors"
+	"fmt"
 	"strings"
 )
 
 const (
-	messageRegexString = `(?:@([^@ ]+) +)?` + //tags
-		`(?::([^ ]+) +)?` + //prefix
-		`((?:[a-zA-Z]+)|(?:[0-9]{3}))` + //command
-		`((?: +[^ \0:]+)+)?` + //params
-		`(?: +:([^\0]+))` //trailing
+	//MaxLineLength is the maximum length of a line that the parser will buffer or parse, 8191 bytes for tags and 512 for the rest
+	MaxLineLength = 8191 + 512
 )
 
 var (
-	//messageRegex = regexp.MustCompile(`(?:@([^@ ]+) +)?(?::([^ ]+) +)?((?:[a-zA-Z]+)|(?:[0-9]{3}))((?: +[^ \n\r\0:]+)+)?(?: +:([^\n\r\0]+))`)
-	messageRegex = regexp.MustCompile(messageRegexString)
-	separator    = []byte{'\r', '\n'}
+	separator = []byte{'\r', '\n'}
+
+	ErrEmptyLine      = errors.New("empty line")
+	ErrMissingCommand = errors.New("line has no command")
+	ErrLineTooLong    = errors.New("line exceeds the maximum line length")
 )
 
 type Parser struct {
 	callback func(Message)
 	buffer   []byte
+	//discarding is set while the rest of a line that was too long is skipped
+	discarding bool
 }
 
 func NewParser() *Parser {
@@ -36,34 +38,156 @@ func (p *Parser) SetCallback(cb func(Message)) {
 	p.callback = cb
 }
 
+//Write buffers the given bytes and invokes the callback for every complete line.
+//Lines may end with either "\r\n" or a bare "\n". Faulty lines are skipped, the rest of the buffer is still processed and the first error encountered is returned.
+//Lines longer than MaxLineLength are skipped entirely, up to and including their line ending.
 func (p *Parser) Write(buf []byte) (int, error) {
 	l := len(buf)
 
+	var firstErr error
+
+	if p.discarding {
+		i := bytes.IndexByte(buf, '\n')
+		if i == -1 {
+			return l, nil
+		}
+		buf = buf[i+1:]
+		p.discarding = false
+	}
+
 	p.buffer = append(p.buffer, buf...)
 
-	for i := bytes.Index(p.buffer, separator); i != -1; i = bytes.Index(p.buffer, separator) {
-		current := p.buffer[:i]
-		p.buffer = p.buffer[i+2:]
-		res := messageRegex.FindAllSubmatch(current, -1)
-		if len(res) > 0 {
-			res := res[0]
-
-			paramsStr := strings.TrimSpace(string(res[4]))
-			paramsStr = regexp.MustCompile(" +").ReplaceAllString(paramsStr, " ")
-
-			p.callback(Message{
-				Tags:     map[string]string{},
-				Source:   string(res[2]),
-				Command:  string(res[3]),
-				Params:   strings.Split(paramsStr, " "),
-				Trailing: string(res[5]),
-			})
+	for i := bytes.IndexByte(p.buffer, '\n'); i != -1; i = bytes.IndexByte(p.buffer, '\n') {
+		current := bytes.TrimSuffix(p.buffer[:i], []byte{'\r'})
+		p.buffer = p.buffer[i+1:]
+
+		if len(current) == 0 {
+			continue
+		}
+
+		if len(current) > MaxLineLength {
+			if firstErr == nil {
+				firstErr = ErrLineTooLong
+			}
+			continue
+		}
+
+		msg, err := ParseLine(current)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+
+		p.callback(msg)
+	}
+
+	if len(p.buffer) > MaxLineLength {
+		p.buffer = p.buffer[:0]
+		p.discarding = true
+		if firstErr == nil {
+			firstErr = ErrLineTooLong
 		}
 	}
 
-	return l, nil
+	return l, firstErr
 }
 
 func (p *Parser) Close() error {
 	return nil
 }
+
+func isValidCommand(command string) bool {
+	if len(command) == 0 {
+		return false
+	}
+
+	if command[0] >= '0' && command[0] <= '9' {
+		if len(command) != 3 {
+			return false
+		}
+		for i := 0; i < 3; i++ {
+			if command[i] < '0' || command[i] > '9' {
+				return false
+			}
+		}
+		return true
+	}
+
+	for i := 0; i < len(command); i++ {
+		c := command[i]
+		if !(c >= 'a' && c <= 'z') && !(c >= 'A' && c <= 'Z') {
+			return false
+		}
+	}
+
+	return true
+}
+
+//ParseLine tokenizes a single line (without the line ending) as described in RFC 1459 and the IRCv3 message-tags specification.
+//The final parameter is stored in Trailing only if it was prefixed with a ':', every other parameter goes to Params.
+func ParseLine(line []byte) (Message, error) {
+	str := string(line)
+
+	msg := Message{
+		Tags:   map[string]string{},
+		Params: []string{},
+	}
+
+	nextToken := func() string {
+		str = strings.TrimLeft(str, " ")
+		idx := strings.IndexByte(str, ' ')
+		if idx == -1 {
+			idx = len(str)
+		}
+
+		token := str[:idx]
+		str = str[idx:]
+		return token
+	}
+
+	if strings.IndexByte(str, 0) != -1 {
+		return Message{}, errors.New("line contains a NUL byte")
+	}
+
+	if len(strings.TrimSpace(str)) == 0 {
+		return Message{}, ErrEmptyLine
+	}
+
+	if str[0] == '@' {
+		msg.Tags = ParseTags(nextToken()[1:])
+	}
+
+	if str = strings.TrimLeft(str, " "); len(str) > 0 && str[0] == ':' {
+		msg.Source = nextToken()[1:]
+	}
+
+	command := nextToken()
+	if len(command) == 0 {
+		return Message{}, ErrMissingCommand
+	}
+
+	if !isValidCommand(command) {
+		return Message{}, fmt.Errorf("bad command %q", command)
+	}
+
+	msg.Command = strings.ToUpper(command)
+
+	for {
+		str = strings.TrimLeft(str, " ")
+		if len(str) == 0 {
+			break
+		}
+
+		if str[0] == ':' {
+			msg.Trailing = str[1:]
+			msg.HasTrailing = true
+			break
+		}
+
+		msg.Params = append(msg.Params, nextToken())
+	}
+
+	return msg, nil
+}
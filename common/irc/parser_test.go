@@ -0,0 +1,243 @@
+package irc
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type parseLineTest struct {
+	line     string
+	fails    bool
+	expected Message
+}
+
+var parseLineTests = []parseLineTest{
+	{
+		line: "PING :irc.example.com",
+		expected: Message{
+			Tags:        map[string]string{},
+			Command:     "PING",
+			Params:      []string{},
+			Trailing:    "irc.example.com",
+			HasTrailing: true,
+		},
+	},
+	{
+		line: ":nick!user@host JOIN #chan",
+		expected: Message{
+			Tags:    map[string]string{},
+			Source:  "nick!user@host",
+			Command: "JOIN",
+			Params:  []string{"#chan"},
+		},
+	},
+	{
+		line: ":server MODE #chan +o  nick",
+		expected: Message{
+			Tags:    map[string]string{},
+			Source:  "server",
+			Command: "MODE",
+			Params:  []string{"#chan", "+o", "nick"},
+		},
+	},
+	{
+		line: ":server 001 nick :Welcome to the network: nick",
+		expected: Message{
+			Tags:        map[string]string{},
+			Source:      "server",
+			Command:     "001",
+			Params:      []string{"nick"},
+			Trailing:    "Welcome to the network: nick",
+			HasTrailing: true,
+		},
+	},
+	{
+		line: `@time=2022-06-01T12:00:00.000Z;msgid=abc;+example/tag=a\sb\:c\\d\r\n;empty= :nick!user@host privmsg #chan :hello`,
+		expected: Message{
+			Tags: map[string]string{
+				"time":         "2022-06-01T12:00:00.000Z",
+				"msgid":        "abc",
+				"+example/tag": "a b;c\\d\r\n",
+				"empty":        "",
+			},
+			Source:      "nick!user@host",
+			Command:     "PRIVMSG",
+			Params:      []string{"#chan"},
+			Trailing:    "hello",
+			HasTrailing: true,
+		},
+	},
+	{
+		line: `@a=b\x\;c=\ :src NICK newnick`,
+		expected: Message{
+			Tags:    map[string]string{"a": "bx", "c": ""},
+			Source:  "src",
+			Command: "NICK",
+			Params:  []string{"newnick"},
+		},
+	},
+	{
+		line: "PRIVMSG #chan :",
+		expected: Message{
+			Tags:        map[string]string{},
+			Command:     "PRIVMSG",
+			Params:      []string{"#chan"},
+			HasTrailing: true,
+		},
+	},
+	{line: ":source", fails: true},
+	{line: ":source 12 foo", fails: true},
+	{line: "PRIV-MSG #chan", fails: true},
+}
+
+func TestParseLine(t *testing.T) {
+	for nTest, test := range parseLineTests {
+		got, err := ParseLine([]byte(test.line))
+
+		if test.fails {
+			if err == nil {
+				t.Errorf("(test %d) Expected an error, got %#v", nTest, got)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("(test %d) Failed with error: %s", nTest, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(got, test.expected) {
+			t.Errorf("(test %d) Bad message: expected %#v, got %#v", nTest, test.expected, got)
+		}
+	}
+}
+
+func TestParser_Write(t *testing.T) {
+	got := make([]Message, 0)
+
+	p := NewParser()
+	p.SetCallback(func(message Message) {
+		got = append(got, message)
+	})
+
+	chunks := []string{"PING :a\r", "\nJOIN #c", "han\n\r\nbad-line\r\nNICK x\r\n"}
+	var lastErr error
+	for _, c := range chunks {
+		if _, err := p.Write([]byte(c)); err != nil {
+			lastErr = err
+		}
+	}
+
+	if lastErr == nil {
+		t.Errorf("Expected an error for the faulty line")
+	}
+
+	commands := make([]string, 0)
+	for _, v := range got {
+		commands = append(commands, v.Command)
+	}
+
+	if !reflect.DeepEqual(commands, []string{"PING", "JOIN", "NICK"}) {
+		t.Errorf("Bad commands: %v", commands)
+	}
+}
+
+func TestParser_Write_LongLine(t *testing.T) {
+	got := make([]Message, 0)
+
+	p := NewParser()
+	p.SetCallback(func(message Message) {
+		got = append(got, message)
+	})
+
+	//the rest of a line that is too long isn't parsed as a line of its own
+	long := "PRIVMSG #chan :" + strings.Repeat("a", MaxLineLength)
+	chunks := []string{"PING :a\r\n" + long, strings.Repeat("b", 10) + " NICK x", "\r\nJOIN #chan\r\n"}
+
+	var firstErr error
+	for _, c := range chunks {
+		if _, err := p.Write([]byte(c)); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	if firstErr != ErrLineTooLong {
+		t.Errorf("Expected %v, got %v", ErrLineTooLong, firstErr)
+	}
+
+	commands := make([]string, 0)
+	for _, v := range got {
+		commands = append(commands, v.Command)
+	}
+
+	if !reflect.DeepEqual(commands, []string{"PING", "JOIN"}) {
+		t.Errorf("Bad commands: %v", commands)
+	}
+}
+
+func TestParser_Write_LongCompleteLine(t *testing.T) {
+	got := make([]Message, 0)
+
+	p := NewParser()
+	p.SetCallback(func(message Message) {
+		got = append(got, message)
+	})
+
+	//a line that is too long is skipped even if it arrives in one piece along with its line ending
+	long := "PRIVMSG #chan :" + strings.Repeat("a", MaxLineLength)
+	_, err := p.Write([]byte("PING :a\r\n" + long + "\r\nJOIN #chan\r\n"))
+
+	if err != ErrLineTooLong {
+		t.Errorf("Expected %v, got %v", ErrLineTooLong, err)
+	}
+
+	commands := make([]string, 0)
+	for _, v := range got {
+		commands = append(commands, v.Command)
+	}
+
+	if !reflect.DeepEqual(commands, []string{"PING", "JOIN"}) {
+		t.Errorf("Bad commands: %v", commands)
+	}
+}
+
+func TestMessage_Serialize(t *testing.T) {
+	msg := Message{
+		Tags:     map[string]string{"+draft/reply": "a;b c", "label": ""},
+		Command:  "PRIVMSG",
+		Params:   []string{"#chan"},
+		Trailing: "hi there",
+	}
+
+	expected := "@+draft/reply=a\\:b\\sc;label PRIVMSG #chan :hi there\r\n"
+	if str := string(msg.Serialize()); str != expected {
+		t.Errorf("Bad serialization: expected %q, got %q", expected, str)
+	}
+
+	reparsed, err := ParseLine(msg.Serialize()[:len(expected)-2])
+	if err != nil {
+		t.Fatalf("Failed with error: %s", err)
+	}
+
+	if !reflect.DeepEqual(reparsed.Tags, msg.Tags) {
+		t.Errorf("Tags did not survive a round trip: %v", reparsed.Tags)
+	}
+}
+
+func TestMessage_Serialize_EmptyTrailing(t *testing.T) {
+	tests := []struct {
+		msg      Message
+		expected string
+	}{
+		{Message{Command: "PRIVMSG", Params: []string{"#c"}, HasTrailing: true}, "PRIVMSG #c :\r\n"},
+		{Message{Command: "JOIN", Params: []string{"#c"}}, "JOIN #c\r\n"},
+		{Message{Command: "PRIVMSG", Params: []string{"#c"}, Trailing: "a"}, "PRIVMSG #c :a\r\n"},
+	}
+
+	for nTest, test := range tests {
+		if str := string(test.msg.Serialize()); str != test.expected {
+			t.Errorf("(test %d) Bad serialization: expected %q, got %q", nTest, test.expected, str)
+		}
+	}
+}
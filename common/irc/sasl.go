@@ -0,0 +1,152 @@
+package irc
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	SASLMechanismPlain    = "PLAIN"
+	SASLMechanismExternal = "EXTERNAL"
+
+	//saslChunkSize is the maximum length of a single AUTHENTICATE payload
+	saslChunkSize = 400
+)
+
+var (
+	ErrSASLFailed      = errors.New("SASL authentication failed")
+	ErrSASLUnsupported = errors.New("server does not support SASL")
+	ErrSASLConfig      = errors.New("bad SASL configuration")
+)
+
+//validateSASL checks that the configured mechanism is known and has what it needs
+func validateSASL(conf ClientConfig) error {
+	switch strings.ToUpper(conf.SASLMechanism) {
+	case "", SASLMechanismExternal:
+		return nil
+	case SASLMechanismPlain:
+		if len(conf.SASLAccount) == 0 || len(conf.SASLPassword) == 0 {
+			return fmt.Errorf("%w: %s needs an account and a password", ErrSASLConfig, SASLMechanismPlain)
+		}
+		return nil
+	default:
+		return fmt.Errorf("%w: unknown mechanism %q", ErrSASLConfig, conf.SASLMechanism)
+	}
+}
+
+//saslMechanism returns the mechanism to use, an empty string means that SASL is disabled
+//Only PLAIN is inferred from the credentials, a client certificate may just be there for CertFP so EXTERNAL has to be set explicitly
+func (client *Client) saslMechanism() string {
+	conf := client.config
+
+	if len(conf.SASLMechanism) != 0 {
+		return strings.ToUpper(conf.SASLMechanism)
+	}
+
+	if len(conf.SASLAccount) != 0 && len(conf.SASLPassword) != 0 {
+		return SASLMechanismPlain
+	}
+
+	return ""
+}
+
+func (client *Client) saslPayload() []byte {
+	switch client.saslMechanism() {
+	case SASLMechanismPlain:
+		return []byte(client.config.SASLAccount + "\x00" + client.config.SASLAccount + "\x00" + client.config.SASLPassword)
+	default:
+		return []byte{}
+	}
+}
+
+//startSASL is called once the sasl capability is acknowledged, the state mutex must be held
+func (client *Client) startSASL() {
+	mechanism := client.saslMechanism()
+
+	if mechs, ok := client.serverInfo.Capabilities["sasl"]; ok && len(mechs) != 0 {
+		if !listContains(strings.Split(mechs, ","), mechanism) {
+			client.failSASL(fmt.Errorf("%w: mechanism %s is not offered (server offers %s)", ErrSASLFailed, mechanism, mechs))
+			return
+		}
+	}
+
+	client.saslInProgress = true
+	client.SendMessage(Message{
+		Command: "AUTHENTICATE",
+		Params:  []string{mechanism},
+	})
+}
+
+func (client *Client) sendSASLPayload() {
+	encoded := base64.StdEncoding.EncodeToString(client.saslPayload())
+
+	if len(encoded) == 0 {
+		client.SendMessage(Message{Command: "AUTHENTICATE", Params: []string{"+"}})
+		return
+	}
+
+	for len(encoded) > 0 {
+		n := saslChunkSize
+		if len(encoded) < n {
+			n = len(encoded)
+		}
+
+		client.SendMessage(Message{Command: "AUTHENTICATE", Params: []string{encoded[:n]}})
+		encoded = encoded[n:]
+
+		//a payload that is a multiple of the chunk size has to be terminated explicitly
+		if len(encoded) == 0 && n == saslChunkSize {
+			client.SendMessage(Message{Command: "AUTHENTICATE", Params: []string{"+"}})
+		}
+	}
+}
+
+//failSASL aborts the registration, the state mutex must be held
+func (client *Client) failSASL(err error) {
+	client.saslInProgress = false
+	client.capNegotiating = false
+	client.finishRegistration(err)
+}
+
+func (client *Client) handleSASL(message Message) {
+	client.stateMutex.Lock()
+	defer client.stateMutex.Unlock()
+
+	switch message.Command {
+	case "AUTHENTICATE":
+		if client.saslInProgress && message.Param(0) == "+" {
+			client.sendSASLPayload()
+		}
+
+	case "900": //RPL_LOGGEDIN
+		client.clientInfo.Account = message.Param(2)
+
+	case "901": //RPL_LOGGEDOUT
+		client.clientInfo.Account = ""
+
+	case "903": //RPL_SASLSUCCESS
+		client.saslInProgress = false
+		client.maybeEndCapNegotiation()
+
+	case "902", "904", "905", "906": //ERR_NICKLOCKED, ERR_SASLFAIL, ERR_SASLTOOLONG, ERR_SASLABORTED
+		client.failSASL(fmt.Errorf("%w: %s %s", ErrSASLFailed, message.Command, message.Trailing))
+
+	case "907": //ERR_SASLALREADY
+		client.saslInProgress = false
+		client.maybeEndCapNegotiation()
+
+	case "908": //RPL_SASLMECHS
+		client.serverInfo.Capabilities["sasl"] = message.Param(1)
+	}
+}
+
+func listContains(list []string, str string) bool {
+	for _, v := range list {
+		if v == str {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,174 @@
+package irc
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+type saslTest struct {
+	conf  ClientConfig
+	steps []registrationStep
+	//err is what the registration fails with, nil if it goes on
+	err     error
+	account string
+}
+
+var saslTests = []saslTest{
+	{
+		conf: ClientConfig{Capabilities: []string{"server-time"}, SASLAccount: "acc", SASLPassword: "pass"},
+		steps: []registrationStep{
+			{":srv CAP * LS :server-time sasl=PLAIN,EXTERNAL", []string{"CAP REQ :server-time sasl"}},
+			{":srv CAP * ACK :server-time sasl", []string{"AUTHENTICATE PLAIN"}},
+			{"AUTHENTICATE +", []string{"AUTHENTICATE YWNjAGFjYwBwYXNz"}},
+			{":srv 900 me me!u@h acc :You are now logged in as acc", []string{}},
+			{":srv 903 me :SASL authentication successful", []string{"CAP END"}},
+		},
+		account: "acc",
+	},
+	{
+		conf: ClientConfig{Capabilities: []string{}, SASLMechanism: "plain", SASLAccount: "acc", SASLPassword: "wrong"},
+		steps: []registrationStep{
+			{":srv CAP * LS :sasl", []string{"CAP REQ :sasl"}},
+			{":srv CAP * ACK :sasl", []string{"AUTHENTICATE PLAIN"}},
+			{"AUTHENTICATE +", []string{"AUTHENTICATE YWNjAGFjYwB3cm9uZw=="}},
+			{":srv 904 me :SASL authentication failed", []string{}},
+		},
+		err: ErrSASLFailed,
+	},
+	{
+		conf: ClientConfig{Capabilities: []string{}, SASLAccount: "acc", SASLPassword: "pass"},
+		steps: []registrationStep{
+			{":srv CAP * LS :sasl", []string{"CAP REQ :sasl"}},
+			{":srv CAP * ACK :sasl", []string{"AUTHENTICATE PLAIN"}},
+			{"AUTHENTICATE +", []string{"AUTHENTICATE YWNjAGFjYwBwYXNz"}},
+			{":srv 905 me :SASL message too long", []string{}},
+		},
+		err: ErrSASLFailed,
+	},
+	//the mechanism isn't offered
+	{
+		conf: ClientConfig{Capabilities: []string{}, SASLAccount: "acc", SASLPassword: "pass"},
+		steps: []registrationStep{
+			{":srv CAP * LS :sasl=EXTERNAL", []string{"CAP REQ :sasl"}},
+			{":srv CAP * ACK :sasl", []string{}},
+		},
+		err: ErrSASLFailed,
+	},
+	//SASL isn't offered or is rejected
+	{
+		conf: ClientConfig{Capabilities: []string{}, SASLAccount: "acc", SASLPassword: "pass"},
+		steps: []registrationStep{
+			{":srv CAP * LS :server-time", []string{}},
+		},
+		err: ErrSASLUnsupported,
+	},
+	{
+		conf: ClientConfig{Capabilities: []string{}, SASLAccount: "acc", SASLPassword: "pass"},
+		steps: []registrationStep{
+			{":srv CAP * LS :sasl", []string{"CAP REQ :sasl"}},
+			{":srv CAP * NAK :sasl", []string{}},
+		},
+		err: ErrSASLUnsupported,
+	},
+	//without credentials SASL isn't requested even if it's offered
+	{
+		conf: ClientConfig{Capabilities: []string{}},
+		steps: []registrationStep{
+			{":srv CAP * LS :sasl", []string{"CAP END"}},
+		},
+	},
+}
+
+func TestClient_HandleSASL(t *testing.T) {
+	for nTest, test := range saslTests {
+		client := newRegisteringClient(t, test.conf)
+
+		for nStep, step := range test.steps {
+			feedLine(t, client, step.line)
+
+			if got := sentLines(client); !reflect.DeepEqual(got, step.sent) {
+				t.Errorf("(test %d, step %d) Bad reply to %q: expected %q, got %q", nTest, nStep, step.line, step.sent, got)
+			}
+		}
+
+		var err error
+		select {
+		case err = <-client.registrationResult:
+			if err == nil {
+				t.Errorf("(test %d) Expected the registration to go on, it succeeded", nTest)
+			}
+		default:
+		}
+
+		if !errors.Is(err, test.err) {
+			t.Errorf("(test %d) Expected the registration to fail with %v, got %v", nTest, test.err, err)
+		}
+
+		if client.clientInfo.Account != test.account {
+			t.Errorf("(test %d) Bad account: expected %q, got %q", nTest, test.account, client.clientInfo.Account)
+		}
+	}
+}
+
+func TestClient_SendSASLPayload(t *testing.T) {
+	//400 bytes of base64 are followed by a lone "+"
+	client := newRegisteringClient(t, ClientConfig{SASLAccount: "a", SASLPassword: string(make([]byte, 296))})
+	client.sendSASLPayload()
+
+	lines := sentLines(client)
+	if len(lines) != 2 || len(lines[0]) != len("AUTHENTICATE ")+400 || lines[1] != "AUTHENTICATE +" {
+		t.Errorf("Bad chunks: %q", lines)
+	}
+
+	client = newRegisteringClient(t, ClientConfig{SASLMechanism: SASLMechanismExternal})
+	client.sendSASLPayload()
+
+	if lines := sentLines(client); !reflect.DeepEqual(lines, []string{"AUTHENTICATE +"}) {
+		t.Errorf("Bad EXTERNAL payload: %q", lines)
+	}
+}
+
+func TestClient_SASLMechanism(t *testing.T) {
+	tests := []struct {
+		conf     ClientConfig
+		expected string
+	}{
+		{ClientConfig{}, ""},
+		{ClientConfig{SASLAccount: "acc", SASLPassword: "pass"}, SASLMechanismPlain},
+		{ClientConfig{SASLAccount: "acc"}, ""},
+		//a certificate alone is used for CertFP, not for SASL
+		{ClientConfig{TLSCertFile: "cert.pem"}, ""},
+		{ClientConfig{TLSCertFile: "cert.pem", SASLMechanism: "external"}, SASLMechanismExternal},
+	}
+
+	for nTest, test := range tests {
+		client := &Client{config: test.conf}
+		if got := client.saslMechanism(); got != test.expected {
+			t.Errorf("(test %d) Bad mechanism: expected %q, got %q", nTest, test.expected, got)
+		}
+	}
+}
+
+func TestNewClient_SASLConfig(t *testing.T) {
+	tests := []struct {
+		conf ClientConfig
+		err  error
+	}{
+		{ClientConfig{}, nil},
+		{ClientConfig{SASLMechanism: "plain", SASLAccount: "acc", SASLPassword: "pass"}, nil},
+		{ClientConfig{SASLMechanism: SASLMechanismExternal}, nil},
+		{ClientConfig{SASLMechanism: SASLMechanismPlain, SASLAccount: "acc"}, ErrSASLConfig},
+		{ClientConfig{SASLMechanism: "SCRAM-SHA-256", SASLAccount: "acc", SASLPassword: "pass"}, ErrSASLConfig},
+		{ClientConfig{SASLMechanism: "EXTRENAL"}, ErrSASLConfig},
+	}
+
+	for nTest, test := range tests {
+		test.conf.Address = "irc.example.com:6667"
+		test.conf.Nick = "me"
+
+		if _, err := NewClient(test.conf); !errors.Is(err, test.err) {
+			t.Errorf("(test %d) Expected %v, got %v", nTest, test.err, err)
+		}
+	}
+}
@@ -0,0 +1,264 @@
+package irc
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	//MaxMessageLength is the maximum length of a line excluding tags, including the line ending
+	MaxMessageLength = 512
+
+	//minimumSplitBudget is the smallest budget SplitText works with, smaller budgets are raised to this
+	minimumSplitBudget = 32
+
+	//worst case lengths for the parts of our own source that we don't know yet
+	fallbackUserLength = 11
+	fallbackHostLength = 63
+)
+
+const (
+	FormatBold          = '\x02'
+	FormatColor         = '\x03'
+	FormatHexColor      = '\x04'
+	FormatReset         = '\x0F'
+	FormatMonospace     = '\x11'
+	FormatReverse       = '\x16'
+	FormatItalic        = '\x1D'
+	FormatStrikeThrough = '\x1E'
+	FormatUnderline     = '\x1F'
+)
+
+//formatToggles are the formatting codes that toggle a state on or off, in the order they are restored in
+var formatToggles = []byte{FormatBold, FormatItalic, FormatUnderline, FormatStrikeThrough, FormatMonospace, FormatReverse}
+
+//formatState is the formatting in effect at some point of a line of IRC formatted text
+type formatState struct {
+	toggles    map[byte]bool
+	colorCode  byte
+	foreground string
+	background string
+}
+
+func newFormatState() formatState {
+	return formatState{toggles: make(map[byte]bool)}
+}
+
+func (state formatState) clone() formatState {
+	newState := state
+	newState.toggles = make(map[byte]bool, len(state.toggles))
+	for k, v := range state.toggles {
+		newState.toggles[k] = v
+	}
+	return newState
+}
+
+//prefix returns the formatting codes that restore the state at the start of a new line
+func (state formatState) prefix() string {
+	builder := strings.Builder{}
+
+	for _, v := range formatToggles {
+		if state.toggles[v] {
+			builder.WriteByte(v)
+		}
+	}
+
+	if len(state.foreground) != 0 {
+		builder.WriteByte(state.colorCode)
+		builder.WriteString(state.foreground)
+		if len(state.background) != 0 {
+			builder.WriteByte(',')
+			builder.WriteString(state.background)
+		}
+	}
+
+	return builder.String()
+}
+
+//apply updates the state with a formatting code as returned by nextFormatCode
+func (state *formatState) apply(code string) {
+	switch code[0] {
+	case FormatReset:
+		*state = newFormatState()
+	case FormatColor, FormatHexColor:
+		fg, bg, hasComma := strings.Cut(code[1:], ",")
+		if len(fg) == 0 {
+			state.foreground, state.background = "", ""
+			return
+		}
+
+		//colour codes are restored with two digits so that the text following them can't be mistaken as a part of them
+		if code[0] == FormatColor && len(fg) == 1 {
+			fg = "0" + fg
+		}
+		if code[0] == FormatColor && len(bg) == 1 {
+			bg = "0" + bg
+		}
+
+		state.colorCode = code[0]
+		state.foreground = fg
+		if hasComma {
+			state.background = bg
+		}
+	default:
+		state.toggles[code[0]] = !state.toggles[code[0]]
+	}
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isHexDigit(c byte) bool {
+	return isDigit(c) || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
+
+//nextFormatCode returns the length of the formatting code at the start of str, zero if there is none
+func nextFormatCode(str string) int {
+	if len(str) == 0 {
+		return 0
+	}
+
+	CountWhile := func(start, max int, pred func(byte) bool) int {
+		n := 0
+		for start+n < len(str) && n < max && pred(str[start+n]) {
+			n++
+		}
+		return n
+	}
+
+	switch str[0] {
+	case FormatBold, FormatItalic, FormatUnderline, FormatStrikeThrough, FormatMonospace, FormatReverse, FormatReset:
+		return 1
+	case FormatColor, FormatHexColor:
+		maxDigits, pred := 2, isDigit
+		if str[0] == FormatHexColor {
+			maxDigits, pred = 6, isHexDigit
+		}
+
+		n := 1 + CountWhile(1, maxDigits, pred)
+		if n > 1 && n < len(str) && str[n] == ',' {
+			if m := CountWhile(n+1, maxDigits, pred); m > 0 {
+				n += 1 + m
+			}
+		}
+		return n
+	}
+
+	return 0
+}
+
+//hasVisibleText returns whether a line contains anything other than formatting codes
+func hasVisibleText(line string) bool {
+	for len(line) > 0 {
+		n := nextFormatCode(line)
+		if n == 0 {
+			return true
+		}
+		line = line[n:]
+	}
+	return false
+}
+
+//SplitText splits IRC formatted text into lines of at most budget bytes. Newlines always start a new line, long lines are split at spaces if possible and at rune boundaries otherwise.
+//Formatting in effect at the end of a line is restored at the start of the next one. Lines without visible text are dropped.
+func SplitText(text string, budget int) []string {
+	if budget < minimumSplitBudget {
+		budget = minimumSplitBudget
+	}
+
+	lines := make([]string, 0)
+	state := newFormatState()
+
+	for _, inputLine := range strings.Split(text, "\n") {
+		inputLine = strings.TrimSuffix(inputLine, "\r")
+
+		current := state.prefix()
+		//lastSpace is the index of the last space in current, prefixLen is the length of the restored formatting
+		lastSpace, prefixLen := -1, len(current)
+		stateAtSpace := state.clone()
+
+		Flush := func() {
+			if lastSpace > prefixLen {
+				line, rest := current[:lastSpace], current[lastSpace+1:]
+				if hasVisibleText(line) {
+					lines = append(lines, line)
+				}
+				current = stateAtSpace.prefix() + rest
+				prefixLen = len(current) - len(rest)
+			} else {
+				if hasVisibleText(current) {
+					lines = append(lines, current)
+				}
+				current = state.prefix()
+				prefixLen = len(current)
+			}
+			lastSpace = -1
+		}
+
+		for len(inputLine) > 0 {
+			if n := nextFormatCode(inputLine); n != 0 {
+				if len(current)+n > budget {
+					Flush()
+				}
+				current += inputLine[:n]
+				state.apply(inputLine[:n])
+				inputLine = inputLine[n:]
+				continue
+			}
+
+			_, n := utf8.DecodeRuneInString(inputLine)
+			for len(current)+n > budget {
+				before := len(current)
+				Flush()
+				if len(current) == before {
+					//the restored formatting alone doesn't leave any room, give up on it
+					current = ""
+					prefixLen = 0
+				}
+			}
+
+			if inputLine[0] == ' ' {
+				lastSpace = len(current)
+				stateAtSpace = state.clone()
+			}
+
+			current += inputLine[:n]
+			inputLine = inputLine[n:]
+		}
+
+		if hasVisibleText(current) {
+			lines = append(lines, current)
+		}
+	}
+
+	return lines
+}
+
+//MessageBudget returns the number of bytes available for the text of a message with the given command and target, taking the source the server will prepend into account
+func (client *Client) MessageBudget(command, target string) int {
+	client.stateMutex.RLock()
+	defer client.stateMutex.RUnlock()
+
+	userLen := len(client.clientInfo.User)
+	if userLen == 0 || !client.selfSourceKnown {
+		//the server may prepend a tilde to the username
+		userLen = fallbackUserLength
+	}
+
+	hostLen := len(client.clientInfo.DisplayedHost)
+	if hostLen == 0 {
+		hostLen = fallbackHostLength
+	}
+
+	//":nick!user@host COMMAND target :text\r\n"
+	overhead := 1 + len(client.clientInfo.Nick) + 1 + userLen + 1 + hostLen + 1 +
+		len(command) + 1 + len(target) + 2 + len(separator)
+
+	return MaxMessageLength - overhead
+}
+
+//SplitMessage splits IRC formatted text into lines that fit in messages with the given command and target, see SplitText
+func (client *Client) SplitMessage(command, target, text string) []string {
+	return SplitText(text, client.MessageBudget(command, target))
+}
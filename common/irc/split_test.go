@@ -0,0 +1,77 @@
+package irc
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+type splitTextTest struct {
+	text     string
+	budget   int
+	expected []string
+}
+
+var splitTextTests = []splitTextTest{
+	{
+		text:     "short",
+		budget:   64,
+		expected: []string{"short"},
+	},
+	{
+		text:     "first line\r\nsecond line\n\nthird",
+		budget:   64,
+		expected: []string{"first line", "second line", "third"},
+	},
+	{
+		text:     "the quick brown fox jumps over the lazy dog again",
+		budget:   32,
+		expected: []string{"the quick brown fox jumps over", "the lazy dog again"},
+	},
+	{
+		text:     strings.Repeat("a", 40),
+		budget:   32,
+		expected: []string{strings.Repeat("a", 32), strings.Repeat("a", 8)},
+	},
+	{
+		text:     "\x02bold \x1Ditalic\x1D\x0304,2 and coloured text that goes on",
+		budget:   32,
+		expected: []string{"\x02bold \x1Ditalic\x1D\x0304,2 and", "\x02\x0304,02coloured text that goes", "\x02\x0304,02on"},
+	},
+	{
+		text:     "\x02bold\n\x02plain",
+		budget:   32,
+		expected: []string{"\x02bold", "\x02\x02plain"},
+	},
+}
+
+func TestSplitText(t *testing.T) {
+	for nTest, test := range splitTextTests {
+		got := SplitText(test.text, test.budget)
+		if !reflect.DeepEqual(got, test.expected) {
+			t.Errorf("(test %d) Bad split: expected %q, got %q", nTest, test.expected, got)
+		}
+
+		for _, line := range got {
+			if len(line) > test.budget {
+				t.Errorf("(test %d) Line exceeds the budget: %q", nTest, line)
+			}
+		}
+	}
+}
+
+func TestSplitText_Runes(t *testing.T) {
+	text := strings.Repeat("ğüşiöç", 20)
+
+	lines := SplitText(text, 33)
+	if strings.Join(lines, "") != text {
+		t.Errorf("Text did not survive the split")
+	}
+
+	for _, line := range lines {
+		if !utf8.ValidString(line) {
+			t.Errorf("Split in the middle of a rune: %q", line)
+		}
+	}
+}
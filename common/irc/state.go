@@ -0,0 +1,587 @@
+package irc
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//ChannelMember is a user in a channel along with the prefix modes ("ov") they have in that channel
+type ChannelMember struct {
+	Nick  string
+	Modes string
+}
+
+//HasMode returns whether the member has the given prefix mode, i.e. 'o' for operators
+func (member ChannelMember) HasMode(mode rune) bool {
+	return strings.ContainsRune(member.Modes, mode)
+}
+
+//Channel is the tracked state of a channel that we are in
+type Channel struct {
+	Name string
+
+	Topic      string
+	TopicSetBy string
+	TopicSetAt time.Time
+
+	//Members is keyed by the casefolded nick
+	Members map[string]ChannelMember
+	//Modes holds the modes that are not list modes, along with their arguments
+	Modes ModeStore
+	//Lists holds the masks of list modes such as bans (+b), exceptions (+e) and invite exceptions (+I)
+	Lists map[rune][]string
+}
+
+func newChannel(name string) *Channel {
+	return &Channel{
+		Name:    name,
+		Members: make(map[string]ChannelMember),
+		Modes:   NewModeStore(),
+		Lists:   make(map[rune][]string),
+	}
+}
+
+func (channel *Channel) clone() Channel {
+	newChannel := *channel
+
+	newChannel.Members = make(map[string]ChannelMember, len(channel.Members))
+	for k, v := range channel.Members {
+		newChannel.Members[k] = v
+	}
+
+	newChannel.Modes = channel.Modes.clone()
+
+	newChannel.Lists = make(map[rune][]string, len(channel.Lists))
+	for k, v := range channel.Lists {
+		newChannel.Lists[k] = append([]string{}, v...)
+	}
+
+	return newChannel
+}
+
+//User is the tracked state of a user that shares a channel with us
+type User struct {
+	Nick        string
+	User        string
+	Host        string
+	Account     string
+	RealName    string
+	Away        bool
+	AwayMessage string
+}
+
+//listReplies maps the numerics of list replies to the list mode they belong to
+var listReplies = map[string]rune{
+	"367": 'b', //RPL_BANLIST
+	"348": 'e', //RPL_EXCEPTLIST
+	"346": 'I', //RPL_INVITELIST
+}
+
+//listEndReplies maps the numerics that end list replies to the list mode they belong to
+var listEndReplies = map[string]rune{
+	"368": 'b', //RPL_ENDOFBANLIST
+	"349": 'e', //RPL_ENDOFEXCEPTLIST
+	"347": 'I', //RPL_ENDOFINVITELIST
+}
+
+//resetTracking clears every tracked channel and user, the state mutex must be held
+func (client *Client) resetTracking() {
+	client.channels = make(map[string]*Channel)
+	client.users = make(map[string]*User)
+	client.namesBuffer = make(map[string]map[string]ChannelMember)
+	client.listBuffer = make(map[string]map[rune][]string)
+}
+
+//fold casefolds a nick or a channel name for use as a map key, the state mutex must be held
+func (client *Client) fold(str string) string {
+	return Casefold(client.serverInfo.CaseMapping, str)
+}
+
+//isSelf returns whether the nick is our own, the state mutex must be held
+func (client *Client) isSelf(nick string) bool {
+	return client.fold(nick) == client.fold(client.clientInfo.Nick)
+}
+
+//isChannelName returns whether the target is a channel according to the channel types of the server, the state mutex must be held
+func (client *Client) isChannelName(target string) bool {
+	return len(target) > 0 && strings.IndexByte(client.serverInfo.ChannelTypes, target[0]) != -1
+}
+
+//splitPrefixes splits a nick from a NAMES reply into the nick and the prefix modes it has, the state mutex must be held
+func (client *Client) splitPrefixes(str string) (string, string) {
+	modes := make([]byte, 0)
+
+	for len(str) > 0 {
+		idx := strings.IndexByte(client.serverInfo.PrefixSymbols, str[0])
+		if idx == -1 || idx >= len(client.serverInfo.PrefixModes) {
+			break
+		}
+
+		modes = append(modes, client.serverInfo.PrefixModes[idx])
+		str = str[1:]
+	}
+
+	return str, client.sortPrefixModes(string(modes))
+}
+
+//sortPrefixModes orders prefix modes by their rank, highest first, the state mutex must be held
+func (client *Client) sortPrefixModes(modes string) string {
+	order := client.serverInfo.PrefixModes
+	runes := []rune(modes)
+
+	sort.Slice(runes, func(i, j int) bool {
+		return strings.IndexRune(order, runes[i]) < strings.IndexRune(order, runes[j])
+	})
+
+	return string(runes)
+}
+
+//getOrAddUser returns the tracked user for the given source, adding it if missing and filling in the user and host if known, the state mutex must be held
+func (client *Client) getOrAddUser(source string) *User {
+	parts := ParseSource(source)
+	key := client.fold(parts[0])
+
+	user, ok := client.users[key]
+	if !ok {
+		user = &User{Nick: parts[0]}
+		client.users[key] = user
+	}
+
+	if len(parts) == 3 {
+		user.User = parts[1]
+		user.Host = parts[2]
+	}
+
+	return user
+}
+
+//updateSelfSource records our own user and host if the source is ours, the state mutex must be held
+func (client *Client) updateSelfSource(nick, user, host string) {
+	if !client.isSelf(nick) || len(user) == 0 || len(host) == 0 {
+		return
+	}
+
+	client.clientInfo.User = user
+	client.clientInfo.DisplayedHost = host
+	client.selfSourceKnown = true
+}
+
+//forgetUserIfAlone removes a user that no longer shares a channel with us, the state mutex must be held
+func (client *Client) forgetUserIfAlone(nick string) {
+	key := client.fold(nick)
+
+	for _, channel := range client.channels {
+		if _, ok := channel.Members[key]; ok {
+			return
+		}
+	}
+
+	delete(client.users, key)
+}
+
+func (client *Client) handleStateMessage(message Message) {
+	client.stateMutex.Lock()
+	defer client.stateMutex.Unlock()
+
+	sourceNick := ParseSource(message.Source)[0]
+	params := message.AllParams()
+
+	switch message.Command {
+	case "JOIN":
+		if len(params) < 1 {
+			return
+		}
+
+		channelKey := client.fold(params[0])
+		if client.isSelf(sourceNick) {
+			client.channels[channelKey] = newChannel(params[0])
+		}
+
+		channel, ok := client.channels[channelKey]
+		if !ok {
+			return
+		}
+
+		user := client.getOrAddUser(message.Source)
+		client.updateSelfSource(user.Nick, user.User, user.Host)
+		//extended-join
+		if len(params) >= 3 {
+			if params[1] != "*" {
+				user.Account = params[1]
+			} else {
+				user.Account = ""
+			}
+			user.RealName = params[2]
+		}
+
+		channel.Members[client.fold(sourceNick)] = ChannelMember{Nick: sourceNick}
+
+	case "PART", "KICK":
+		if len(params) < 1 {
+			return
+		}
+
+		nick := sourceNick
+		if message.Command == "KICK" {
+			if len(params) < 2 {
+				return
+			}
+			nick = params[1]
+		}
+
+		channelKey := client.fold(params[0])
+		if client.isSelf(nick) {
+			channel, ok := client.channels[channelKey]
+			delete(client.channels, channelKey)
+
+			if ok {
+				for _, member := range channel.Members {
+					client.forgetUserIfAlone(member.Nick)
+				}
+			}
+			return
+		}
+
+		if channel, ok := client.channels[channelKey]; ok {
+			delete(channel.Members, client.fold(nick))
+			client.forgetUserIfAlone(nick)
+		}
+
+	case "QUIT":
+		key := client.fold(sourceNick)
+		for _, channel := range client.channels {
+			delete(channel.Members, key)
+		}
+		delete(client.users, key)
+
+	case "NICK":
+		if len(params) < 1 {
+			return
+		}
+
+		newNick := params[0]
+		oldKey, newKey := client.fold(sourceNick), client.fold(newNick)
+
+		if client.isSelf(sourceNick) {
+			client.clientInfo.Nick = newNick
+		}
+
+		for _, channel := range client.channels {
+			if member, ok := channel.Members[oldKey]; ok {
+				delete(channel.Members, oldKey)
+				member.Nick = newNick
+				channel.Members[newKey] = member
+			}
+		}
+
+		if user, ok := client.users[oldKey]; ok {
+			delete(client.users, oldKey)
+			user.Nick = newNick
+			client.users[newKey] = user
+		}
+
+	case "CHGHOST":
+		if user, ok := client.users[client.fold(sourceNick)]; ok && len(params) >= 2 {
+			user.User = params[0]
+			user.Host = params[1]
+		}
+		if len(params) >= 2 {
+			client.updateSelfSource(sourceNick, params[0], params[1])
+		}
+
+	case "352": //RPL_WHOREPLY
+		//<me> <channel> <user> <host> <server> <nick> <flags> :<hopcount> <realname>
+		if len(params) < 6 {
+			return
+		}
+
+		client.updateSelfSource(params[5], params[2], params[3])
+
+		if user, ok := client.users[client.fold(params[5])]; ok {
+			user.User = params[2]
+			user.Host = params[3]
+			if len(params) >= 7 {
+				user.Away = strings.HasPrefix(params[6], "G")
+			}
+			if len(params) >= 8 {
+				if _, realName, ok := strings.Cut(params[7], " "); ok {
+					user.RealName = realName
+				}
+			}
+		}
+
+	case "ACCOUNT":
+		if user, ok := client.users[client.fold(sourceNick)]; ok && len(params) >= 1 {
+			if params[0] == "*" {
+				user.Account = ""
+			} else {
+				user.Account = params[0]
+			}
+		}
+
+	case "AWAY":
+		if user, ok := client.users[client.fold(sourceNick)]; ok {
+			user.Away = len(params) > 0
+			user.AwayMessage = message.Param(0)
+		}
+
+	case "TOPIC":
+		if channel, ok := client.channels[client.fold(message.Param(0))]; ok {
+			channel.Topic = message.Param(1)
+			channel.TopicSetBy = message.Source
+			channel.TopicSetAt = time.Now()
+		}
+
+	case "332": //RPL_TOPIC
+		if channel, ok := client.channels[client.fold(message.Param(1))]; ok {
+			channel.Topic = message.Param(2)
+		}
+
+	case "333": //RPL_TOPICWHOTIME
+		if channel, ok := client.channels[client.fold(message.Param(1))]; ok {
+			channel.TopicSetBy = message.Param(2)
+			if ts, err := strconv.ParseInt(message.Param(3), 10, 64); err == nil {
+				channel.TopicSetAt = time.Unix(ts, 0)
+			}
+		}
+
+	case "353": //RPL_NAMREPLY
+		if len(params) < 4 {
+			return
+		}
+
+		channelKey := client.fold(params[2])
+		if _, ok := client.channels[channelKey]; !ok {
+			return
+		}
+
+		buffer, ok := client.namesBuffer[channelKey]
+		if !ok {
+			buffer = make(map[string]ChannelMember)
+			client.namesBuffer[channelKey] = buffer
+		}
+
+		for _, entry := range strings.Split(params[3], " ") {
+			if len(entry) == 0 {
+				continue
+			}
+
+			//with userhost-in-names the entries are full sources
+			source, modes := client.splitPrefixes(entry)
+			user := client.getOrAddUser(source)
+			buffer[client.fold(user.Nick)] = ChannelMember{Nick: user.Nick, Modes: modes}
+		}
+
+	case "366": //RPL_ENDOFNAMES
+		channelKey := client.fold(message.Param(1))
+		buffer, ok := client.namesBuffer[channelKey]
+		delete(client.namesBuffer, channelKey)
+
+		if channel, channelOk := client.channels[channelKey]; channelOk && ok {
+			oldMembers := channel.Members
+			channel.Members = buffer
+
+			for _, member := range oldMembers {
+				client.forgetUserIfAlone(member.Nick)
+			}
+		}
+
+	case "324": //RPL_CHANNELMODEIS
+		if len(params) < 3 {
+			return
+		}
+
+		if channel, ok := client.channels[client.fold(params[1])]; ok {
+			channel.Modes = NewModeStore()
+			client.applyChannelModes(channel, params[2], params[3:])
+		}
+
+	case "367", "348", "346":
+		channelKey := client.fold(message.Param(1))
+		if _, ok := client.channels[channelKey]; !ok {
+			return
+		}
+
+		if _, ok := client.listBuffer[channelKey]; !ok {
+			client.listBuffer[channelKey] = make(map[rune][]string)
+		}
+
+		mode := listReplies[message.Command]
+		client.listBuffer[channelKey][mode] = append(client.listBuffer[channelKey][mode], message.Param(2))
+
+	case "368", "349", "347":
+		channelKey := client.fold(message.Param(1))
+		mode := listEndReplies[message.Command]
+
+		channel, ok := client.channels[channelKey]
+		if !ok {
+			return
+		}
+
+		channel.Lists[mode] = client.listBuffer[channelKey][mode]
+		if channel.Lists[mode] == nil {
+			channel.Lists[mode] = []string{}
+		}
+
+		if buffer, ok := client.listBuffer[channelKey]; ok {
+			delete(buffer, mode)
+		}
+
+	case "MODE":
+		if len(params) < 2 {
+			return
+		}
+
+		if client.isChannelName(params[0]) {
+			if channel, ok := client.channels[client.fold(params[0])]; ok {
+				client.applyChannelModes(channel, params[1], params[2:])
+			}
+		} else if client.isSelf(params[0]) {
+			client.clientInfo.Modes.ApplyModeString(params[1])
+		}
+
+	case "221": //RPL_UMODEIS
+		client.clientInfo.Modes = NewModeStore()
+		client.clientInfo.Modes.ApplyModeString(message.Param(1))
+	}
+}
+
+//applyChannelModes applies a mode string to a channel, the state mutex must be held
+func (client *Client) applyChannelModes(channel *Channel, modes string, args []string) {
+	info := client.serverInfo
+
+	for _, change := range ParseChannelModeChanges(modes, args, info.ChannelModes, info.PrefixModes) {
+		switch {
+		case strings.ContainsRune(info.PrefixModes, change.Mode):
+			key := client.fold(change.Argument)
+			member, ok := channel.Members[key]
+			if !ok {
+				continue
+			}
+
+			if change.Adding && !member.HasMode(change.Mode) {
+				member.Modes = client.sortPrefixModes(member.Modes + string(change.Mode))
+			} else if !change.Adding {
+				member.Modes = strings.ReplaceAll(member.Modes, string(change.Mode), "")
+			}
+
+			channel.Members[key] = member
+
+		case strings.ContainsRune(info.ChannelModes.List, change.Mode):
+			if len(change.Argument) == 0 {
+				continue
+			}
+
+			list := channel.Lists[change.Mode]
+			newList := make([]string, 0, len(list)+1)
+			for _, v := range list {
+				if v != change.Argument {
+					newList = append(newList, v)
+				}
+			}
+
+			if change.Adding {
+				newList = append(newList, change.Argument)
+			}
+
+			channel.Lists[change.Mode] = newList
+
+		default:
+			if change.Adding {
+				channel.Modes.AddModeWithArgument(change.Mode, change.Argument)
+			} else {
+				channel.Modes.RemoveMode(change.Mode)
+			}
+		}
+	}
+}
+
+//Channels returns the names of the channels we are in
+func (client *Client) Channels() []string {
+	client.stateMutex.RLock()
+	defer client.stateMutex.RUnlock()
+
+	names := make([]string, 0, len(client.channels))
+	for _, channel := range client.channels {
+		names = append(names, channel.Name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+//GetChannel returns a copy of the tracked state of a channel
+func (client *Client) GetChannel(name string) (Channel, bool) {
+	client.stateMutex.RLock()
+	defer client.stateMutex.RUnlock()
+
+	channel, ok := client.channels[client.fold(name)]
+	if !ok {
+		return Channel{}, false
+	}
+
+	return channel.clone(), true
+}
+
+//GetChannelMember returns the membership of a nick in a channel
+func (client *Client) GetChannelMember(channelName, nick string) (ChannelMember, bool) {
+	client.stateMutex.RLock()
+	defer client.stateMutex.RUnlock()
+
+	channel, ok := client.channels[client.fold(channelName)]
+	if !ok {
+		return ChannelMember{}, false
+	}
+
+	member, ok := channel.Members[client.fold(nick)]
+	return member, ok
+}
+
+//IsChannelOperator returns whether the nick has operator status (or higher, e.g. +q or +a) in a channel
+func (client *Client) IsChannelOperator(channelName, nick string) bool {
+	member, ok := client.GetChannelMember(channelName, nick)
+	if !ok {
+		return false
+	}
+
+	client.stateMutex.RLock()
+	defer client.stateMutex.RUnlock()
+
+	opIdx := strings.IndexByte(client.serverInfo.PrefixModes, 'o')
+	for _, mode := range member.Modes {
+		if idx := strings.IndexRune(client.serverInfo.PrefixModes, mode); idx != -1 && (opIdx == -1 || idx <= opIdx) {
+			return true
+		}
+	}
+
+	return false
+}
+
+//GetUser returns a copy of the tracked state of a user that shares a channel with us
+func (client *Client) GetUser(nick string) (User, bool) {
+	client.stateMutex.RLock()
+	defer client.stateMutex.RUnlock()
+
+	user, ok := client.users[client.fold(nick)]
+	if !ok {
+		return User{}, false
+	}
+
+	return *user, true
+}
+
+//HasUserMode returns whether we have the given user mode
+func (client *Client) HasUserMode(mode rune) bool {
+	client.stateMutex.RLock()
+	defer client.stateMutex.RUnlock()
+	return client.clientInfo.Modes.HasMode(mode)
+}
+
+//UserModes returns our user modes as a mode string
+func (client *Client) UserModes() string {
+	client.stateMutex.RLock()
+	defer client.stateMutex.RUnlock()
+	return client.clientInfo.Modes.String()
+}
@@ -0,0 +1,212 @@
+package irc
+
+import (
+	"reflect"
+	"testing"
+)
+
+//newStateClient returns a client registered as "me" on a server that sent the given RPL_ISUPPORT tokens
+func newStateClient(t *testing.T, isupport []string) *Client {
+	client, err := NewClient(ClientConfig{Address: "irc.example.com:6667", Nick: "me"})
+	if err != nil {
+		t.Fatalf("Failed to create a client: %s", err)
+	}
+
+	client.clientInfo.Nick = "me"
+	if len(isupport) != 0 {
+		params := append(append([]string{"me"}, isupport...), "are supported by this server")
+		client.handleISupport(Message{Command: "005", Params: params})
+	}
+
+	return client
+}
+
+type stateTest struct {
+	isupport []string
+	lines    []string
+
+	channel string
+	//members maps the nicks in the channel to their prefix modes, nil if we shouldn't be in the channel
+	members   map[string]string
+	operators []string
+	modes     string
+	arguments map[rune]string
+	lists     map[rune][]string
+
+	users  []User
+	absent []string
+}
+
+var stateTests = []stateTest{
+	//multi-prefix
+	{
+		isupport: []string{"PREFIX=(qaohv)~&@%+"},
+		lines: []string{
+			":me!u@h JOIN #chan",
+			":srv 353 me = #chan :~@alice @+bob %carol +dave erin me",
+			":srv 366 me #chan :End of /NAMES list.",
+		},
+		channel:   "#chan",
+		members:   map[string]string{"alice": "qo", "bob": "ov", "carol": "h", "dave": "v", "erin": "", "me": ""},
+		operators: []string{"alice", "bob"},
+		modes:     "+",
+		users:     []User{{Nick: "me", User: "u", Host: "h"}, {Nick: "alice"}, {Nick: "erin"}},
+	},
+	//userhost-in-names, lookups are casefolded
+	{
+		lines: []string{
+			":me!u@h JOIN #Chan",
+			":srv 353 me = #Chan :@Alice!a@host.a bob!b@host.b me!u@h",
+			":srv 366 me #Chan :End of /NAMES list.",
+		},
+		channel:   "#CHAN",
+		members:   map[string]string{"ALICE": "o", "Bob": "", "me": ""},
+		operators: []string{"alice"},
+		modes:     "+",
+		users:     []User{{Nick: "Alice", User: "a", Host: "host.a"}, {Nick: "bob", User: "b", Host: "host.b"}},
+	},
+	//+k always takes an argument, +l only when it's set
+	{
+		lines: []string{
+			":me!u@h JOIN #chan",
+			":srv 353 me = #chan :@alice bob me",
+			":srv 366 me #chan :End of /NAMES list.",
+			":srv 324 me #chan +kln secret 10",
+			":alice!a@h MODE #chan -l+o-k+b bob secret *!*@bad",
+			":alice!a@h MODE #chan +l-o 20 alice",
+		},
+		channel:   "#chan",
+		members:   map[string]string{"alice": "", "bob": "o", "me": ""},
+		operators: []string{"bob"},
+		modes:     "+ln",
+		arguments: map[rune]string{'l': "20", 'n': ""},
+		lists:     map[rune][]string{'b': {"*!*@bad"}},
+	},
+	//list replies replace the list, an empty one ends up empty rather than missing
+	{
+		lines: []string{
+			":me!u@h JOIN #chan",
+			":alice!a@h MODE #chan +b *!*@old",
+			":srv 367 me #chan *!*@a alice 1650000000",
+			":srv 367 me #chan *!*@b alice 1650000001",
+			":srv 368 me #chan :End of channel ban list",
+			":srv 349 me #chan :End of channel exception list",
+			":srv 346 me #other *!*@c alice 1650000002",
+		},
+		channel: "#chan",
+		members: map[string]string{"me": ""},
+		modes:   "+",
+		lists:   map[rune][]string{'b': {"*!*@a", "*!*@b"}, 'e': {}},
+	},
+	//parting forgets the channel and the users we no longer share a channel with
+	{
+		lines: []string{
+			":me!u@h JOIN #a",
+			":srv 353 me = #a :alice bob me",
+			":srv 366 me #a :End of /NAMES list.",
+			":me!u@h JOIN #b",
+			":srv 353 me = #b :bob me",
+			":srv 366 me #b :End of /NAMES list.",
+			":me!u@h PART #a :bye",
+		},
+		channel: "#a",
+		users:   []User{{Nick: "bob"}},
+		absent:  []string{"alice"},
+	},
+	//so does being kicked
+	{
+		lines: []string{
+			":me!u@h JOIN #a",
+			":srv 353 me = #a :@alice bob me",
+			":srv 366 me #a :End of /NAMES list.",
+			":me!u@h JOIN #b",
+			":srv 353 me = #b :bob me",
+			":srv 366 me #b :End of /NAMES list.",
+			":alice!a@h KICK #a ME :bye",
+			":alice!a@h PRIVMSG #b :still here?",
+		},
+		channel: "#a",
+		users:   []User{{Nick: "bob"}},
+		absent:  []string{"alice"},
+	},
+	//others being kicked only removes them
+	{
+		lines: []string{
+			":me!u@h JOIN #chan",
+			":srv 353 me = #chan :@alice bob me",
+			":srv 366 me #chan :End of /NAMES list.",
+			":alice!a@h KICK #chan bob :bye",
+		},
+		channel:   "#chan",
+		members:   map[string]string{"alice": "o", "me": ""},
+		operators: []string{"alice"},
+		modes:     "+",
+		users:     []User{{Nick: "alice"}},
+		absent:    []string{"bob"},
+	},
+}
+
+func TestClient_HandleStateMessage(t *testing.T) {
+	for nTest, test := range stateTests {
+		client := newStateClient(t, test.isupport)
+
+		for _, line := range test.lines {
+			message, err := ParseLine([]byte(line))
+			if err != nil {
+				t.Fatalf("(test %d) Failed to parse %q: %s", nTest, line, err)
+			}
+			client.handleStateMessage(message)
+		}
+
+		channel, ok := client.GetChannel(test.channel)
+		if ok != (test.members != nil) {
+			t.Errorf("(test %d) Expected the channel to be tracked: %v, got %v", nTest, test.members != nil, ok)
+		}
+
+		if test.members != nil {
+			if len(channel.Members) != len(test.members) {
+				t.Errorf("(test %d) Bad members: expected %v, got %v", nTest, test.members, channel.Members)
+			}
+
+			for nick, modes := range test.members {
+				member, ok := client.GetChannelMember(test.channel, nick)
+				if !ok || member.Modes != modes {
+					t.Errorf("(test %d) Bad membership of %s: expected %q, got %#v (%v)", nTest, nick, modes, member, ok)
+				}
+
+				isOperator := false
+				for _, v := range test.operators {
+					isOperator = isOperator || client.EqualFold(v, nick)
+				}
+				if got := client.IsChannelOperator(test.channel, nick); got != isOperator {
+					t.Errorf("(test %d) Expected %s to be an operator: %v, got %v", nTest, nick, isOperator, got)
+				}
+			}
+
+			if got := channel.Modes.String(); got != test.modes {
+				t.Errorf("(test %d) Bad channel modes: expected %s, got %s", nTest, test.modes, got)
+			}
+			for mode, argument := range test.arguments {
+				if got := channel.Modes.GetArgument(mode); got != argument {
+					t.Errorf("(test %d) Bad argument of %c: expected %q, got %q", nTest, mode, argument, got)
+				}
+			}
+
+			if test.lists != nil && !reflect.DeepEqual(channel.Lists, test.lists) {
+				t.Errorf("(test %d) Bad lists: expected %v, got %v", nTest, test.lists, channel.Lists)
+			}
+		}
+
+		for _, expected := range test.users {
+			if user, ok := client.GetUser(expected.Nick); !ok || user != expected {
+				t.Errorf("(test %d) Bad user: expected %#v, got %#v (%v)", nTest, expected, user, ok)
+			}
+		}
+
+		for _, nick := range test.absent {
+			if user, ok := client.GetUser(nick); ok {
+				t.Errorf("(test %d) Expected %s to be forgotten, got %#v", nTest, nick, user)
+			}
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package irc
+
+import (
+	"sort"
+	"strings"
+)
+
+const (
+	//ClientTagPrefix marks a client-only tag, the prefix is kept as a part of the key in Message.Tags
+	ClientTagPrefix = '+'
+)
+
+var (
+	tagValueEscaper = strings.NewReplacer(
+		`\`, `\\`,
+		";", `\:`,
+		" ", `\s`,
+		"\r", `\r`,
+		"\n", `\n`,
+	)
+)
+
+//IsClientOnlyTag returns whether the given tag key is a client-only tag (i.e. it starts with a '+')
+func IsClientOnlyTag(key string) bool {
+	return len(key) > 0 && key[0] == ClientTagPrefix
+}
+
+//EscapeTagValue escapes a tag value as described in the IRCv3 message-tags specification
+func EscapeTagValue(value string) string {
+	return tagValueEscaper.Replace(value)
+}
+
+//UnescapeTagValue reverses EscapeTagValue, invalid escapes drop the backslash and a trailing lone backslash is removed
+func UnescapeTagValue(value string) string {
+	if strings.IndexByte(value, '\\') == -1 {
+		return value
+	}
+
+	builder := strings.Builder{}
+	builder.Grow(len(value))
+
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		if c != '\\' {
+			builder.WriteByte(c)
+			continue
+		}
+
+		i++
+		if i >= len(value) {
+			break
+		}
+
+		switch value[i] {
+		case ':':
+			builder.WriteByte(';')
+		case 's':
+			builder.WriteByte(' ')
+		case 'r':
+			builder.WriteByte('\r')
+		case 'n':
+			builder.WriteByte('\n')
+		default:
+			builder.WriteByte(value[i])
+		}
+	}
+
+	return builder.String()
+}
+
+//ParseTags parses the tag section of a message (without the leading '@') into a map, later duplicates override earlier ones
+func ParseTags(str string) map[string]string {
+	tags := make(map[string]string)
+
+	for _, tag := range strings.Split(str, ";") {
+		if len(tag) == 0 {
+			continue
+		}
+
+		key, value := tag, ""
+		if idx := strings.IndexByte(tag, '='); idx != -1 {
+			key, value = tag[:idx], UnescapeTagValue(tag[idx+1:])
+		}
+
+		if len(key) == 0 || key == string(ClientTagPrefix) {
+			continue
+		}
+
+		tags[key] = value
+	}
+
+	return tags
+}
+
+//SerializeTags is the inverse of ParseTags, keys are sorted to make the output deterministic
+func SerializeTags(tags map[string]string) string {
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	builder := strings.Builder{}
+
+	for i, k := range keys {
+		if i != 0 {
+			builder.WriteByte(';')
+		}
+
+		builder.WriteString(k)
+		if v := tags[k]; len(v) != 0 {
+			builder.WriteByte('=')
+			builder.WriteString(EscapeTagValue(v))
+		}
+	}
+
+	return builder.String()
+}
@@ -0,0 +1,74 @@
+package irc
+
+import (
+	"reflect"
+	"testing"
+)
+
+var tagValueTests = []struct {
+	value   string
+	escaped string
+}{
+	{"plain", "plain"},
+	{"a;b", `a\:b`},
+	{"a b", `a\sb`},
+	{`a\b`, `a\\b`},
+	{"a\rb", `a\rb`},
+	{"a\nb", `a\nb`},
+	{`\`, `\\`},
+	{"; \\\r\n", `\:\s\\\r\n`},
+	{`\s`, `\\s`},
+	{"", ""},
+}
+
+func TestEscapeTagValue(t *testing.T) {
+	for nTest, test := range tagValueTests {
+		if got := EscapeTagValue(test.value); got != test.escaped {
+			t.Errorf("(test %d) Bad escape of %q: expected %q, got %q", nTest, test.value, test.escaped, got)
+		}
+
+		if got := UnescapeTagValue(test.escaped); got != test.value {
+			t.Errorf("(test %d) Bad round trip of %q: expected %q, got %q", nTest, test.escaped, test.value, got)
+		}
+	}
+}
+
+func TestUnescapeTagValue(t *testing.T) {
+	tests := []struct {
+		escaped  string
+		expected string
+	}{
+		//a trailing lone backslash is dropped
+		{`abc\`, "abc"},
+		{`\`, ""},
+		{`a\\\`, `a\`},
+		//invalid escapes drop the backslash
+		{`a\bc`, "abc"},
+		{`\x\:`, "x;"},
+	}
+
+	for nTest, test := range tests {
+		if got := UnescapeTagValue(test.escaped); got != test.expected {
+			t.Errorf("(test %d) Bad unescape of %q: expected %q, got %q", nTest, test.escaped, test.expected, got)
+		}
+	}
+}
+
+func TestTags_RoundTrip(t *testing.T) {
+	tags := map[string]string{
+		"time":          "2022-06-01T12:00:00.000Z",
+		"+draft/reply":  "a; b\\c\r\nd",
+		"label":         "",
+		"+example/tail": `end\`,
+	}
+
+	serialized := SerializeTags(tags)
+	expected := `+draft/reply=a\:\sb\\c\r\nd;+example/tail=end\\;label;time=2022-06-01T12:00:00.000Z`
+	if serialized != expected {
+		t.Errorf("Bad serialization: expected %q, got %q", expected, serialized)
+	}
+
+	if got := ParseTags(serialized); !reflect.DeepEqual(got, tags) {
+		t.Errorf("Tags did not survive a round trip: expected %#v, got %#v", tags, got)
+	}
+}
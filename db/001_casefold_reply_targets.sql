@@ -0,0 +1,8 @@
+-- Reactions for "#Chan" and "#chan" are in the same scope, the reaction module folds the reply target of IRC scopes
+-- (the part after "IRC:SomeNetwork:") with ASCII casefolding and the stored ones have to match
+-- Module identifiers like "IRC:SomeNetwork" are case sensitive and left as they are, lower() only folds ASCII letters
+
+UPDATE reactions
+SET when_replying_to = substr(when_replying_to, 1, instr(substr(when_replying_to, 5), ':') + 4) ||
+                       lower(substr(when_replying_to, instr(substr(when_replying_to, 5), ':') + 5))
+WHERE when_replying_to GLOB 'IRC:*:*';
@@ -0,0 +1,73 @@
+-- Reply strings stored in the legacy intermediate form (enable:inherit:length:text, repeated) are rewritten to the
+-- versioned JSON form, the bot reads both but only writes the latter
+-- Lengths are in bytes so the strings are sliced as blobs, rows that can't be parsed are left as they are
+-- In the legacy form a property in neither list kept the value it had in the previous node, which is every property
+-- enabled so far, such properties are enabled explicitly like FromIntermediate does
+
+WITH RECURSIVE
+    -- every row consumes one field, stage is the last field read (0: enable, 1: inherit, 3: length and text) and -1
+    -- marks a faulty reply string, seen holds the properties enabled up to and including the node and before those
+    -- enabled before it
+    parsed(id, n, stage, rest, colon, enable, inherit, text, seen, before) AS (
+        SELECT id, -1, 3, CAST(reply_str AS BLOB), instr(CAST(reply_str AS BLOB), x'3a'), NULL, NULL, NULL, 0, 0
+        FROM reactions
+        WHERE reply_str NOT LIKE '{%'
+
+        UNION ALL
+
+        SELECT id,
+               n + (stage = 3),
+               CASE
+                   WHEN colon < 2 THEN -1
+                   WHEN stage = 3 AND CAST(substr(rest, 1, colon - 1) AS TEXT) NOT GLOB '*[^0-9]*' THEN 0
+                   WHEN stage = 0 AND CAST(substr(rest, 1, colon - 1) AS TEXT) NOT GLOB '*[^0-9]*' THEN 1
+                   WHEN stage = 1 AND CAST(substr(rest, 1, colon - 1) AS TEXT) = '-1' THEN 3
+                   WHEN stage = 1 AND CAST(substr(rest, 1, colon - 1) AS TEXT) NOT GLOB '*[^0-9]*' AND
+                        CAST(CAST(substr(rest, 1, colon - 1) AS TEXT) AS INTEGER) <= length(substr(rest, colon + 1)) THEN 3
+                   ELSE -1
+               END,
+               CASE
+                   WHEN stage <> 1 THEN substr(rest, colon + 1)
+                   WHEN CAST(substr(rest, 1, colon - 1) AS TEXT) = '-1' THEN x''
+                   ELSE substr(substr(rest, colon + 1), CAST(CAST(substr(rest, 1, colon - 1) AS TEXT) AS INTEGER) + 1)
+               END,
+               CASE
+                   WHEN stage <> 1 THEN instr(substr(rest, colon + 1), x'3a')
+                   WHEN CAST(substr(rest, 1, colon - 1) AS TEXT) = '-1' THEN 0
+                   ELSE instr(substr(substr(rest, colon + 1), CAST(CAST(substr(rest, 1, colon - 1) AS TEXT) AS INTEGER) + 1), x'3a')
+               END,
+               CASE WHEN stage = 3 THEN CAST(CAST(substr(rest, 1, colon - 1) AS TEXT) AS INTEGER) ELSE enable END,
+               CASE WHEN stage = 0 THEN CAST(CAST(substr(rest, 1, colon - 1) AS TEXT) AS INTEGER) ELSE inherit END,
+               CASE
+                   WHEN stage <> 1 THEN NULL
+                   WHEN CAST(substr(rest, 1, colon - 1) AS TEXT) = '-1' THEN substr(rest, colon + 1)
+                   ELSE substr(substr(rest, colon + 1), 1, CAST(CAST(substr(rest, 1, colon - 1) AS TEXT) AS INTEGER))
+               END,
+               CASE WHEN stage = 3 THEN seen | CAST(CAST(substr(rest, 1, colon - 1) AS TEXT) AS INTEGER) ELSE seen END,
+               CASE WHEN stage = 3 THEN seen ELSE before END
+        FROM parsed
+        WHERE stage <> -1 AND (stage <> 3 OR length(rest) > 0)
+    ),
+    names(bit, name) AS (
+        VALUES (1, 'bold'), (2, 'italic'), (4, 'underline'), (8, 'strikethrough'), (16, 'monospace'), (32, 'spoiler'),
+               (64, 'foreground'), (128, 'background')
+    ),
+    -- empty property lists are left out like the bot does, every property is written as "all"
+    nodes(id, n, node) AS (
+        SELECT id, n, json_patch(json_object('text', coalesce(CAST(text AS TEXT), '')), json_object(
+            'enable', json(CASE
+                WHEN enable & 255 = 255 THEN json_array('all')
+                ELSE (SELECT nullif(json_group_array(name), '[]') FROM (SELECT name FROM names WHERE enable & bit ORDER BY name))
+            END),
+            'inherit', json(CASE
+                WHEN inherit & 255 = 255 THEN json_array('all')
+                ELSE (SELECT nullif(json_group_array(name), '[]') FROM (SELECT name FROM names WHERE inherit & bit ORDER BY name))
+            END)
+        ))
+        FROM (SELECT id, n, enable | (before & ~inherit) AS enable, inherit, text FROM parsed WHERE stage = 3 AND n >= 0)
+    )
+UPDATE reactions
+SET reply_str = json_object('version', 2, 'nodes', json((
+    SELECT json_group_array(json(node)) FROM (SELECT node FROM nodes WHERE nodes.id = reactions.id ORDER BY n)
+)))
+WHERE reply_str NOT LIKE '{%' AND id NOT IN (SELECT id FROM parsed WHERE stage = -1);